@@ -2,9 +2,12 @@ module roxy
 
 go 1.22.4
 
-require github.com/BurntSushi/toml v1.4.0
-
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	golang.org/x/sync v0.8.0 // indirect
+	github.com/BurntSushi/toml v1.4.0
+	github.com/google/uuid v1.6.0
+	golang.org/x/sync v0.8.0
 )
+
+require github.com/klauspost/compress v1.17.9
+
+require golang.org/x/crypto v0.26.0
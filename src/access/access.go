@@ -0,0 +1,135 @@
+// Package access restricts the clients of a route by address, HTTP Basic
+// authentication against an htpasswd file and API keys.
+package access
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"roxy/src/watch"
+	"slices"
+	"time"
+)
+
+// Controller applies the [`config.Access`] options of a pattern. The
+// password and key files are read again when they change.
+type Controller struct {
+	options   *config.Access
+	passwords *watch.File[*passwords]
+	keys      *watch.File[keys]
+
+	// Called with the errors of the password and key files, the previous
+	// content stays in force until they are fixed.
+	ErrorLog func(error)
+}
+
+// New creates the controller described by options and loads its files.
+func New(options *config.Access) (*Controller, error) {
+	controller := &Controller{options: options}
+
+	if options.HTPasswd != "" {
+		passwords, err := watch.NewFile(options.HTPasswd, parsePasswords)
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd: %w", err)
+		}
+		controller.passwords = passwords
+	}
+
+	if options.APIKeys != "" {
+		keys, err := watch.NewFile(options.APIKeys, parseKeys)
+		if err != nil {
+			return nil, fmt.Errorf("api keys: %w", err)
+		}
+		controller.keys = keys
+	}
+
+	return controller, nil
+}
+
+// Check returns the response refusing r, sent by clientIP, or nil if the
+// client is allowed in. The password or API key that let it in is removed
+// from r.
+func (c *Controller) Check(r *http.Request, clientIP string) *http.Response {
+	ip := net.ParseIP(clientIP)
+	if contains(c.options.DenyNetworks, ip) ||
+		(len(c.options.AllowNetworks) > 0 && !contains(c.options.AllowNetworks, ip)) {
+		return new(local_http.LocalResponse).Forbidden()
+	}
+
+	if c.passwords == nil && c.keys == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if c.passwords != nil {
+		if user, password, ok := r.BasicAuth(); ok {
+			passwords, err := c.passwords.Get(now)
+			c.logError("htpasswd", err)
+			if passwords.verify(user, password) {
+				// The backend has no use for the password.
+				r.Header.Del("Authorization")
+				return nil
+			}
+		}
+	}
+	if c.keys != nil {
+		if key := c.apiKey(r); key != "" {
+			keys, err := c.keys.Get(now)
+			c.logError("api keys", err)
+			if keys.lookup(key) {
+				c.removeAPIKey(r)
+				return nil
+			}
+		}
+	}
+
+	var challenges []string
+	if c.passwords != nil {
+		challenges = append(challenges, fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, c.options.Realm))
+	}
+	if c.keys != nil {
+		challenges = append(challenges, fmt.Sprintf(`APIKey realm="%s"`, c.options.Realm))
+	}
+	return new(local_http.LocalResponse).Unauthorized(challenges...)
+}
+
+// apiKey returns the key sent in the header or query parameter of r.
+func (c *Controller) apiKey(r *http.Request) string {
+	if c.options.APIKeyHeader != "" {
+		if key := r.Header.Get(c.options.APIKeyHeader); key != "" {
+			return key
+		}
+	}
+	if c.options.APIKeyQuery != "" {
+		return r.URL.Query().Get(c.options.APIKeyQuery)
+	}
+	return ""
+}
+
+// removeAPIKey removes the API key from r, so that it doesn't reach the
+// backend.
+func (c *Controller) removeAPIKey(r *http.Request) {
+	if c.options.APIKeyHeader != "" {
+		r.Header.Del(c.options.APIKeyHeader)
+	}
+	if c.options.APIKeyQuery != "" {
+		if query := r.URL.Query(); query.Has(c.options.APIKeyQuery) {
+			query.Del(c.options.APIKeyQuery)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+}
+
+func (c *Controller) logError(file string, err error) {
+	if err != nil && c.ErrorLog != nil {
+		c.ErrorLog(fmt.Errorf("%s: %w", file, err))
+	}
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	return ip != nil && slices.ContainsFunc(networks, func(network *net.IPNet) bool {
+		return network.Contains(ip)
+	})
+}
@@ -0,0 +1,132 @@
+package access
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func networks(t *testing.T, values ...string) []*net.IPNet {
+	var parsed []*net.IPNet
+	for _, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed
+}
+
+func status(resp *http.Response) int {
+	if resp == nil {
+		return http.StatusOK
+	}
+	return resp.StatusCode
+}
+
+func TestAddresses(t *testing.T) {
+	controller, err := New(&config.Access{
+		AllowNetworks: networks(t, "10.0.0.0/8"),
+		DenyNetworks:  networks(t, "10.0.0.5/32"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for client, want := range map[string]int{
+		"10.1.2.3":  http.StatusOK,
+		"10.0.0.5":  http.StatusForbidden,
+		"192.0.2.1": http.StatusForbidden,
+	} {
+		if got := status(controller.Check(r, client)); got != want {
+			t.Errorf("%s: status = %d, want %d", client, got, want)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	dir := t.TempDir()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd := filepath.Join(dir, "htpasswd")
+	os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0644)
+	keysFile := filepath.Join(dir, "keys")
+	os.WriteFile(keysFile, []byte("key-1 partner\n"), 0644)
+
+	controller, err := New(&config.Access{
+		HTPasswd:     htpasswd,
+		Realm:        "admin",
+		APIKeys:      keysFile,
+		APIKeyHeader: "X-API-Key",
+		APIKeyQuery:  "api_key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	resp := controller.Check(r, "192.0.2.1")
+	if status(resp) != http.StatusUnauthorized || len(resp.Header.Values("WWW-Authenticate")) != 2 ||
+		resp.Header.Get("WWW-Authenticate") != `Basic realm="admin", charset="UTF-8"` {
+		t.Fatalf("anonymous request: %d %v", status(resp), resp.Header)
+	}
+
+	for i, credentials := range []struct {
+		user, password string
+		want           int
+	}{{"alice", "secret", http.StatusOK}, {"alice", "wrong", http.StatusUnauthorized}, {"bob", "secret", http.StatusUnauthorized}} {
+		// Twice, the second check of a valid password is remembered.
+		for range 2 {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.SetBasicAuth(credentials.user, credentials.password)
+			if got := status(controller.Check(r, "192.0.2.1")); got != credentials.want {
+				t.Errorf("credentials %d: status = %d, want %d", i, got, credentials.want)
+			}
+			if _, _, sent := r.BasicAuth(); sent != (credentials.want != http.StatusOK) {
+				t.Errorf("credentials %d: Authorization header kept = %v", i, sent)
+			}
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/?api_key=key-1&page=2", nil)
+	if got := status(controller.Check(r, "192.0.2.1")); got != http.StatusOK {
+		t.Errorf("key in the query: status = %d", got)
+	}
+	if r.URL.RawQuery != "page=2" {
+		t.Errorf("query after the key was accepted = %q", r.URL.RawQuery)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "key-2")
+	if got := status(controller.Check(r, "192.0.2.1")); got != http.StatusUnauthorized {
+		t.Errorf("unknown key: status = %d", got)
+	}
+
+	// The keys file is read again once it changes.
+	os.WriteFile(keysFile, []byte("key-2\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keysFile, later, later)
+	controller.keys.Expire()
+	if got := status(controller.Check(r, "192.0.2.1")); got != http.StatusOK || r.Header.Get("X-API-Key") != "" {
+		t.Errorf("key added to the file: status = %d, header %q", got, r.Header.Get("X-API-Key"))
+	}
+
+	// A broken file keeps the previous keys.
+	os.WriteFile(htpasswd, []byte("alice:plaintext\n"), 0644)
+	os.Chtimes(htpasswd, later, later)
+	controller.passwords.Expire()
+	var logged error
+	controller.ErrorLog = func(err error) { logged = err }
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("alice", "secret")
+	if got := status(controller.Check(r, "192.0.2.1")); got != http.StatusOK || logged == nil {
+		t.Errorf("broken htpasswd: status = %d, error = %v", got, logged)
+	}
+}
@@ -0,0 +1,113 @@
+package access
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Successful password checks remembered, bcrypt being slow on purpose.
+const maxVerified = 1024
+
+// lines calls fn with the number and content of the lines of data that are
+// neither blank nor comments.
+func lines(data []byte, fn func(int, string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(number, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// passwords are the users of an htpasswd file.
+type passwords struct {
+	hashes map[string][]byte
+
+	mu sync.Mutex
+	// Digests of the user and password pairs known to be valid.
+	verified map[[sha256.Size]byte]bool
+}
+
+// parsePasswords reads an htpasswd file of user:hash lines, only bcrypt
+// hashes are supported.
+func parsePasswords(data []byte) (*passwords, error) {
+	p := &passwords{hashes: make(map[string][]byte), verified: make(map[[sha256.Size]byte]bool)}
+	err := lines(data, func(number int, line string) error {
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("line %d: expected user:hash", number)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("line %d: user %q: only bcrypt hashes are supported", number, user)
+		}
+		p.hashes[user] = []byte(hash)
+		return nil
+	})
+	return p, err
+}
+
+// Compared with the passwords of unknown users, so that checking them takes
+// as long as checking known ones.
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (p *passwords) verify(user, password string) bool {
+	hash, ok := p.hashes[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+	p.mu.Lock()
+	verified := p.verified[digest]
+	p.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	p.mu.Lock()
+	if len(p.verified) >= maxVerified {
+		clear(p.verified)
+	}
+	p.verified[digest] = true
+	p.mu.Unlock()
+	return true
+}
+
+// keys are the API keys of a keys file, indexed by their digest so that
+// looking them up doesn't leak their content through timing. Values are the
+// names following the keys.
+type keys map[[sha256.Size]byte]string
+
+func parseKeys(data []byte) (keys, error) {
+	parsed := make(keys)
+	err := lines(data, func(number int, line string) error {
+		key, name, _ := strings.Cut(line, " ")
+		parsed[sha256.Sum256([]byte(key))] = strings.TrimSpace(name)
+		return nil
+	})
+	return parsed, err
+}
+
+func (k keys) lookup(key string) bool {
+	_, ok := k[sha256.Sum256([]byte(key))]
+	return ok
+}
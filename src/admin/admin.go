@@ -0,0 +1,194 @@
+// Package admin implements the local HTTP API used to inspect and purge the
+// response caches.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"roxy/src/httpcache"
+	"roxy/src/service"
+	"strings"
+	"time"
+)
+
+// Handler serves the admin API:
+//
+//	GET  /cache                        keys of every cache, filtered by prefix
+//	GET  /cache/entry?key=K            stored responses of a key
+//	POST /cache/purge?key=K            purge by exact key,
+//	POST /cache/purge?prefix=P         by key prefix,
+//	POST /cache/purge?tag=T            or by surrogate key
+//
+// Every endpoint accepts the host and route parameters to restrict it to
+// some caches, host being the log name of a host and route the uri, path or
+// path_regex of a pattern.
+type Handler struct {
+	routes []service.CachedRoute
+	mux    *http.ServeMux
+}
+
+func NewHandler(routes []service.CachedRoute) *Handler {
+	handler := &Handler{routes: routes, mux: http.NewServeMux()}
+	handler.mux.HandleFunc("GET /cache", handler.list)
+	handler.mux.HandleFunc("GET /cache/entry", handler.entry)
+	handler.mux.HandleFunc("POST /cache/purge", handler.purge)
+	return handler
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type cacheKeys struct {
+	Host  string   `json:"host"`
+	Route string   `json:"route"`
+	Keys  []string `json:"keys"`
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	result := []cacheKeys{}
+	for _, route := range h.selected(r) {
+		keys := []string{}
+		for _, key := range route.Cache.Keys() {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		result = append(result, cacheKeys{Host: route.Host, Route: route.Route, Keys: keys})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+type entryInfo struct {
+	Host      string         `json:"host"`
+	Route     string         `json:"route"`
+	Key       string         `json:"key"`
+	Vary      []string       `json:"vary,omitempty"`
+	Responses []responseInfo `json:"responses"`
+}
+
+type responseInfo struct {
+	VaryValues []string    `json:"vary_values,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Size       int         `json:"size"`
+	Tags       []string    `json:"tags,omitempty"`
+	StoredAt   time.Time   `json:"stored_at"`
+
+	// In seconds, TTL is negative once the response is stale.
+	Age int64 `json:"age"`
+	TTL int64 `json:"ttl"`
+}
+
+func (h *Handler) entry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "the key parameter is required")
+		return
+	}
+
+	now := time.Now()
+	result := []entryInfo{}
+	for _, route := range h.selected(r) {
+		entry, err := route.Cache.Inspect(key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if entry == nil {
+			continue
+		}
+
+		info := entryInfo{Host: route.Host, Route: route.Route, Key: entry.Key, Vary: entry.Vary}
+		for _, response := range entry.Responses {
+			info.Responses = append(info.Responses, responseInfo{
+				VaryValues: response.VaryValues,
+				Status:     response.Status,
+				Header:     response.Header,
+				Size:       len(response.Body),
+				Tags:       route.Cache.Tags(response),
+				StoredAt:   response.ResponseTime,
+				Age:        int64(response.Age(now) / time.Second),
+				TTL:        int64(response.TTL(now) / time.Second),
+			})
+		}
+		result = append(result, info)
+	}
+
+	if len(result) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no entry stored under %q", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) purge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var purge func(*httpcache.Cache) (int, error)
+	set := 0
+	if key := query.Get("key"); key != "" {
+		set++
+		purge = func(cache *httpcache.Cache) (int, error) {
+			purged, err := cache.PurgeKey(key)
+			if purged {
+				return 1, err
+			}
+			return 0, err
+		}
+	}
+	if prefix := query.Get("prefix"); prefix != "" {
+		set++
+		purge = func(cache *httpcache.Cache) (int, error) { return cache.PurgePrefix(prefix) }
+	}
+	if tag := query.Get("tag"); tag != "" {
+		set++
+		purge = func(cache *httpcache.Cache) (int, error) { return cache.PurgeTag(tag) }
+	}
+	if set != 1 {
+		writeError(w, http.StatusBadRequest, "exactly one of the key, prefix and tag parameters is required")
+		return
+	}
+
+	total := 0
+	for _, route := range h.selected(r) {
+		purged, err := purge(route.Cache)
+		total += purged
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"purged": total})
+}
+
+// selected returns the caches matching the host and route parameters of r.
+func (h *Handler) selected(r *http.Request) []service.CachedRoute {
+	host := r.URL.Query().Get("host")
+	route := r.URL.Query().Get("route")
+
+	var selected []service.CachedRoute
+	for _, candidate := range h.routes {
+		if (host == "" || candidate.Host == host) && (route == "" || candidate.Route == route) {
+			selected = append(selected, candidate)
+		}
+	}
+	return selected
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
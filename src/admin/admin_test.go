@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"roxy/src/httpcache"
+	"roxy/src/service"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newHandler returns a handler over the caches of two routes of a host, the
+// assets one holding a.js and b.js and the pages one holding index.html.
+func newHandler(t *testing.T) *Handler {
+	t.Helper()
+
+	cache := func(paths ...string) *httpcache.Cache {
+		cache := &httpcache.Cache{Storage: httpcache.NewMemoryStorage(1 << 20), TagHeader: "Surrogate-Key"}
+		for _, path := range paths {
+			err := cache.Storage.Put(&httpcache.Entry{
+				Key: "http://example.com" + path,
+				Responses: []*httpcache.Response{{
+					Status:       http.StatusOK,
+					Header:       http.Header{"Cache-Control": {"max-age=60"}, "Surrogate-Key": {"all " + path[1:]}},
+					Body:         []byte(path),
+					RequestTime:  time.Now(),
+					ResponseTime: time.Now(),
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return cache
+	}
+
+	return NewHandler([]service.CachedRoute{
+		{Host: "example.com", Route: "/assets", Cache: cache("/a.js", "/b.js")},
+		{Host: "example.com", Route: "/", Cache: cache("/index.html")},
+	})
+}
+
+func serve(t *testing.T, handler *Handler, method, target string, result any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("%s %s: %v, body %q", method, target, err, w.Body.String())
+	}
+	return w.Code
+}
+
+func TestList(t *testing.T) {
+	handler := newHandler(t)
+
+	var caches []cacheKeys
+	if status := serve(t, handler, "GET", "/cache", &caches); status != http.StatusOK || len(caches) != 2 {
+		t.Fatalf("list: status %d, %+v", status, caches)
+	}
+	if !slices.Equal(caches[0].Keys, []string{"http://example.com/a.js", "http://example.com/b.js"}) {
+		t.Errorf("keys of /assets = %v", caches[0].Keys)
+	}
+
+	serve(t, handler, "GET", "/cache?prefix=http://example.com/a", &caches)
+	if len(caches[0].Keys) != 1 || len(caches[1].Keys) != 0 {
+		t.Errorf("list by prefix: %+v", caches)
+	}
+
+	serve(t, handler, "GET", "/cache?route=/", &caches)
+	if len(caches) != 1 || caches[0].Route != "/" {
+		t.Errorf("list by route: %+v", caches)
+	}
+}
+
+func TestEntry(t *testing.T) {
+	handler := newHandler(t)
+
+	var entries []entryInfo
+	if status := serve(t, handler, "GET", "/cache/entry?key=http://example.com/a.js", &entries); status != http.StatusOK {
+		t.Fatalf("entry: status %d", status)
+	}
+	if len(entries) != 1 || entries[0].Route != "/assets" || len(entries[0].Responses) != 1 {
+		t.Fatalf("entry: %+v", entries)
+	}
+	if response := entries[0].Responses[0]; response.Size != 5 || !slices.Equal(response.Tags, []string{"all", "a.js"}) || response.TTL <= 0 {
+		t.Errorf("entry response: %+v", response)
+	}
+
+	var failure map[string]string
+	if status := serve(t, handler, "GET", "/cache/entry?key=http://example.com/missing", &failure); status != http.StatusNotFound {
+		t.Errorf("missing entry: status %d", status)
+	}
+	if status := serve(t, handler, "GET", "/cache/entry", &failure); status != http.StatusBadRequest {
+		t.Errorf("entry without key: status %d", status)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var result map[string]int
+	for target, want := range map[string]int{
+		"/cache/purge?key=http://example.com/a.js":    1,
+		"/cache/purge?key=http://example.com/missing": 0,
+		"/cache/purge?prefix=http://example.com/":     3,
+		"/cache/purge?tag=all":                        3,
+		"/cache/purge?tag=index.html":                 1,
+		"/cache/purge?tag=all&route=/assets":          2,
+		"/cache/purge?tag=all&host=other.com":         0,
+	} {
+		handler := newHandler(t)
+		if status := serve(t, handler, "POST", target, &result); status != http.StatusOK || result["purged"] != want {
+			t.Errorf("%s: status %d, %v, want %d purged", target, status, result, want)
+		}
+	}
+
+	handler := newHandler(t)
+	serve(t, handler, "POST", "/cache/purge?tag=a.js", &result)
+	var caches []cacheKeys
+	serve(t, handler, "GET", "/cache", &caches)
+	if !slices.Equal(caches[0].Keys, []string{"http://example.com/b.js"}) || len(caches[1].Keys) != 1 {
+		t.Errorf("keys left after purging a tag: %+v", caches)
+	}
+
+	var failure map[string]string
+	for _, target := range []string{
+		"/cache/purge",
+		"/cache/purge?key=http://example.com/a.js&tag=all",
+		"/cache/purge?key=k&prefix=p&tag=t",
+	} {
+		if status := serve(t, handler, "POST", target, &failure); status != http.StatusBadRequest || failure["error"] == "" {
+			t.Errorf("%s: status %d, %v", target, status, failure)
+		}
+	}
+}
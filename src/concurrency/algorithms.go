@@ -0,0 +1,93 @@
+package concurrency
+
+import (
+	"math"
+	"time"
+)
+
+// sample is what a limiter learns from a request.
+type sample struct {
+	latency time.Duration
+	// Requests in flight when it was sent, itself included.
+	inflight int
+	// Whether it failed or the backend answered that it is overloaded.
+	dropped bool
+}
+
+// algorithm computes the next limit from the current one and a sample.
+type algorithm interface {
+	update(limit float64, s sample) float64
+}
+
+// aimd grows the limit by one while the backends keep up, and multiplies it
+// by backoff as soon as a request is dropped or slower than threshold.
+type aimd struct {
+	threshold time.Duration
+	backoff   float64
+}
+
+func (a *aimd) update(limit float64, s sample) float64 {
+	if s.dropped || s.latency > a.threshold {
+		return limit * a.backoff
+	}
+	// A limit that isn't reached tells nothing about the backends.
+	if float64(s.inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+const (
+	// Number of samples averaged by the long-term latency, and of the first
+	// ones averaged evenly.
+	gradientWindow = 600
+	gradientWarmup = 10
+
+	// Weight of the new limit against the current one.
+	gradientSmoothing = 0.2
+
+	// Ratio applied to the limit when a request is dropped.
+	gradientBackoff = 0.9
+)
+
+// gradient compares the latency of every request to a long-term average.
+// The limit shrinks as the latency grows beyond tolerance times the average,
+// by half at most, and otherwise grows by the square root of the limit,
+// which leaves some requests queued at the backends to absorb bursts. A
+// dropped request multiplies the limit by gradientBackoff.
+type gradient struct {
+	tolerance float64
+
+	// Long-term latency, in seconds.
+	average float64
+	samples int
+}
+
+func (g *gradient) update(limit float64, s sample) float64 {
+	// The latency of a failure, often quick, says nothing of the backends.
+	if s.dropped {
+		return limit * gradientBackoff
+	}
+
+	latency := max(s.latency, time.Microsecond).Seconds()
+
+	if g.samples < gradientWarmup {
+		g.samples++
+		g.average += (latency - g.average) / float64(g.samples)
+	} else {
+		g.average += (latency - g.average) * 2 / (gradientWindow + 1)
+	}
+	// Once the backends recover, their latency falls well below an average
+	// raised by the overload, let the average catch up faster.
+	if g.average/latency > 2 {
+		g.average *= 0.95
+	}
+
+	if float64(s.inflight) < limit/2 {
+		return limit
+	}
+
+	ratio := max(0.5, min(1, g.tolerance*g.average/latency))
+	next := limit*ratio + math.Sqrt(limit)
+	return limit*(1-gradientSmoothing) + next*gradientSmoothing
+}
@@ -0,0 +1,192 @@
+// Package concurrency limits the requests in flight to the backends of a
+// route, adapting the limit to their latency.
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"roxy/src/config"
+	"roxy/src/metrics"
+	"sync"
+	"time"
+)
+
+// ErrLimited is returned by [`Limiter.Acquire`] when the queue is full or
+// the request waited too long for a slot.
+var ErrLimited = errors.New("concurrency limit reached")
+
+// Limiter admits requests while fewer than its limit are in flight, the
+// others wait in a FIFO queue. The limit is updated by the algorithm after
+// every request, between MinLimit and MaxLimit.
+type Limiter struct {
+	algorithm algorithm
+	minLimit  float64
+	maxLimit  float64
+
+	queueSize    int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	// Waiting requests, *waiter values.
+	queue *list.List
+
+	Rejected *metrics.Counter
+}
+
+type waiter struct {
+	ready chan struct{}
+	// Set when admitted, before ready is closed.
+	slot *Slot
+}
+
+// New creates the limiter described by options.
+func New(options *config.Concurrency, labels metrics.Labels) *Limiter {
+	limiter := &Limiter{
+		minLimit:     float64(options.MinLimit),
+		maxLimit:     float64(options.MaxLimit),
+		queueSize:    options.QueueSize,
+		queueTimeout: time.Duration(options.QueueTimeout) * time.Millisecond,
+		limit:        float64(options.InitialLimit),
+		queue:        list.New(),
+		Rejected:     metrics.Default.Counter("roxy_concurrency_rejected_total", "Requests rejected by a concurrency limit.", labels),
+	}
+
+	switch options.Algorithm {
+	case "aimd":
+		limiter.algorithm = &aimd{
+			threshold: time.Duration(options.Latency) * time.Millisecond,
+			backoff:   options.BackoffRatio,
+		}
+	default:
+		limiter.algorithm = &gradient{tolerance: options.Tolerance}
+	}
+
+	metrics.Default.GaugeFunc("roxy_concurrency_limit", "Current concurrency limit.", labels, func() float64 {
+		return float64(limiter.Limit())
+	})
+	metrics.Default.GaugeFunc("roxy_concurrency_in_flight", "Requests in flight under a concurrency limit.", labels, func() float64 {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return float64(limiter.inflight)
+	})
+	metrics.Default.GaugeFunc("roxy_concurrency_queued", "Requests waiting for a concurrency limit.", labels, func() float64 {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return float64(limiter.queue.Len())
+	})
+
+	return limiter
+}
+
+// Limit returns the number of requests currently allowed in flight.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// Acquire returns a slot for a request, waiting in the queue if the limit
+// is reached. It fails with ErrLimited if the queue is full or no slot
+// frees up in time, and with the error of ctx if it is done first.
+func (l *Limiter) Acquire(ctx context.Context) (*Slot, error) {
+	l.mu.Lock()
+	if l.queue.Len() == 0 && l.inflight < int(l.limit) {
+		slot := l.admit()
+		l.mu.Unlock()
+		return slot, nil
+	}
+	if l.queue.Len() >= l.queueSize {
+		l.mu.Unlock()
+		l.Rejected.Inc()
+		return nil, ErrLimited
+	}
+	w := &waiter{ready: make(chan struct{})}
+	element := l.queue.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return w.slot, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Admitted while giving up.
+	if w.slot != nil {
+		return w.slot, nil
+	}
+	l.queue.Remove(element)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	l.Rejected.Inc()
+	return nil, ErrLimited
+}
+
+// admit takes a slot, l.mu must be held.
+func (l *Limiter) admit() *Slot {
+	l.inflight++
+	return &Slot{limiter: l, start: time.Now(), inflight: l.inflight}
+}
+
+// dispatch admits waiting requests while the limit allows it, l.mu must be
+// held.
+func (l *Limiter) dispatch() {
+	for l.queue.Len() > 0 && l.inflight < int(l.limit) {
+		w := l.queue.Remove(l.queue.Front()).(*waiter)
+		w.slot = l.admit()
+		close(w.ready)
+	}
+}
+
+// Slot is a request admitted by a limiter. Its latency is reported with
+// Done once the response headers are received, and it is given back with
+// Release once the response is over.
+type Slot struct {
+	limiter  *Limiter
+	start    time.Time
+	inflight int
+
+	done     sync.Once
+	released sync.Once
+}
+
+// Done updates the limit with the latency of the request, dropped telling
+// that it failed or that the backend is overloaded.
+func (s *Slot) Done(dropped bool) {
+	s.done.Do(func() {
+		l := s.limiter
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		limit := l.algorithm.update(l.limit, sample{
+			latency:  time.Since(s.start),
+			inflight: s.inflight,
+			dropped:  dropped,
+		})
+		l.limit = max(l.minLimit, min(l.maxLimit, limit))
+		l.dispatch()
+	})
+}
+
+// Release gives the slot back.
+func (s *Slot) Release() {
+	s.released.Do(func() {
+		l := s.limiter
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.inflight--
+		l.dispatch()
+	})
+}
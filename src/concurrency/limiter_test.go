@@ -0,0 +1,136 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"roxy/src/config"
+	"roxy/src/metrics"
+	"testing"
+	"time"
+)
+
+func newLimiter(t *testing.T, options config.Concurrency) *Limiter {
+	options.MinLimit = max(options.MinLimit, 1)
+	if options.MaxLimit == 0 {
+		options.MaxLimit = 100
+	}
+	if options.Tolerance == 0 {
+		options.Tolerance = 1.5
+	}
+	return New(&options, metrics.Labels{"test": t.Name()})
+}
+
+func TestLimiterQueue(t *testing.T) {
+	limiter := newLimiter(t, config.Concurrency{InitialLimit: 1, MaxLimit: 1, QueueSize: 1, QueueTimeout: 1000})
+	// The counter outlives the limiter when tests run several times.
+	rejected := limiter.Rejected.Value()
+
+	first, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan *Slot)
+	go func() {
+		slot, err := limiter.Acquire(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		admitted <- slot
+	}()
+
+	// Wait for the request to be queued.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		limiter.mu.Lock()
+		queued := limiter.queue.Len()
+		limiter.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not queued")
+		}
+	}
+
+	if _, err := limiter.Acquire(context.Background()); !errors.Is(err, ErrLimited) {
+		t.Fatalf("request over a full queue: %v", err)
+	}
+
+	first.Done(false)
+	first.Release()
+	second := <-admitted
+	if second == nil {
+		t.Fatal("queued request not admitted")
+	}
+	second.Release()
+
+	if got := limiter.Rejected.Value() - rejected; got != 1 {
+		t.Errorf("rejected = %v, want 1", got)
+	}
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	limiter := newLimiter(t, config.Concurrency{InitialLimit: 1, MaxLimit: 1, QueueSize: 10, QueueTimeout: 50})
+
+	slot, _ := limiter.Acquire(context.Background())
+	defer slot.Release()
+
+	start := time.Now()
+	if _, err := limiter.Acquire(context.Background()); !errors.Is(err, ErrLimited) {
+		t.Fatalf("request waiting too long: %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("rejected after %v, before the queue timeout", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled request: %v", err)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	a := &aimd{threshold: 100 * time.Millisecond, backoff: 0.5}
+
+	if limit := a.update(10, sample{latency: time.Millisecond, inflight: 10}); limit != 11 {
+		t.Errorf("fast request at the limit: %v, want 11", limit)
+	}
+	if limit := a.update(10, sample{latency: time.Millisecond, inflight: 2}); limit != 10 {
+		t.Errorf("fast request under the limit: %v, want 10", limit)
+	}
+	if limit := a.update(10, sample{latency: time.Second, inflight: 10}); limit != 5 {
+		t.Errorf("slow request: %v, want 5", limit)
+	}
+	if limit := a.update(10, sample{latency: time.Millisecond, inflight: 10, dropped: true}); limit != 5 {
+		t.Errorf("dropped request: %v, want 5", limit)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	g := &gradient{tolerance: 1.5}
+
+	limit := 20.0
+	for range 100 {
+		limit = g.update(limit, sample{latency: 10 * time.Millisecond, inflight: int(limit)})
+	}
+	if limit <= 20 {
+		t.Fatalf("limit with a steady latency = %v, want it to grow", limit)
+	}
+
+	grown := limit
+	for range 20 {
+		limit = g.update(limit, sample{latency: 100 * time.Millisecond, inflight: int(limit)})
+	}
+	if limit >= grown/2 {
+		t.Errorf("limit after the latency rose = %v, want it to shrink from %v", limit, grown)
+	}
+
+	average := g.average
+	if limit := g.update(20, sample{latency: time.Microsecond, inflight: 20, dropped: true}); limit != 18 {
+		t.Errorf("dropped request: %v, want 18", limit)
+	}
+	if g.average != average {
+		t.Errorf("dropped request changed the average latency from %v to %v", average, g.average)
+	}
+}
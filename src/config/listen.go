@@ -0,0 +1,168 @@
+package config
+
+import "fmt"
+
+// Listen is an entry of the server listen array. It can be written as a
+// plain "address:port" string or as a table with extra options:
+//
+//	listen = ["127.0.0.1:8100", { address = "0.0.0.0:443", tls = true }]
+type Listen struct {
+	Address string `toml:"address"`
+
+	// Terminate TLS on this socket using the certificates of the hosts.
+	TLS bool `toml:"tls"`
+
+	// Strict-Transport-Security header added to responses of TLS sockets.
+	HSTS *HSTS `toml:"hsts"`
+
+	// Answer every request on this plaintext socket with a redirect to the
+	// HTTPS URL on HTTPSPort, except for paths starting with one of Exempt.
+	RedirectToHTTPS bool     `toml:"redirect_to_https"`
+	HTTPSPort       int      `toml:"https_port"`
+	Exempt          []string `toml:"exempt"`
+}
+
+// Default max_age of HSTS, one year, which is also the least the preload
+// lists accept.
+const hstsPreloadMaxAge = 31536000
+
+type HSTS struct {
+	// Seconds browsers remember to use HTTPS, one year by default.
+	MaxAge            int  `toml:"max_age"`
+	IncludeSubDomains bool `toml:"include_subdomains"`
+	Preload           bool `toml:"preload"`
+}
+
+// UnmarshalTOML implements toml.Unmarshaler so that both forms are accepted.
+func (l *Listen) UnmarshalTOML(data any) error {
+	switch value := data.(type) {
+	case string:
+		l.Address = value
+	case map[string]any:
+		for key, v := range value {
+			var err error
+			switch key {
+			case "address":
+				l.Address, err = tomlString(key, v)
+			case "tls":
+				l.TLS, err = tomlBool(key, v)
+			case "redirect_to_https":
+				l.RedirectToHTTPS, err = tomlBool(key, v)
+			case "https_port":
+				l.HTTPSPort, err = tomlInt(key, v)
+			case "exempt":
+				l.Exempt, err = tomlStrings(key, v)
+			case "hsts":
+				l.HSTS, err = tomlHSTS(v)
+			default:
+				err = fmt.Errorf("listen: unknown key %q", key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("listen: expected string or table, got %T", data)
+	}
+
+	if l.Address == "" {
+		return fmt.Errorf("listen: missing address")
+	}
+
+	if l.RedirectToHTTPS && l.TLS {
+		return fmt.Errorf("listen %s: redirect_to_https only applies to plaintext sockets", l.Address)
+	}
+
+	if l.HSTS != nil && !l.TLS {
+		return fmt.Errorf("listen %s: hsts only applies to TLS sockets", l.Address)
+	}
+
+	if l.HTTPSPort == 0 {
+		l.HTTPSPort = 443
+	}
+
+	return nil
+}
+
+func (l Listen) String() string {
+	return l.Address
+}
+
+func tomlString(key string, v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("listen: %s must be a string, got %T", key, v)
+	}
+	return s, nil
+}
+
+func tomlBool(key string, v any) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("listen: %s must be a boolean, got %T", key, v)
+	}
+	return b, nil
+}
+
+func tomlInt(key string, v any) (int, error) {
+	i, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("listen: %s must be an integer, got %T", key, v)
+	}
+	return int(i), nil
+}
+
+func tomlStrings(key string, v any) ([]string, error) {
+	values, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("listen: %s must be an array, got %T", key, v)
+	}
+
+	strings := make([]string, 0, len(values))
+	for _, value := range values {
+		s, err := tomlString(key, value)
+		if err != nil {
+			return nil, err
+		}
+		strings = append(strings, s)
+	}
+
+	return strings, nil
+}
+
+func tomlHSTS(v any) (*HSTS, error) {
+	table, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("listen: hsts must be a table, got %T", v)
+	}
+
+	hsts := &HSTS{MaxAge: hstsPreloadMaxAge}
+	for key, value := range table {
+		var err error
+		switch key {
+		case "max_age":
+			hsts.MaxAge, err = tomlInt(key, value)
+		case "include_subdomains":
+			hsts.IncludeSubDomains, err = tomlBool(key, value)
+		case "preload":
+			hsts.Preload, err = tomlBool(key, value)
+		default:
+			err = fmt.Errorf("listen: unknown hsts key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if hsts.MaxAge <= 0 {
+		return nil, fmt.Errorf("listen: invalid hsts max_age %d", hsts.MaxAge)
+	}
+
+	// Browsers only accept preload lists entries that cover subdomains for
+	// at least a year.
+	if hsts.Preload && (!hsts.IncludeSubDomains || hsts.MaxAge < hstsPreloadMaxAge) {
+		return nil, fmt.Errorf("listen: hsts preload requires include_subdomains and a max_age of at least %d", hstsPreloadMaxAge)
+	}
+
+	return hsts, nil
+}
@@ -1,7 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"html/template"
 	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -10,8 +18,10 @@ type Algorithm string
 type ActionType string
 
 const (
-	ServeAction   ActionType = "serve"
-	ForwardAction ActionType = "forward"
+	ServeAction    ActionType = "serve"
+	ForwardAction  ActionType = "forward"
+	RedirectAction ActionType = "redirect"
+	RespondAction  ActionType = "respond"
 )
 
 const (
@@ -21,11 +31,124 @@ const (
 type ServerConfig struct {
 	URI      string   `toml:"uri"`
 	NAME     string   `toml:"name"`
-	LISTEN   []string `toml:"listen"`
-	MAXCONN  int16    `toml:"max_connections"`
+	LISTEN   []Listen `toml:"listen"`
+	MAXCONN  int      `toml:"max_connections"`
 	LOGFILE  string   `toml:"logfile"`
 	LOGLEVEL string   `toml:"loglevel"`
 	LOGNAME  string
+
+	// What happens to new connections once max_connections are open,
+	// "wait" stops accepting them until one is closed and "reject" answers
+	// them with 503 Service Unavailable, retrying after OverloadRetryAfter
+	// seconds.
+	Overload           string `toml:"overload"`
+	OverloadRetryAfter int    `toml:"overload_retry_after"`
+
+	// Certificate and error pages of the implicit default host made of the
+	// top level [[match]] patterns.
+	TLS        *TLSConfig        `toml:"tls"`
+	ErrorPages map[string]string `toml:"error_pages"`
+
+	// Addresses or CIDR ranges of the proxies in front of roxy. The client
+	// address of their requests is taken from X-Forwarded-For.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	TrustedNetworks []*net.IPNet `toml:"-"`
+
+	// Protection of the listeners against clients holding connections.
+	Limits ConnectionLimits `toml:"limits"`
+
+	// Bounds the requests handled at once, shedding low priority ones first.
+	Shedding *LoadShedding `toml:"shedding"`
+}
+
+// LoadShedding bounds the requests handled at once by all the listeners.
+// Requests beyond MaxRequests wait in a queue of QueueSize requests for at
+// most QueueTimeout milliseconds. They are admitted by tier, highest first,
+// and within a tier in turns between clients, so that no client can take
+// all the capacity. Once the queue is full, a request of a lower tier than
+// the incoming one is dropped, from the client with the most queued
+// requests. Requests that are dropped or wait too long get 503 Service
+// Unavailable.
+type LoadShedding struct {
+	MaxRequests  int `toml:"max_requests"`
+	QueueSize    int `toml:"queue_size"`
+	QueueTimeout int `toml:"queue_timeout_ms"`
+
+	// What identifies a client for fair queuing: "ip" (default),
+	// "header:<Name>" or "jwt:<claim>", the address being used for requests
+	// without the header or claim.
+	Key string `toml:"key"`
+
+	// Tier of the requests matching no rule on routes without a tier,
+	// "normal" by default.
+	DefaultTier string `toml:"default_tier"`
+
+	// Checked in order, the first matching rule gives the tier of a request.
+	Rules []TierRule `toml:"rules"`
+}
+
+// TierRule classifies the requests carrying Header, equal to Value unless
+// it is empty, and coming from one of Clients, addresses or CIDR ranges.
+// Either condition can be omitted.
+type TierRule struct {
+	Header  string   `toml:"header"`
+	Value   string   `toml:"value"`
+	Clients []string `toml:"clients"`
+	Tier    string   `toml:"tier"`
+
+	ClientNetworks []*net.IPNet `toml:"-"`
+}
+
+// Priority tiers of load shedding, from the first shed to the last.
+var Tiers = []string{"low", "normal", "high", "critical"}
+
+// ConnectionLimits protect the listeners against clients holding
+// connections open, slowloris attacks in particular. Offenders are
+// disconnected.
+type ConnectionLimits struct {
+	// Concurrent connections from a single address, 0 for no limit.
+	// Trusted proxies are exempt.
+	MaxConnectionsPerIP int `toml:"max_connections_per_ip"`
+
+	// Minimum rates, in bytes per second, at which request headers and
+	// bodies must be received once GracePeriod seconds have passed. Zero
+	// disables the check. Waiting for the next request of a keep-alive
+	// connection counts as receiving headers.
+	MinHeaderRate int `toml:"min_header_rate"`
+	MinBodyRate   int `toml:"min_body_rate"`
+	GracePeriod   int `toml:"grace_period"`
+
+	// Size of the request line and headers, and number of header fields.
+	MaxHeaderBytes int `toml:"max_header_bytes"`
+	MaxHeaderCount int `toml:"max_header_count"`
+}
+
+// HostConfig describes a virtual host. Requests are dispatched to the host
+// whose names match the Host header (or the TLS server name), falling back
+// to the default host.
+type HostConfig struct {
+	// Exact names or wildcards such as "*.example.com".
+	Names []string `toml:"names"`
+
+	// Handle requests that don't match any other host.
+	Default bool `toml:"default"`
+
+	TLS     *TLSConfig `toml:"tls"`
+	Pattern []Pattern  `toml:"match"`
+
+	// Files sent instead of the generic body of local error responses,
+	// indexed by status code.
+	ErrorPages map[string]string `toml:"error_pages"`
+
+	// Access log file and the name this host uses in its log lines.
+	LOGFILE string `toml:"logfile"`
+	LOGNAME string `toml:"logname"`
+}
+
+type TLSConfig struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
 }
 
 type Backend struct {
@@ -34,8 +157,104 @@ type Backend struct {
 }
 
 type Pattern struct {
-	URI    string `toml:"uri"`
-	Action Action `toml:",inline"`
+	// Path matchers, uri matches by prefix, path must be equal to the
+	// request path and path_regex is matched against it.
+	URI       string `toml:"uri"`
+	Path      string `toml:"path"`
+	PathRegex string `toml:"path_regex"`
+
+	// Request matchers. Hosts can be exact names or wildcards such as
+	// "*.example.com". An empty header or query value only requires the key
+	// to be present.
+	Hosts   []string          `toml:"host"`
+	Methods []string          `toml:"methods"`
+	Headers map[string]string `toml:"headers"`
+	Query   map[string]string `toml:"query"`
+
+	// Patterns with higher priority win, ties are broken by the longest
+	// literal path and then by declaration order.
+	Priority int `toml:"priority"`
+
+	CompiledPathRegex *regexp.Regexp `toml:"-"`
+
+	// Raw action keys as they appear in a [[match]] table. They are turned
+	// into [`Action`] once the file has been decoded.
+	Serve     *string   `toml:"serve"`
+	Forward   []Backend `toml:"forward"`
+	Algorithm Algorithm `toml:"algorithm"`
+	Redirect  *Redirect `toml:"redirect"`
+	Respond   *Respond  `toml:"respond"`
+
+	// Options of serve patterns, written directly in the [[match]] table.
+	ServeOptions
+
+	// On-the-fly compression of responses, for any action.
+	Compress *Compress `toml:"compress"`
+
+	// Shared cache of the responses of forward patterns.
+	Cache *ResponseCache `toml:"cache"`
+
+	// Limits the rate of requests of every client, for any action.
+	RateLimit *RateLimit `toml:"rate_limit"`
+
+	// Restricts the clients allowed to use the pattern, for any action.
+	Access *Access `toml:"access"`
+
+	// Requires a valid JSON Web Token, for any action.
+	JWT *JWT `toml:"jwt"`
+
+	// Asks an authorization service whether requests may go on, for any
+	// action.
+	ForwardAuth *ForwardAuth `toml:"forward_auth"`
+
+	// Requires users to log in with an OpenID Connect provider, for any
+	// action.
+	OIDC *OIDC `toml:"oidc"`
+
+	// Answers CORS preflight requests and adds the CORS headers to the
+	// responses, for any action.
+	CORS *CORS `toml:"cors"`
+
+	// Inspects requests with firewall rules, for any action.
+	WAF *WAF `toml:"waf"`
+
+	// Adapts the number of requests in flight to the backends of a forward
+	// pattern to their latency.
+	Concurrency *Concurrency `toml:"concurrency"`
+
+	// Bytes a request body may have, unlimited when 0. Larger bodies get
+	// 413 Content Too Large.
+	MaxBodySize int64 `toml:"max_body_size"`
+
+	// Receives request bodies fully before forwarding them, instead of
+	// streaming them to the backends.
+	RequestBuffering *RequestBuffering `toml:"request_buffering"`
+
+	// Load shedding tier of the requests of the pattern, see
+	// [`LoadShedding`].
+	Tier string `toml:"tier"`
+
+	// Path rewriting applied to forwarded requests, in this order: the
+	// prefix is stripped, the regex rewrite runs and then the new prefix is
+	// added.
+	StripPrefix string   `toml:"strip_prefix"`
+	AddPrefix   string   `toml:"add_prefix"`
+	Rewrite     *Rewrite `toml:"rewrite"`
+
+	// Map Location headers and Set-Cookie paths sent by the backend back to
+	// the paths seen by the client.
+	RewriteLocation   bool `toml:"rewrite_location"`
+	RewriteCookiePath bool `toml:"rewrite_cookie_path"`
+
+	Action Action `toml:"-"`
+}
+
+// Rewrite replaces the request path with Replacement when it matches Regex.
+// Replacement can reference capture groups with $1, ${name}, etc.
+type Rewrite struct {
+	Regex       string         `toml:"regex"`
+	Replacement string         `toml:"replacement"`
+	Compiled    *regexp.Regexp `toml:"-"`
 }
 
 type Forward struct {
@@ -43,15 +262,388 @@ type Forward struct {
 	Algorithm Algorithm `toml:"algorithm"`
 }
 
+type SymlinkPolicy string
+
+const (
+	// Follow symlinks as long as their target is inside the root.
+	SymlinksWithinRoot SymlinkPolicy = "within_root"
+	// Follow every symlink.
+	SymlinksFollow SymlinkPolicy = "follow"
+	// Never serve a path containing a symlink.
+	SymlinksDeny SymlinkPolicy = "deny"
+)
+
+// ServeOptions controls how serve patterns map requests to files. The
+// request path, after strip_prefix, rewrite and add_prefix, is looked up
+// under the serve root.
+type ServeOptions struct {
+	// Files tried, in order, when a directory is requested.
+	Index []string `toml:"index"`
+
+	Symlinks SymlinkPolicy `toml:"symlinks"`
+
+	// Serve files and directories whose name starts with a dot.
+	Dotfiles bool `toml:"dotfiles"`
+
+	// Cache-Control values indexed by file extension, "*" applies to the
+	// extensions that are not listed.
+	CacheControl map[string]string `toml:"cache_control"`
+
+	// List directories without an index file, as HTML or JSON depending on
+	// the Accept header. BrowseSort is the default order (name, size or
+	// mtime) and BrowseTemplate an html/template file replacing the
+	// built-in page.
+	Browse         bool   `toml:"browse"`
+	BrowseSort     string `toml:"browse_sort"`
+	BrowseTemplate string `toml:"browse_template"`
+
+	CompiledBrowseTemplate *template.Template `toml:"-"`
+
+	// Candidates tried in order instead of the request path, "$uri" is
+	// replaced by the request path. Entries ending with a slash match
+	// directories, and a final "=404" (or any error status) answers with
+	// that status. For example ["$uri", "$uri.html", "/index.html"].
+	TryFiles []string `toml:"try_files"`
+
+	// Error documents indexed by status code, relative to the serve root.
+	ErrorPages map[string]string `toml:"error_pages"`
+
+	// Encodings whose precompressed siblings (.br, .zst, .gz) are sent to
+	// clients accepting them, in order of preference.
+	Precompressed []string `toml:"precompressed"`
+
+	// Keep small files in memory.
+	MemoryCache *MemoryCache `toml:"memory_cache"`
+}
+
+// MemoryCache bounds the in-memory cache of a serve pattern. Files larger
+// than MaxFileSize are always read from disk.
+type MemoryCache struct {
+	MaxBytes    int64 `toml:"max_bytes"`
+	MaxFileSize int64 `toml:"max_file_size"`
+}
+
+// ResponseCache stores the responses of a forward pattern following the
+// rules of a shared HTTP cache (RFC 9111).
+type ResponseCache struct {
+	// "memory" (default) or "disk". Path is the directory of the disk
+	// storage.
+	Storage string `toml:"storage"`
+	Path    string `toml:"path"`
+
+	// Bounds of the whole storage and of a single response body.
+	MaxBytes      int64 `toml:"max_bytes"`
+	MaxObjectSize int64 `toml:"max_object_size"`
+
+	// Template of the cache key with the placeholders {method}, {scheme},
+	// {host}, {path}, {query} and {uri}, plus {header.<Name>} and
+	// {cookie.<name>} for request headers and cookies.
+	Key string `toml:"key"`
+
+	// Make concurrent misses of the same key wait for a single request to
+	// the backend, for at most CoalesceTimeout seconds.
+	Coalesce        bool `toml:"coalesce"`
+	CoalesceTimeout int  `toml:"coalesce_timeout"`
+
+	// Response header listing the surrogate keys (tags) of a response,
+	// separated by spaces or commas, used to purge related responses.
+	TagHeader string `toml:"tag_header"`
+}
+
+// RateLimit allows Requests requests every Window seconds to each client of
+// a pattern.
+type RateLimit struct {
+	// "token_bucket" (default) or "sliding_window". Burst is the capacity
+	// of the token bucket, Requests by default.
+	Algorithm string `toml:"algorithm"`
+	Requests  int    `toml:"requests"`
+	Window    int    `toml:"window"`
+	Burst     int    `toml:"burst"`
+
+	// What identifies a client: "ip" (default), "header:<Name>" or
+	// "jwt:<claim>", or "route" for a single limit shared by every client.
+	// Requests without the header or claim are keyed by their address.
+	Key string `toml:"key"`
+
+	// Clients tracked at most, the least recently seen are forgotten first.
+	MaxKeys int `toml:"max_keys"`
+
+	// TOML file of limits replacing these ones for some keys, reloaded when
+	// it changes.
+	Overrides string `toml:"overrides"`
+}
+
+// Access restricts who can use a pattern. Clients must pass the address
+// lists and, when HTPasswd or APIKeys is set, authenticate with either.
+// Clients denied by address get 403 Forbidden, the others 401 Unauthorized
+// until they authenticate.
+type Access struct {
+	// Addresses or CIDR ranges. Deny wins over Allow, and when Allow is set
+	// only the clients it lists get in.
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+
+	// htpasswd file of bcrypt hashed passwords checked with HTTP Basic
+	// authentication in Realm.
+	HTPasswd string `toml:"htpasswd"`
+	Realm    string `toml:"realm"`
+
+	// File of API keys, one per line optionally followed by a name, looked
+	// up in the APIKeyHeader header or the APIKeyQuery query parameter.
+	APIKeys      string `toml:"api_keys"`
+	APIKeyHeader string `toml:"api_key_header"`
+	APIKeyQuery  string `toml:"api_key_query"`
+
+	AllowNetworks []*net.IPNet `toml:"-"`
+	DenyNetworks  []*net.IPNet `toml:"-"`
+}
+
+// JWT requires requests to carry a JSON Web Token signed by one of the keys
+// of a JWKS, read from a local file or a URL. Requests without a valid token
+// get 401 Unauthorized.
+type JWT struct {
+	// The token is read from the Cookie cookie when set, otherwise from
+	// Header, as a bearer token when it is Authorization (the default).
+	Header string `toml:"header"`
+	Cookie string `toml:"cookie"`
+
+	// The file is read again when it changes, the URL every JWKSRefresh
+	// seconds and when a token is signed by an unknown key.
+	JWKSFile    string `toml:"jwks_file"`
+	JWKSURL     string `toml:"jwks_url"`
+	JWKSRefresh int    `toml:"jwks_refresh"`
+
+	// Accepted signature algorithms, every supported one by default: RS256,
+	// RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512 and EdDSA.
+	Algorithms []string `toml:"algorithms"`
+
+	// Expected iss claim and accepted aud values, when set.
+	Issuer   string   `toml:"issuer"`
+	Audience []string `toml:"audience"`
+
+	// Seconds of clock skew tolerated when checking exp, nbf and iat.
+	Leeway int `toml:"leeway"`
+
+	// Claims every token must have.
+	RequiredClaims []string `toml:"required_claims"`
+
+	// Request headers set from claims, indexed by claim. Headers of the same
+	// name sent by the client are removed.
+	ForwardClaims map[string]string `toml:"forward_claims"`
+}
+
+// JWTAlgorithms are the signature algorithms supported by [`JWT`].
+var JWTAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// ForwardAuth sends a subrequest with the method, URI and some headers of
+// every request to an authorization service. A 2xx response lets the request
+// go on, any other one is sent back to the client as it is.
+type ForwardAuth struct {
+	URL string `toml:"url"`
+
+	// Request headers sent to the service, Authorization and Cookie by
+	// default.
+	RequestHeaders []string `toml:"request_headers"`
+
+	// Headers of the 2xx responses of the service copied onto the request,
+	// such as the user ID or roles. Headers of the same name sent by the
+	// client are removed.
+	ResponseHeaders []string `toml:"response_headers"`
+
+	// Seconds to wait for the service, 5 by default.
+	Timeout int `toml:"timeout"`
+
+	// Seconds the decisions of the service are remembered, per method, URI,
+	// client address and request headers. 0 disables the cache.
+	CacheTTL int `toml:"cache_ttl"`
+}
+
+// OIDC makes roxy an OpenID Connect relying party: users without a session
+// are redirected to the provider, and the authorization code it sends back
+// to RedirectURL is exchanged, with PKCE, for tokens kept in an encrypted
+// session cookie.
+type OIDC struct {
+	// The provider endpoints are discovered from
+	// Issuer/.well-known/openid-configuration.
+	Issuer       string `toml:"issuer"`
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+
+	// Callback URL registered with the provider, its path must be matched
+	// by the pattern.
+	RedirectURL string `toml:"redirect_url"`
+
+	// Path clearing the session, disabled when empty.
+	LogoutPath string `toml:"logout_path"`
+
+	// Requested scopes, openid, profile and email by default.
+	Scopes []string `toml:"scopes"`
+
+	// Session cookie name, roxy_session by default, and the secret its
+	// content is encrypted with, at least 32 characters.
+	CookieName   string `toml:"cookie_name"`
+	CookieSecret string `toml:"cookie_secret"`
+
+	// Seconds a session lasts at most, refreshing its tokens on the way,
+	// 86400 by default.
+	SessionLifetime int `toml:"session_lifetime"`
+
+	// Request headers set from claims of the ID token, indexed by claim,
+	// sub as X-Forwarded-User and email as X-Forwarded-Email by default.
+	// Headers of the same name sent by the client are removed.
+	ClaimHeaders map[string]string `toml:"claim_headers"`
+
+	// Sends the access token to the backends as X-Forwarded-Access-Token.
+	PassAccessToken bool `toml:"pass_access_token"`
+}
+
+// CORS is the Cross-Origin Resource Sharing policy of a pattern. Roxy
+// answers the preflight requests itself and sets the CORS headers of the
+// responses in place of those of the backends.
+type CORS struct {
+	// Allowed origins: exact ("https://app.example.com"), with * standing
+	// for host name parts ("https://*.example.com"), or "*" for any origin.
+	Origins []string `toml:"origins"`
+
+	// Regular expressions matching whole allowed origins.
+	OriginRegex []string `toml:"origin_regex"`
+
+	// Allowed methods, GET, HEAD and POST by default.
+	Methods []string `toml:"methods"`
+
+	// Allowed request headers, any asked for by preflight requests when
+	// empty.
+	Headers []string `toml:"headers"`
+
+	// Response headers exposed to scripts.
+	ExposeHeaders []string `toml:"expose_headers"`
+
+	// Allows cookies and HTTP authentication, not with the "*" origin.
+	Credentials bool `toml:"credentials"`
+
+	// Seconds browsers may cache preflight responses, not sent when 0.
+	MaxAge int `toml:"max_age"`
+
+	AnyOrigin       bool             `toml:"-"`
+	CompiledOrigins []*regexp.Regexp `toml:"-"`
+}
+
+// WAF inspects the method, path, query, headers and the start of the body
+// of requests with firewall rules, which block them, log them or tag them
+// for the backends. Matches are recorded in the access log.
+type WAF struct {
+	// TOML files of [[rule]] tables, read again when they change.
+	RuleFiles []string `toml:"rule_files"`
+
+	// Turns off the built-in rules against path traversal, SQL injection
+	// and XSS.
+	DisableBuiltinRules bool `toml:"disable_builtin_rules"`
+
+	// Bytes of the request body inspected, none by default.
+	BodyLimit int `toml:"body_limit"`
+
+	// Request header listing the tags of the matching tag rules, sent to
+	// the backends, X-WAF-Tags by default.
+	TagHeader string `toml:"tag_header"`
+}
+
+// RequestBuffering keeps request bodies in memory up to MemoryLimit bytes,
+// and in a temporary file beyond, until they are complete. Slow uploads then
+// don't hold the backends, and the buffered bodies can be sent again. The
+// pattern must set MaxBodySize to bound the temporary files.
+type RequestBuffering struct {
+	// 1MiB by default.
+	MemoryLimit int `toml:"memory_limit"`
+
+	// Directory of the temporary files, the system one by default.
+	TempDir string `toml:"temp_dir"`
+}
+
+// Concurrency limits the requests a forward pattern sends to its backends
+// at once, adjusting the limit from their latency in the manner of Netflix's
+// concurrency-limits. Requests beyond the limit wait in a queue of QueueSize
+// requests for at most QueueTimeout milliseconds, and are rejected with 503
+// Service Unavailable when it is full or the wait is over.
+type Concurrency struct {
+	// "gradient" (default) or "aimd".
+	Algorithm    string `toml:"algorithm"`
+	InitialLimit int    `toml:"initial_limit"`
+	MinLimit     int    `toml:"min_limit"`
+	MaxLimit     int    `toml:"max_limit"`
+
+	QueueSize    int `toml:"queue_size"`
+	QueueTimeout int `toml:"queue_timeout_ms"`
+
+	// Gradient: how much the latency can grow above its long-term average
+	// before the limit decreases.
+	Tolerance float64 `toml:"tolerance"`
+
+	// AIMD: the limit is multiplied by BackoffRatio when a request fails,
+	// gets 503 or takes more than Latency milliseconds, and grows by one
+	// otherwise.
+	Latency      int     `toml:"latency_ms"`
+	BackoffRatio float64 `toml:"backoff_ratio"`
+}
+
+// Compress enables on-the-fly compression of responses whose content type
+// matches Types and whose body is at least MinSize bytes long.
+type Compress struct {
+	// Encodings in order of preference, "zstd" and "gzip" are supported.
+	Algorithms []string `toml:"algorithms"`
+	MinSize    int      `toml:"min_size"`
+
+	// Media types, "text/*" matches every subtype.
+	Types []string `toml:"types"`
+}
+
+// Redirect answers with a redirection to To, which can contain the
+// placeholders {scheme}, {host}, {hostname}, {path}, {query} and {uri}.
+type Redirect struct {
+	To     string `toml:"to"`
+	Status int    `toml:"status"`
+
+	// Append the request path and query to the target.
+	PreservePath  bool `toml:"preserve_path"`
+	PreserveQuery bool `toml:"preserve_query"`
+}
+
+// Respond answers with a fixed response without contacting any backend.
+type Respond struct {
+	Status  int               `toml:"status"`
+	Headers map[string]string `toml:"headers"`
+	Body    string            `toml:"body"`
+}
+
 type Action struct {
-	Type    ActionType `toml:"-"`
-	Forward *Forward   `toml:"forward,omitempty"`
-	Serve   *string    `toml:"serve,omitempty"`
+	Type     ActionType `toml:"-"`
+	Forward  *Forward   `toml:"forward,omitempty"`
+	Serve    *string    `toml:"serve,omitempty"`
+	Redirect *Redirect  `toml:"redirect,omitempty"`
+	Respond  *Respond   `toml:"respond,omitempty"`
+}
+
+// MetricsConfig enables the listener exposing metrics in the Prometheus text
+// format on /metrics.
+type MetricsConfig struct {
+	Listen string `toml:"listen"`
+}
+
+// AdminConfig enables the listener of the admin API, used to inspect and
+// purge the response caches. It has no authentication and should only
+// listen on a local address.
+type AdminConfig struct {
+	Listen string `toml:"listen"`
 }
 
 type Config struct {
-	Server  ServerConfig `toml:"server"`
-	Pattern []Pattern    `toml:"match"`
+	Server  ServerConfig   `toml:"server"`
+	Pattern []Pattern      `toml:"match"`
+	Metrics *MetricsConfig `toml:"metrics"`
+	Admin   *AdminConfig   `toml:"admin"`
+
+	// Virtual hosts. Once loaded, the top level patterns are appended here
+	// as the default host unless a [[host]] is already marked as default.
+	Hosts []HostConfig `toml:"host"`
 }
 
 func NewConfig() *Config {
@@ -61,7 +653,10 @@ func NewConfig() *Config {
 func (c *Config) Load(filename string) (*Config, error) {
 
 	if _, err := toml.DecodeFile(filename, &c); err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	if err := c.resolve(); err != nil {
 		return nil, err
 	}
 
@@ -70,6 +665,833 @@ func (c *Config) Load(filename string) (*Config, error) {
 	return c, nil
 }
 
+// LoadAdmin reads only the [admin] table of filename, for the commands
+// talking to a running instance. It returns nil when the table is absent.
+func LoadAdmin(filename string) (*AdminConfig, error) {
+	var file struct {
+		Admin *AdminConfig `toml:"admin"`
+	}
+	if _, err := toml.DecodeFile(filename, &file); err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	return file.Admin, nil
+}
+
 func (c *Config) Get() *Config {
 	return c
 }
+
+// resolve validates the virtual hosts, builds the implicit default host and
+// resolves the patterns of every host.
+func (c *Config) resolve() error {
+	hasDefault := false
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		if host.Default {
+			if hasDefault {
+				return fmt.Errorf("host %v: only one host can be the default", host.Names)
+			}
+			hasDefault = true
+		} else if len(host.Names) == 0 {
+			return fmt.Errorf("host: names are required unless the host is the default")
+		}
+		if host.LOGNAME == "" && len(host.Names) > 0 {
+			host.LOGNAME = host.Names[0]
+		}
+	}
+
+	if err := c.Server.resolveOverload(); err != nil {
+		return err
+	}
+
+	if err := resolveConnectionLimits(&c.Server.Limits); err != nil {
+		return err
+	}
+
+	if c.Server.Shedding != nil {
+		if err := resolveLoadShedding(c.Server.Shedding); err != nil {
+			return err
+		}
+	}
+
+	for _, proxy := range c.Server.TrustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return fmt.Errorf("server: invalid trusted proxy %q", proxy)
+		}
+		c.Server.TrustedNetworks = append(c.Server.TrustedNetworks, network)
+	}
+
+	if len(c.Pattern) > 0 || !hasDefault {
+		if hasDefault {
+			return fmt.Errorf("top level [[match]] patterns conflict with the default [[host]]")
+		}
+		c.Hosts = append(c.Hosts, HostConfig{
+			Default:    true,
+			TLS:        c.Server.TLS,
+			Pattern:    c.Pattern,
+			ErrorPages: c.Server.ErrorPages,
+			LOGFILE:    c.Server.LOGFILE,
+			LOGNAME:    c.Server.NAME,
+		})
+	}
+
+	for i := range c.Hosts {
+		host := &c.Hosts[i]
+		for status := range host.ErrorPages {
+			if code, err := strconv.Atoi(status); err != nil || code < 400 || code > 599 {
+				return fmt.Errorf("host %v: invalid error page status %q", host.Names, status)
+			}
+		}
+		if err := resolvePatterns(host.Pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// name identifies the pattern in errors by its uri, path or path_regex,
+// whichever is set.
+func (pattern *Pattern) name() string {
+	switch {
+	case pattern.URI != "":
+		return pattern.URI
+	case pattern.Path != "":
+		return pattern.Path
+	}
+	return pattern.PathRegex
+}
+
+// resolvePatterns builds the [`Action`] of every pattern from its raw keys
+// and compiles the regular expressions used by the pattern.
+func resolvePatterns(patterns []Pattern) error {
+	for i := range patterns {
+		pattern := &patterns[i]
+
+		if err := resolveAction(pattern); err != nil {
+			return err
+		}
+
+		if pattern.PathRegex != "" {
+			compiled, err := regexp.Compile(pattern.PathRegex)
+			if err != nil {
+				return fmt.Errorf("match %q: invalid path_regex: %w", pattern.name(), err)
+			}
+			pattern.CompiledPathRegex = compiled
+		}
+
+		if pattern.Compress != nil {
+			if err := resolveCompress(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.Cache != nil {
+			if err := resolveResponseCache(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.RateLimit != nil {
+			if err := resolveRateLimit(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.Access != nil {
+			if err := resolveAccess(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.JWT != nil {
+			if err := resolveJWT(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.ForwardAuth != nil {
+			if err := resolveForwardAuth(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.OIDC != nil {
+			if err := resolveOIDC(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.CORS != nil {
+			if err := resolveCORS(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.WAF != nil {
+			if err := resolveWAF(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.MaxBodySize < 0 {
+			return fmt.Errorf("match %q: invalid max_body_size", pattern.name())
+		}
+
+		if pattern.RequestBuffering != nil {
+			if err := resolveRequestBuffering(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.Concurrency != nil {
+			if err := resolveConcurrency(pattern); err != nil {
+				return err
+			}
+		}
+
+		if pattern.Tier != "" && !slices.Contains(Tiers, pattern.Tier) {
+			return fmt.Errorf("match %q: unknown tier %q", pattern.name(), pattern.Tier)
+		}
+
+		if pattern.Rewrite != nil {
+			compiled, err := regexp.Compile(pattern.Rewrite.Regex)
+			if err != nil {
+				return fmt.Errorf("match %q: invalid rewrite regex: %w", pattern.name(), err)
+			}
+			pattern.Rewrite.Compiled = compiled
+		}
+	}
+
+	return nil
+}
+
+// resolveAction builds the [`Action`] of pattern, exactly one action key must
+// be set.
+func resolveAction(pattern *Pattern) error {
+	actions := 0
+	for _, set := range []bool{pattern.Forward != nil, pattern.Serve != nil, pattern.Redirect != nil, pattern.Respond != nil} {
+		if set {
+			actions++
+		}
+	}
+
+	if actions > 1 {
+		return fmt.Errorf("match %q: forward, serve, redirect and respond are mutually exclusive", pattern.name())
+	}
+
+	switch {
+	case pattern.Forward != nil:
+		algorithm := pattern.Algorithm
+		if algorithm == "" {
+			algorithm = WRR
+		}
+		pattern.Action = Action{
+			Type:    ForwardAction,
+			Forward: &Forward{Backends: pattern.Forward, Algorithm: algorithm},
+		}
+	case pattern.Serve != nil:
+		if err := resolveServeOptions(pattern); err != nil {
+			return err
+		}
+		pattern.Action = Action{Type: ServeAction, Serve: pattern.Serve}
+	case pattern.Redirect != nil:
+		switch pattern.Redirect.Status {
+		case 0:
+			pattern.Redirect.Status = 302
+		case 301, 302, 307, 308:
+		default:
+			return fmt.Errorf("match %q: invalid redirect status %d", pattern.name(), pattern.Redirect.Status)
+		}
+		if pattern.Redirect.To == "" {
+			return fmt.Errorf("match %q: redirect target is required", pattern.name())
+		}
+		pattern.Action = Action{Type: RedirectAction, Redirect: pattern.Redirect}
+	case pattern.Respond != nil:
+		if pattern.Respond.Status == 0 {
+			pattern.Respond.Status = 200
+		}
+		if pattern.Respond.Status < 100 || pattern.Respond.Status > 599 {
+			return fmt.Errorf("match %q: invalid respond status %d", pattern.name(), pattern.Respond.Status)
+		}
+		pattern.Action = Action{Type: RespondAction, Respond: pattern.Respond}
+	default:
+		return fmt.Errorf("match %q: no action, expected forward, serve, redirect or respond", pattern.name())
+	}
+
+	return nil
+}
+
+// resolveServeOptions fills the defaults of a serve pattern and validates its
+// options.
+func resolveServeOptions(pattern *Pattern) error {
+	if pattern.Index == nil {
+		pattern.Index = []string{"index.html"}
+	}
+
+	switch pattern.Symlinks {
+	case "":
+		pattern.Symlinks = SymlinksWithinRoot
+	case SymlinksWithinRoot, SymlinksFollow, SymlinksDeny:
+	default:
+		return fmt.Errorf("match %q: invalid symlinks policy %q", pattern.name(), pattern.Symlinks)
+	}
+
+	switch pattern.BrowseSort {
+	case "":
+		pattern.BrowseSort = "name"
+	case "name", "size", "mtime":
+	default:
+		return fmt.Errorf("match %q: invalid browse_sort %q", pattern.name(), pattern.BrowseSort)
+	}
+
+	if pattern.BrowseTemplate != "" {
+		compiled, err := template.ParseFiles(pattern.BrowseTemplate)
+		if err != nil {
+			return fmt.Errorf("match %q: invalid browse_template: %w", pattern.name(), err)
+		}
+		pattern.CompiledBrowseTemplate = compiled
+	}
+
+	for _, entry := range pattern.TryFiles {
+		if status, ok := strings.CutPrefix(entry, "="); ok {
+			if code, err := strconv.Atoi(status); err != nil || code < 400 || code > 599 {
+				return fmt.Errorf("match %q: invalid try_files status %q", pattern.name(), entry)
+			}
+		}
+	}
+
+	for status := range pattern.ErrorPages {
+		if code, err := strconv.Atoi(status); err != nil || code < 400 || code > 599 {
+			return fmt.Errorf("match %q: invalid error page status %q", pattern.name(), status)
+		}
+	}
+
+	if cache := pattern.MemoryCache; cache != nil {
+		if cache.MaxBytes == 0 {
+			cache.MaxBytes = 64 << 20
+		}
+		if cache.MaxFileSize == 0 {
+			cache.MaxFileSize = 64 << 10
+		}
+		if cache.MaxBytes < 0 || cache.MaxFileSize < 0 {
+			return fmt.Errorf("match %q: memory_cache sizes must be positive", pattern.name())
+		}
+	}
+
+	for _, encoding := range pattern.Precompressed {
+		switch encoding {
+		case "br", "zstd", "gzip":
+		default:
+			return fmt.Errorf("match %q: invalid precompressed encoding %q", pattern.name(), encoding)
+		}
+	}
+
+	return nil
+}
+
+// resolveCompress fills the defaults of the compress option of pattern.
+func resolveCompress(pattern *Pattern) error {
+	compress := pattern.Compress
+
+	if len(compress.Algorithms) == 0 {
+		compress.Algorithms = []string{"zstd", "gzip"}
+	}
+	for _, algorithm := range compress.Algorithms {
+		if algorithm != "zstd" && algorithm != "gzip" {
+			return fmt.Errorf("match %q: unsupported compression algorithm %q", pattern.name(), algorithm)
+		}
+	}
+
+	if compress.MinSize == 0 {
+		compress.MinSize = 1024
+	}
+
+	if len(compress.Types) == 0 {
+		compress.Types = []string{
+			"text/*",
+			"application/javascript",
+			"application/json",
+			"application/manifest+json",
+			"application/wasm",
+			"application/xml",
+			"application/yaml",
+			"image/svg+xml",
+		}
+	}
+
+	return nil
+}
+
+// resolveResponseCache fills the defaults of the cache option of pattern.
+func resolveResponseCache(pattern *Pattern) error {
+	cache := pattern.Cache
+
+	if pattern.Action.Type != ForwardAction {
+		return fmt.Errorf("match %q: cache is only supported by forward patterns", pattern.name())
+	}
+
+	switch cache.Storage {
+	case "":
+		cache.Storage = "memory"
+	case "memory":
+	case "disk":
+		if cache.Path == "" {
+			return fmt.Errorf("match %q: disk cache requires a path", pattern.name())
+		}
+	default:
+		return fmt.Errorf("match %q: invalid cache storage %q", pattern.name(), cache.Storage)
+	}
+
+	if cache.MaxBytes == 0 {
+		cache.MaxBytes = 64 << 20
+		if cache.Storage == "disk" {
+			cache.MaxBytes = 1 << 30
+		}
+	}
+	if cache.MaxObjectSize == 0 {
+		cache.MaxObjectSize = 1 << 20
+	}
+	if cache.MaxBytes < 0 || cache.MaxObjectSize < 0 {
+		return fmt.Errorf("match %q: cache sizes must be positive", pattern.name())
+	}
+
+	if cache.Key == "" {
+		cache.Key = "{scheme}://{host}{uri}"
+	}
+
+	if cache.TagHeader == "" {
+		cache.TagHeader = "Surrogate-Key"
+	}
+
+	if cache.CoalesceTimeout == 0 {
+		cache.CoalesceTimeout = 5
+	}
+	if cache.CoalesceTimeout < 0 {
+		return fmt.Errorf("match %q: invalid coalesce_timeout %d", pattern.name(), cache.CoalesceTimeout)
+	}
+
+	return nil
+}
+
+// resolveRateLimit fills the defaults of the rate_limit option of pattern.
+func resolveRateLimit(pattern *Pattern) error {
+	limit := pattern.RateLimit
+
+	switch limit.Algorithm {
+	case "":
+		limit.Algorithm = "token_bucket"
+	case "token_bucket", "sliding_window":
+	default:
+		return fmt.Errorf("match %q: invalid rate limit algorithm %q", pattern.name(), limit.Algorithm)
+	}
+
+	if limit.Requests <= 0 {
+		return fmt.Errorf("match %q: rate limit requests must be positive", pattern.name())
+	}
+	if limit.Window == 0 {
+		limit.Window = 1
+	}
+	if limit.Burst == 0 {
+		limit.Burst = limit.Requests
+	}
+	if limit.Window < 0 || limit.Burst < 0 {
+		return fmt.Errorf("match %q: rate limit window and burst must be positive", pattern.name())
+	}
+
+	kind, name, _ := strings.Cut(limit.Key, ":")
+	switch {
+	case limit.Key == "":
+		limit.Key = "ip"
+	case limit.Key == "ip" || limit.Key == "route":
+	case (kind == "header" || kind == "jwt") && name != "":
+	default:
+		return fmt.Errorf("match %q: invalid rate limit key %q", pattern.name(), limit.Key)
+	}
+	if kind == "jwt" && pattern.JWT == nil {
+		return fmt.Errorf("match %q: rate limit key %q requires the jwt option", pattern.name(), limit.Key)
+	}
+
+	if limit.MaxKeys == 0 {
+		limit.MaxKeys = 100000
+	}
+
+	return nil
+}
+
+func resolveAccess(pattern *Pattern) error {
+	access := pattern.Access
+
+	for _, list := range []struct {
+		values   []string
+		networks *[]*net.IPNet
+	}{{access.Allow, &access.AllowNetworks}, {access.Deny, &access.DenyNetworks}} {
+		for _, value := range list.values {
+			network, err := parseNetwork(value)
+			if err != nil {
+				return fmt.Errorf("match %q: invalid access address %q", pattern.name(), value)
+			}
+			*list.networks = append(*list.networks, network)
+		}
+	}
+
+	if access.Realm == "" {
+		access.Realm = "roxy"
+	}
+	if strings.ContainsAny(access.Realm, "\"\\") {
+		return fmt.Errorf("match %q: access realm can't contain quotes or backslashes", pattern.name())
+	}
+	if access.APIKeys != "" && access.APIKeyHeader == "" && access.APIKeyQuery == "" {
+		access.APIKeyHeader = "X-API-Key"
+	}
+
+	return nil
+}
+
+func resolveJWT(pattern *Pattern) error {
+	jwt := pattern.JWT
+
+	if (jwt.JWKSFile == "") == (jwt.JWKSURL == "") {
+		return fmt.Errorf("match %q: jwt requires exactly one of jwks_file and jwks_url", pattern.name())
+	}
+	if jwt.JWKSURL != "" && !strings.HasPrefix(jwt.JWKSURL, "https://") && !strings.HasPrefix(jwt.JWKSURL, "http://") {
+		return fmt.Errorf("match %q: invalid jwks_url %q", pattern.name(), jwt.JWKSURL)
+	}
+	if jwt.JWKSRefresh == 0 {
+		jwt.JWKSRefresh = 3600
+	}
+	if jwt.Header == "" {
+		jwt.Header = "Authorization"
+	}
+	if len(jwt.Algorithms) == 0 {
+		jwt.Algorithms = JWTAlgorithms
+	}
+	for _, algorithm := range jwt.Algorithms {
+		if !slices.Contains(JWTAlgorithms, algorithm) {
+			return fmt.Errorf("match %q: unsupported jwt algorithm %q", pattern.name(), algorithm)
+		}
+	}
+	if jwt.JWKSRefresh < 0 || jwt.Leeway < 0 {
+		return fmt.Errorf("match %q: invalid jwks_refresh or leeway", pattern.name())
+	}
+
+	return nil
+}
+
+func resolveForwardAuth(pattern *Pattern) error {
+	auth := pattern.ForwardAuth
+
+	if !strings.HasPrefix(auth.URL, "https://") && !strings.HasPrefix(auth.URL, "http://") {
+		return fmt.Errorf("match %q: invalid forward_auth url %q", pattern.name(), auth.URL)
+	}
+	if auth.RequestHeaders == nil {
+		auth.RequestHeaders = []string{"Authorization", "Cookie"}
+	}
+	if auth.Timeout == 0 {
+		auth.Timeout = 5
+	}
+	if auth.Timeout < 0 || auth.CacheTTL < 0 {
+		return fmt.Errorf("match %q: invalid forward_auth timeout or cache_ttl", pattern.name())
+	}
+
+	return nil
+}
+
+func resolveOIDC(pattern *Pattern) error {
+	oidc := pattern.OIDC
+
+	if !strings.HasPrefix(oidc.Issuer, "https://") && !strings.HasPrefix(oidc.Issuer, "http://") {
+		return fmt.Errorf("match %q: invalid oidc issuer %q", pattern.name(), oidc.Issuer)
+	}
+	if oidc.ClientID == "" {
+		return fmt.Errorf("match %q: oidc requires a client_id", pattern.name())
+	}
+	redirect, err := url.Parse(oidc.RedirectURL)
+	if err != nil || (redirect.Scheme != "https" && redirect.Scheme != "http") || redirect.Host == "" {
+		return fmt.Errorf("match %q: invalid oidc redirect_url %q", pattern.name(), oidc.RedirectURL)
+	}
+	if len(oidc.CookieSecret) < 32 {
+		return fmt.Errorf("match %q: oidc cookie_secret must be at least 32 characters", pattern.name())
+	}
+	if oidc.CookieName == "" {
+		oidc.CookieName = "roxy_session"
+	}
+	if len(oidc.Scopes) == 0 {
+		oidc.Scopes = []string{"openid", "profile", "email"}
+	}
+	if !slices.Contains(oidc.Scopes, "openid") {
+		oidc.Scopes = append([]string{"openid"}, oidc.Scopes...)
+	}
+	if oidc.SessionLifetime == 0 {
+		oidc.SessionLifetime = 86400
+	}
+	if oidc.SessionLifetime < 0 {
+		return fmt.Errorf("match %q: invalid oidc session_lifetime", pattern.name())
+	}
+	if oidc.ClaimHeaders == nil {
+		oidc.ClaimHeaders = map[string]string{"sub": "X-Forwarded-User", "email": "X-Forwarded-Email"}
+	}
+
+	return nil
+}
+
+func resolveCORS(pattern *Pattern) error {
+	cors := pattern.CORS
+
+	if len(cors.Origins) == 0 && len(cors.OriginRegex) == 0 {
+		return fmt.Errorf("match %q: cors requires origins or origin_regex", pattern.name())
+	}
+
+	cors.CompiledOrigins = nil
+	var exact []string
+	for _, origin := range cors.Origins {
+		switch {
+		case origin == "*":
+			cors.AnyOrigin = true
+		case strings.Contains(origin, "*"):
+			expression := strings.ReplaceAll(regexp.QuoteMeta(origin), `\*`, `[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*`)
+			cors.CompiledOrigins = append(cors.CompiledOrigins, regexp.MustCompile("^"+expression+"$"))
+		default:
+			exact = append(exact, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	cors.Origins = exact
+
+	for _, expression := range cors.OriginRegex {
+		compiled, err := regexp.Compile("^(?:" + expression + ")$")
+		if err != nil {
+			return fmt.Errorf("match %q: invalid cors origin_regex: %w", pattern.name(), err)
+		}
+		cors.CompiledOrigins = append(cors.CompiledOrigins, compiled)
+	}
+
+	if cors.AnyOrigin && cors.Credentials {
+		return fmt.Errorf("match %q: cors credentials can't be allowed to any origin", pattern.name())
+	}
+
+	if len(cors.Methods) == 0 {
+		cors.Methods = []string{"GET", "HEAD", "POST"}
+	}
+	for i, method := range cors.Methods {
+		cors.Methods[i] = strings.ToUpper(method)
+	}
+
+	if cors.MaxAge < 0 {
+		return fmt.Errorf("match %q: invalid cors max_age", pattern.name())
+	}
+
+	return nil
+}
+
+func resolveWAF(pattern *Pattern) error {
+	waf := pattern.WAF
+
+	if waf.DisableBuiltinRules && len(waf.RuleFiles) == 0 {
+		return fmt.Errorf("match %q: waf has no rules", pattern.name())
+	}
+	if waf.BodyLimit < 0 {
+		return fmt.Errorf("match %q: invalid waf body_limit", pattern.name())
+	}
+	if waf.TagHeader == "" {
+		waf.TagHeader = "X-WAF-Tags"
+	}
+
+	return nil
+}
+
+func resolveRequestBuffering(pattern *Pattern) error {
+	buffering := pattern.RequestBuffering
+	if pattern.Action.Forward == nil {
+		return fmt.Errorf("match %q: request_buffering requires a forward action", pattern.name())
+	}
+	// Otherwise a client could fill the disk with a single request.
+	if pattern.MaxBodySize == 0 {
+		return fmt.Errorf("match %q: request_buffering requires max_body_size", pattern.name())
+	}
+	if buffering.MemoryLimit == 0 {
+		buffering.MemoryLimit = 1 << 20
+	}
+	if buffering.MemoryLimit < 0 {
+		return fmt.Errorf("match %q: invalid request_buffering memory_limit", pattern.name())
+	}
+	return nil
+}
+
+func resolveConcurrency(pattern *Pattern) error {
+	limit := pattern.Concurrency
+	if pattern.Action.Forward == nil {
+		return fmt.Errorf("match %q: concurrency requires a forward action", pattern.name())
+	}
+
+	switch limit.Algorithm {
+	case "":
+		limit.Algorithm = "gradient"
+	case "gradient", "aimd":
+	default:
+		return fmt.Errorf("match %q: invalid concurrency algorithm %q", pattern.name(), limit.Algorithm)
+	}
+
+	if limit.MinLimit == 0 {
+		limit.MinLimit = 1
+	}
+	if limit.MaxLimit == 0 {
+		limit.MaxLimit = 1000
+	}
+	if limit.InitialLimit == 0 {
+		limit.InitialLimit = min(max(20, limit.MinLimit), limit.MaxLimit)
+	}
+	if limit.MinLimit < 1 || limit.MaxLimit < limit.MinLimit ||
+		limit.InitialLimit < limit.MinLimit || limit.InitialLimit > limit.MaxLimit {
+		return fmt.Errorf("match %q: concurrency limits must satisfy 1 <= min_limit <= initial_limit <= max_limit", pattern.name())
+	}
+
+	if limit.QueueSize == 0 {
+		limit.QueueSize = 100
+	}
+	if limit.QueueTimeout == 0 {
+		limit.QueueTimeout = 500
+	}
+	if limit.Tolerance == 0 {
+		limit.Tolerance = 1.5
+	}
+	if limit.Latency == 0 {
+		limit.Latency = 1000
+	}
+	if limit.BackoffRatio == 0 {
+		limit.BackoffRatio = 0.9
+	}
+	if limit.QueueSize < 0 || limit.QueueTimeout < 0 || limit.Tolerance < 1 || limit.Latency < 0 ||
+		limit.BackoffRatio <= 0 || limit.BackoffRatio >= 1 {
+		return fmt.Errorf("match %q: invalid concurrency options", pattern.name())
+	}
+
+	return nil
+}
+
+// parseNetwork parses a CIDR range or a single address.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// resolveOverload fills the defaults of max_connections and overload.
+func (s *ServerConfig) resolveOverload() error {
+	if s.MAXCONN == 0 {
+		s.MAXCONN = 1024
+	}
+	if s.MAXCONN < 0 {
+		return fmt.Errorf("server: invalid max_connections %d", s.MAXCONN)
+	}
+
+	switch s.Overload {
+	case "":
+		s.Overload = "wait"
+	case "wait", "reject":
+	default:
+		return fmt.Errorf("server: unknown overload %q, expected wait or reject", s.Overload)
+	}
+
+	if s.OverloadRetryAfter == 0 {
+		s.OverloadRetryAfter = 1
+	}
+	if s.OverloadRetryAfter < 0 {
+		return fmt.Errorf("server: invalid overload_retry_after %d", s.OverloadRetryAfter)
+	}
+
+	return nil
+}
+
+// resolveLoadShedding fills the defaults of the [server.shedding] table and
+// parses the client ranges of its rules.
+func resolveLoadShedding(shedding *LoadShedding) error {
+	if shedding.MaxRequests <= 0 {
+		return fmt.Errorf("server: shedding max_requests must be positive")
+	}
+	if shedding.QueueSize == 0 {
+		shedding.QueueSize = 1000
+	}
+	if shedding.QueueTimeout == 0 {
+		shedding.QueueTimeout = 1000
+	}
+	if shedding.QueueSize < 0 || shedding.QueueTimeout < 0 {
+		return fmt.Errorf("server: invalid shedding queue_size or queue_timeout_ms")
+	}
+
+	kind, name, _ := strings.Cut(shedding.Key, ":")
+	switch {
+	case shedding.Key == "":
+		shedding.Key = "ip"
+	case shedding.Key == "ip":
+	case (kind == "header" || kind == "jwt") && name != "":
+	default:
+		return fmt.Errorf("server: invalid shedding key %q", shedding.Key)
+	}
+
+	if shedding.DefaultTier == "" {
+		shedding.DefaultTier = "normal"
+	}
+	if !slices.Contains(Tiers, shedding.DefaultTier) {
+		return fmt.Errorf("server: unknown shedding default_tier %q", shedding.DefaultTier)
+	}
+
+	for i := range shedding.Rules {
+		rule := &shedding.Rules[i]
+		if !slices.Contains(Tiers, rule.Tier) {
+			return fmt.Errorf("server: shedding rule %d: unknown tier %q", i+1, rule.Tier)
+		}
+		if rule.Header == "" && len(rule.Clients) == 0 {
+			return fmt.Errorf("server: shedding rule %d: header or clients is required", i+1)
+		}
+		for _, client := range rule.Clients {
+			network, err := parseNetwork(client)
+			if err != nil {
+				return fmt.Errorf("server: shedding rule %d: invalid client %q", i+1, client)
+			}
+			rule.ClientNetworks = append(rule.ClientNetworks, network)
+		}
+	}
+
+	return nil
+}
+
+// resolveConnectionLimits fills the defaults of the [server.limits] table.
+func resolveConnectionLimits(limits *ConnectionLimits) error {
+	if limits.GracePeriod == 0 {
+		limits.GracePeriod = 10
+	}
+	if limits.MaxHeaderBytes == 0 {
+		limits.MaxHeaderBytes = 1 << 20
+	}
+	if limits.MaxHeaderCount == 0 {
+		limits.MaxHeaderCount = 100
+	}
+
+	for name, value := range map[string]int{
+		"max_connections_per_ip": limits.MaxConnectionsPerIP,
+		"min_header_rate":        limits.MinHeaderRate,
+		"min_body_rate":          limits.MinBodyRate,
+		"grace_period":           limits.GracePeriod,
+		"max_header_bytes":       limits.MaxHeaderBytes,
+		"max_header_count":       limits.MaxHeaderCount,
+	} {
+		if value < 0 {
+			return fmt.Errorf("server: invalid limits.%s %d", name, value)
+		}
+	}
+
+	return nil
+}
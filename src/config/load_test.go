@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +74,374 @@ func TestLoadConfig(t *testing.T) {
 	}
 
 }
+
+// loadConfig writes content to a temporary file and loads it.
+func loadConfig(t *testing.T, content string) (*Config, error) {
+	t.Helper()
+
+	tmpfile, err := os.CreateTemp(t.TempDir(), "roxy-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to write to temp file: %v", err)
+	}
+
+	if err := tmpfile.Close(); err != nil {
+		t.Fatalf("Failed to close temp file: %v", err)
+	}
+
+	return NewConfig().Load(tmpfile.Name())
+}
+
+func TestLoadRewrite(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+
+		[[match]]
+		uri = "/api"
+		strip_prefix = "/api"
+		add_prefix = "/v2"
+		rewrite = { regex = "^/users/(\\d+)$", replacement = "/people/$1" }
+		rewrite_location = true
+		forward = [{ address = "127.0.0.1:8080", weight = 1 }]
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	pattern := config.Pattern[0]
+	if pattern.Action.Type != ForwardAction || len(pattern.Action.Forward.Backends) != 1 {
+		t.Errorf("Load() action = %+v, want forward to 1 backend", pattern.Action)
+	}
+
+	if pattern.Action.Forward.Algorithm != WRR {
+		t.Errorf("Load() algorithm = %v, want %v", pattern.Action.Forward.Algorithm, WRR)
+	}
+
+	if pattern.Rewrite == nil || pattern.Rewrite.Compiled == nil {
+		t.Fatalf("Load() rewrite regex was not compiled")
+	}
+
+	_, err = loadConfig(t, `
+		[[match]]
+		uri = "/"
+		rewrite = { regex = "(", replacement = "" }
+		serve = "/static"
+	`)
+	if err == nil {
+		t.Errorf("Load() accepted an invalid rewrite regex")
+	}
+}
+
+func TestLoadHosts(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		name = "roxy"
+		listen = ["127.0.0.1:8100", { address = "127.0.0.1:8443", tls = true }]
+
+		[[match]]
+		uri = "/"
+		serve = "/static"
+
+		[[host]]
+		names = ["example.com", "*.example.com"]
+		logfile = "logs/example.log"
+		tls = { cert = "example.crt", key = "example.key" }
+		error_pages = { "404" = "/var/www/404.html" }
+
+		[[host.match]]
+		uri = "/api"
+		forward = [{ address = "127.0.0.1:8080", weight = 1 }]
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(config.Server.LISTEN) != 2 || config.Server.LISTEN[0].TLS || !config.Server.LISTEN[1].TLS {
+		t.Errorf("Load() listen = %v, want one plain and one TLS socket", config.Server.LISTEN)
+	}
+
+	if len(config.Hosts) != 2 {
+		t.Fatalf("Load() got %d hosts, want 2", len(config.Hosts))
+	}
+
+	host := config.Hosts[0]
+	if host.LOGNAME != "example.com" || host.Pattern[0].Action.Type != ForwardAction {
+		t.Errorf("Load() host = %+v", host)
+	}
+
+	fallback := config.Hosts[1]
+	if !fallback.Default || fallback.LOGNAME != "roxy" || fallback.Pattern[0].Action.Type != ServeAction {
+		t.Errorf("Load() default host = %+v", fallback)
+	}
+
+	_, err = loadConfig(t, `
+		[[host]]
+		names = ["example.com"]
+		error_pages = { "not-found" = "/var/www/404.html" }
+	`)
+	if err == nil {
+		t.Errorf("Load() accepted an invalid error page status")
+	}
+}
+
+func TestLoadRedirectRespond(t *testing.T) {
+	config, err := loadConfig(t, `
+		[[match]]
+		uri = "/old"
+		redirect = { to = "https://new.example.com", status = 308, preserve_path = true }
+
+		[[match]]
+		path = "/robots.txt"
+		respond = { body = "User-agent: *", headers = { "Content-Type" = "text/plain" } }
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if action := config.Pattern[0].Action; action.Type != RedirectAction || action.Redirect.Status != 308 {
+		t.Errorf("Load() redirect action = %+v", action)
+	}
+
+	if action := config.Pattern[1].Action; action.Type != RespondAction || action.Respond.Status != 200 {
+		t.Errorf("Load() respond action = %+v", action)
+	}
+
+	_, err = loadConfig(t, `
+		[[match]]
+		uri = "/old"
+		redirect = { to = "https://new.example.com", status = 200 }
+	`)
+	if err == nil {
+		t.Errorf("Load() accepted an invalid redirect status")
+	}
+
+	// Errors name routes matched by path too.
+	_, err = loadConfig(t, `
+		[[match]]
+		path = "/old"
+		redirect = { to = "https://new.example.com", status = 200 }
+	`)
+	if err == nil || !strings.Contains(err.Error(), `match "/old"`) {
+		t.Errorf("Load() error = %v", err)
+	}
+}
+
+func TestLoadListen(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		listen = [
+			{ address = "0.0.0.0:80", redirect_to_https = true, exempt = ["/.well-known/acme-challenge/"] },
+			{ address = "0.0.0.0:443", tls = true, hsts = { max_age = 31536000, include_subdomains = true, preload = true } },
+		]
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	plain, secure := config.Server.LISTEN[0], config.Server.LISTEN[1]
+	if !plain.RedirectToHTTPS || plain.HTTPSPort != 443 || len(plain.Exempt) != 1 {
+		t.Errorf("Load() plaintext listen = %+v", plain)
+	}
+
+	if secure.HSTS == nil || secure.HSTS.MaxAge != 31536000 || !secure.HSTS.Preload {
+		t.Errorf("Load() TLS listen = %+v", secure)
+	}
+
+	_, err = loadConfig(t, `
+		[server]
+		listen = [{ address = "0.0.0.0:443", tls = true, redirect_to_https = true }]
+	`)
+	if err == nil {
+		t.Errorf("Load() accepted redirect_to_https on a TLS socket")
+	}
+
+	config, err = loadConfig(t, `
+		[server]
+		listen = [{ address = "0.0.0.0:443", tls = true, hsts = {} }]
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if hsts := config.Server.LISTEN[0].HSTS; hsts.MaxAge != 31536000 {
+		t.Errorf("Load() default hsts = %+v", hsts)
+	}
+
+	for _, hsts := range []string{
+		"{ max_age = 0 }",
+		"{ max_age = -1 }",
+		"{ preload = true }",
+		"{ max_age = 86400, include_subdomains = true, preload = true }",
+	} {
+		_, err = loadConfig(t, `
+			[server]
+			listen = [{ address = "0.0.0.0:443", tls = true, hsts = `+hsts+` }]
+		`)
+		if err == nil {
+			t.Errorf("Load() accepted hsts = %s", hsts)
+		}
+	}
+}
+
+func TestLoadOverload(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+		max_connections = 100000
+		overload = "reject"
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if config.Server.MAXCONN != 100000 || config.Server.Overload != "reject" || config.Server.OverloadRetryAfter != 1 {
+		t.Errorf("Load() server = %+v", config.Server)
+	}
+
+	if _, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+		overload = "drop"
+	`); err == nil {
+		t.Errorf("Load() accepted an unknown overload")
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+
+		[server.shedding]
+		max_requests = 100
+		key = "header:X-Tenant"
+
+		[[server.shedding.rules]]
+		clients = ["10.0.0.0/8", "192.0.2.1"]
+		tier = "critical"
+
+		[[match]]
+		uri = "/reports"
+		tier = "low"
+		respond = { body = "ok" }
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	shedding := config.Server.Shedding
+	if shedding.DefaultTier != "normal" || shedding.QueueSize != 1000 || len(shedding.Rules[0].ClientNetworks) != 2 {
+		t.Errorf("Load() shedding = %+v", shedding)
+	}
+
+	if _, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+
+		[[match]]
+		uri = "/"
+		tier = "urgent"
+		respond = { body = "ok" }
+	`); err == nil {
+		t.Errorf("Load() accepted an unknown tier")
+	}
+}
+
+func TestLoadCORS(t *testing.T) {
+	config, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+
+		[[match]]
+		uri = "/api"
+		respond = { body = "ok" }
+		cors = { origins = ["https://app.example.com", "https://*.example.org"], origin_regex = ['http://localhost:\d+'], methods = ["get", "put"] }
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	cors := config.Pattern[0].CORS
+	if len(cors.Origins) != 1 || len(cors.CompiledOrigins) != 2 || cors.Methods[1] != "PUT" {
+		t.Fatalf("Load() cors = %+v", cors)
+	}
+	for origin, want := range map[string]bool{
+		"https://a.example.org":         true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://evil.com/.example.org": false,
+		"http://localhost:3000":         true,
+		"http://localhost:3000.evil":    false,
+	} {
+		matched := cors.CompiledOrigins[0].MatchString(origin) || cors.CompiledOrigins[1].MatchString(origin)
+		if matched != want {
+			t.Errorf("origin %s matched = %v, want %v", origin, matched, want)
+		}
+	}
+
+	if _, err := loadConfig(t, `
+		[server]
+		listen = ["127.0.0.1:3312"]
+
+		[[match]]
+		uri = "/api"
+		respond = { body = "ok" }
+		cors = { origins = ["*"], credentials = true }
+	`); err == nil {
+		t.Errorf("Load() accepted credentials for any origin")
+	}
+}
+
+func TestLoadRateLimit(t *testing.T) {
+	config, err := loadConfig(t, `
+		[[match]]
+		uri = "/api"
+		respond = { body = "ok" }
+		rate_limit = { requests = 10, key = "jwt:sub" }
+		jwt = { jwks_file = "jwks.json" }
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if limit := config.Pattern[0].RateLimit; limit.Algorithm != "token_bucket" || limit.Burst != 10 || limit.MaxKeys != 100000 {
+		t.Errorf("Load() rate limit = %+v", limit)
+	}
+
+	// Claims of tokens that aren't verified can't identify clients.
+	if _, err := loadConfig(t, `
+		[[match]]
+		uri = "/api"
+		respond = { body = "ok" }
+		rate_limit = { requests = 10, key = "jwt:sub" }
+	`); err == nil {
+		t.Errorf("Load() accepted a jwt key without the jwt option")
+	}
+}
+
+func TestLoadRequestBuffering(t *testing.T) {
+	config, err := loadConfig(t, `
+		[[match]]
+		uri = "/upload"
+		forward = [{ address = "127.0.0.1:8080", weight = 1 }]
+		max_body_size = 1048576
+		request_buffering = { temp_dir = "/tmp" }
+	`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if buffering := config.Pattern[0].RequestBuffering; buffering.MemoryLimit != 1<<20 {
+		t.Errorf("Load() request buffering = %+v", buffering)
+	}
+
+	// Buffered bodies must be bounded.
+	if _, err := loadConfig(t, `
+		[[match]]
+		uri = "/upload"
+		forward = [{ address = "127.0.0.1:8080", weight = 1 }]
+		request_buffering = {}
+	`); err == nil || !strings.Contains(err.Error(), "max_body_size") {
+		t.Errorf("Load() error without max_body_size = %v", err)
+	}
+}
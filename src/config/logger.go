@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -54,7 +55,12 @@ func (l *CustomLogger) setPrefix(level string) {
 	l.SetPrefix(fmt.Sprintf("%s: ", level))
 }
 
-func setupLogger(logFile string) (*CustomLogger, error) {
+// SetupLogger creates a logger that writes both to stdout and to logFile,
+// creating its directory if needed.
+func SetupLogger(logFile string) (*CustomLogger, error) {
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
 	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %v", err)
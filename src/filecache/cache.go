@@ -0,0 +1,221 @@
+package filecache
+
+import (
+	"container/list"
+	"net/http"
+	"roxy/src/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a file held in memory together with everything needed to send
+// it without touching the disk.
+type Entry struct {
+	// Files the entry was read from, the file itself and its precompressed
+	// siblings.
+	Files []string
+
+	ModTime time.Time
+
+	// Validator of the identity content, computed once.
+	ETag string
+
+	// Content-Type, Cache-Control and Vary headers.
+	Header http.Header
+
+	// Content indexed by encoding, "" is the identity. Encodings lists the
+	// precompressed ones in order of preference.
+	Variants  map[string][]byte
+	Encodings []string
+
+	element *list.Element
+	key     string
+	size    int64
+}
+
+// Cache is an LRU of small files bounded by the total number of bytes it
+// holds. Entries are dropped as soon as the watcher reports a change of the
+// files they were read from. Where no watcher is available, entries are
+// validated against the file system on every hit instead.
+type Cache struct {
+	mu sync.Mutex
+
+	MaxBytes    int64
+	MaxFileSize int64
+
+	used    int64
+	entries map[string]*Entry
+
+	// Keys of the entries read from a file.
+	byFile map[string]map[string]struct{}
+
+	// Most recently used entries at the front.
+	lru *list.List
+
+	// Incremented on every invalidation, see Generation.
+	generation uint64
+
+	watcher *watcher
+
+	Hits   *metrics.Counter
+	Misses *metrics.Counter
+}
+
+// New creates a Cache for the files under root.
+func New(root string, maxBytes, maxFileSize int64, labels metrics.Labels) (*Cache, error) {
+	cache := &Cache{
+		MaxBytes:    maxBytes,
+		MaxFileSize: maxFileSize,
+		entries:     make(map[string]*Entry),
+		byFile:      make(map[string]map[string]struct{}),
+		lru:         list.New(),
+		Hits:        metrics.Default.Counter("roxy_file_cache_hits_total", "Requests served from the in-memory file cache.", labels),
+		Misses:      metrics.Default.Counter("roxy_file_cache_misses_total", "Requests that missed the in-memory file cache.", labels),
+	}
+
+	metrics.Default.GaugeFunc("roxy_file_cache_bytes", "Bytes held by the in-memory file cache.", labels, func() float64 {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return float64(cache.used)
+	})
+
+	watcher, err := newWatcher(root, cache.InvalidateFile, cache.Purge)
+	if err != nil {
+		return nil, err
+	}
+	cache.watcher = watcher
+
+	return cache, nil
+}
+
+// Get returns the entry stored under key, or nil.
+func (c *Cache) Get(key string) *Entry {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(entry.element)
+	}
+	c.mu.Unlock()
+
+	if ok && c.watcher == nil && !entry.fresh() {
+		c.InvalidateFile(entry.Files[0])
+		ok = false
+	}
+
+	if !ok {
+		c.Misses.Inc()
+		return nil
+	}
+
+	c.Hits.Inc()
+	return entry
+}
+
+// Generation returns a number that changes whenever entries are invalidated.
+// It must be read before loading an entry and given back to Put, so that
+// changes happening while the file is read are not missed.
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put stores entry under key unless something was invalidated since
+// generation was obtained or the entry doesn't fit.
+func (c *Cache) Put(key string, entry *Entry, generation uint64) {
+	size := int64(len(key))
+	for _, content := range entry.Variants {
+		size += int64(len(content))
+	}
+	if size > c.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+
+	entry.key = key
+	entry.size = size
+	entry.element = c.lru.PushFront(entry)
+	c.entries[key] = entry
+	c.used += size
+
+	for _, file := range entry.Files {
+		keys, ok := c.byFile[file]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.byFile[file] = keys
+		}
+		keys[key] = struct{}{}
+	}
+
+	for c.used > c.MaxBytes {
+		c.remove(c.lru.Back().Value.(*Entry))
+	}
+}
+
+// InvalidateFile drops the entries read from file, or from files under it
+// when file is a directory.
+func (c *Cache) InvalidateFile(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	prefix := strings.TrimSuffix(file, "/") + "/"
+	for candidate, keys := range c.byFile {
+		if candidate != file && !strings.HasPrefix(candidate, prefix) {
+			continue
+		}
+		for key := range keys {
+			if entry, ok := c.entries[key]; ok {
+				c.remove(entry)
+			}
+		}
+	}
+}
+
+// Purge drops every entry. Used when files are created, deleted or renamed,
+// which can change the file a request path resolves to.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*Entry)
+	c.byFile = make(map[string]map[string]struct{})
+	c.lru.Init()
+	c.used = 0
+}
+
+// Close stops watching the file system.
+func (c *Cache) Close() error {
+	if c.watcher != nil {
+		return c.watcher.close()
+	}
+	return nil
+}
+
+// remove drops entry, the lock must be held.
+func (c *Cache) remove(entry *Entry) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+
+	for _, file := range entry.Files {
+		if keys, ok := c.byFile[file]; ok {
+			delete(keys, entry.key)
+			if len(keys) == 0 {
+				delete(c.byFile, file)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"roxy/src/metrics"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newEntry(file string, size int) *Entry {
+	return &Entry{Files: []string{file}, Variants: map[string][]byte{"": make([]byte, size)}}
+}
+
+func TestCacheEviction(t *testing.T) {
+	root := t.TempDir()
+	cache, err := New(root, 250, 100, metrics.Labels{"test": t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	hits, misses := cache.Hits.Value(), cache.Misses.Value()
+
+	cache.Put("/a", newEntry(filepath.Join(root, "a"), 98), cache.Generation())
+	cache.Put("/b", newEntry(filepath.Join(root, "b"), 98), cache.Generation())
+	cache.Get("/a")
+	cache.Put("/c", newEntry(filepath.Join(root, "c"), 98), cache.Generation())
+
+	if cache.Get("/b") != nil {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if cache.Get("/a") == nil || cache.Get("/c") == nil {
+		t.Errorf("recently used entries were evicted")
+	}
+
+	generation := cache.Generation()
+	cache.InvalidateFile(filepath.Join(root, "a"))
+	cache.Put("/a", newEntry(filepath.Join(root, "a"), 10), generation)
+	if cache.Get("/a") != nil {
+		t.Errorf("entry loaded before an invalidation was stored")
+	}
+
+	// Counters are registered per root, so compare against the values at start.
+	if h, m := cache.Hits.Value()-hits, cache.Misses.Value()-misses; h != 3 || m != 2 {
+		t.Errorf("hits = %d, misses = %d, want 3 and 2", h, m)
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on Linux")
+	}
+
+	root := t.TempDir()
+	file := filepath.Join(root, "index.html")
+	if err := os.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := New(root, 1<<20, 1<<10, metrics.Labels{"test": t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	waitFor := func(what string, condition func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	cache.Put("/", newEntry(file, 2), cache.Generation())
+	if err := os.WriteFile(file, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("modification", func() bool { return cache.Get("/") == nil })
+
+	// Directories created after the cache are watched too.
+	nested := filepath.Join(root, "docs")
+	if err := os.Mkdir(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	nestedFile := filepath.Join(nested, "page.html")
+	if err := os.WriteFile(nestedFile, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cache.Put("/docs/page.html", newEntry(nestedFile, 2), cache.Generation())
+	if err := os.WriteFile(nestedFile, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("nested modification", func() bool { return cache.Get("/docs/page.html") == nil })
+}
@@ -0,0 +1,10 @@
+package filecache
+
+import "os"
+
+// fresh checks the entry against the file system, for platforms where
+// changes can't be watched.
+func (e *Entry) fresh() bool {
+	info, err := os.Stat(e.Files[0])
+	return err == nil && info.ModTime().Equal(e.ModTime) && info.Size() == int64(len(e.Variants[""]))
+}
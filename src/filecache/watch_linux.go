@@ -0,0 +1,158 @@
+package filecache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Changes of file contents or metadata, which invalidate single files.
+	contentEvents = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE
+
+	// Changes of directory entries, which can change the file a request
+	// resolves to.
+	nameEvents = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+		syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+)
+
+// watcher reports changes of the files under a directory tree through
+// inotify. Every directory of the tree is watched, new ones included.
+type watcher struct {
+	file *os.File
+	fd   int
+
+	mu sync.Mutex
+
+	// Watched directories indexed by watch descriptor.
+	directories map[int32]string
+
+	invalidate func(string)
+	purge      func()
+}
+
+func newWatcher(root string, invalidate func(string), purge func()) (*watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+
+	w := &watcher{
+		// Non blocking descriptors are handled by the runtime poller, so
+		// closing the file interrupts a pending read.
+		file:        os.NewFile(uintptr(fd), "inotify"),
+		fd:          fd,
+		directories: make(map[int32]string),
+		invalidate:  invalidate,
+		purge:       purge,
+	}
+
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// addTree watches directory and every directory below it.
+func (w *watcher) addTree(directory string) error {
+	return filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// The tree may change while it is walked.
+			if errors.Is(err, fs.ErrNotExist) && path != directory {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, contentEvents|nameEvents|syscall.IN_ONLYDIR)
+		if err != nil {
+			return fmt.Errorf("inotify: watching %s: %w", path, err)
+		}
+
+		w.mu.Lock()
+		w.directories[int32(wd)] = path
+		w.mu.Unlock()
+
+		return nil
+	})
+}
+
+func (w *watcher) run() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			// Closed, from now on nothing can be trusted.
+			w.purge()
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.handle(event, name)
+		}
+	}
+}
+
+func (w *watcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.purge()
+		return
+	}
+
+	w.mu.Lock()
+	directory, ok := w.directories[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.directories, event.Wd)
+	}
+	w.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	path := directory
+	if name != "" {
+		path = filepath.Join(directory, name)
+	}
+
+	if event.Mask&nameEvents != 0 {
+		if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			w.addTree(path)
+		}
+		w.purge()
+		return
+	}
+
+	if event.Mask&contentEvents != 0 {
+		w.invalidate(path)
+	}
+}
+
+func (w *watcher) close() error {
+	return w.file.Close()
+}
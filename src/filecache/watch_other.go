@@ -0,0 +1,15 @@
+//go:build !linux
+
+package filecache
+
+// watcher is not available on this platform, entries are validated with a
+// stat call on every hit instead.
+type watcher struct{}
+
+func newWatcher(root string, invalidate func(string), purge func()) (*watcher, error) {
+	return nil, nil
+}
+
+func (w *watcher) close() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+package forwardauth
+
+import (
+	"sync"
+	"time"
+)
+
+// Decisions remembered at most, the expired ones are dropped when it is
+// reached, and all of them if none expired.
+const maxDecisions = 10000
+
+// cache remembers the decisions of the service for a while.
+type cache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	decision *decision
+	expires  time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// get returns the decision remembered for key, nil if none or expired.
+func (c *cache) get(key string, now time.Time) *decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.decision
+}
+
+func (c *cache) put(key string, decision *decision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxDecisions {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= maxDecisions {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = cacheEntry{decision: decision, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,186 @@
+// Package forwardauth delegates the decision to let requests in to an
+// external authorization service, asked with a subrequest.
+package forwardauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"roxy/src/config"
+	"strconv"
+	"time"
+)
+
+// Response bodies of denials larger than this are sent to the client but
+// not cached.
+const maxCachedBody = 64 << 10
+
+// Response headers of the service that concern its connection to roxy only.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Authorizer applies the [`config.ForwardAuth`] options of a pattern.
+type Authorizer struct {
+	options *config.ForwardAuth
+	client  *http.Client
+	// Nil when decisions aren't cached.
+	cache *cache
+}
+
+// New creates the authorizer described by options.
+func New(options *config.ForwardAuth) *Authorizer {
+	authorizer := &Authorizer{
+		options: options,
+		client: &http.Client{
+			Timeout: time.Duration(options.Timeout) * time.Second,
+			// Redirects, to a login page for instance, are meant for the
+			// client.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	if options.CacheTTL > 0 {
+		authorizer.cache = newCache(time.Duration(options.CacheTTL) * time.Second)
+	}
+	return authorizer
+}
+
+// Check asks the service whether r, sent by clientIP, may go on. When it
+// may, the configured headers of the answer are copied onto r and the
+// response is nil, otherwise the response is the answer of the service. The
+// error is returned when the service can't be reached.
+func (a *Authorizer) Check(r *http.Request, clientIP string) (*http.Response, error) {
+	for _, name := range a.options.ResponseHeaders {
+		r.Header.Del(name)
+	}
+
+	key := a.key(r, clientIP)
+	now := time.Now()
+	if a.cache != nil {
+		if decision := a.cache.get(key, now); decision != nil {
+			return a.apply(decision, r), nil
+		}
+	}
+
+	resp, err := a.client.Do(a.subrequest(r, clientIP))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.options.URL, err)
+	}
+
+	decision := &decision{status: resp.StatusCode, header: resp.Header.Clone()}
+	for _, name := range hopHeaders {
+		decision.header.Del(name)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", a.options.URL, err)
+	}
+	if len(body) > maxCachedBody && !decision.allowed() {
+		// Streamed to the client, without caching it.
+		denial := decision.response()
+		denial.Body = &remainingBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return denial, nil
+	}
+	resp.Body.Close()
+	if !decision.allowed() {
+		decision.body = body
+	}
+
+	if a.cache != nil && decision.cacheable() {
+		a.cache.put(key, decision, now)
+	}
+	return a.apply(decision, r), nil
+}
+
+// apply copies the configured headers of an approval onto r, or returns the
+// response to send for a denial.
+func (a *Authorizer) apply(d *decision, r *http.Request) *http.Response {
+	if !d.allowed() {
+		resp := d.response()
+		resp.Body = io.NopCloser(bytes.NewReader(d.body))
+		resp.ContentLength = int64(len(d.body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(d.body)))
+		return resp
+	}
+
+	for _, name := range a.options.ResponseHeaders {
+		for _, value := range d.header.Values(name) {
+			r.Header.Add(name, value)
+		}
+	}
+	return nil
+}
+
+// subrequest returns the request asking the service about r.
+func (a *Authorizer) subrequest(r *http.Request, clientIP string) *http.Request {
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, a.options.URL, nil)
+	for _, name := range a.options.RequestHeaders {
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-For", clientIP)
+	return req
+}
+
+// key identifies the subrequests sent for r, whose decisions are the same.
+func (a *Authorizer) key(r *http.Request, clientIP string) string {
+	var key bytes.Buffer
+	for _, part := range []string{r.Method, r.Host, r.URL.RequestURI(), clientIP} {
+		fmt.Fprintf(&key, "%q ", part)
+	}
+	for _, name := range a.options.RequestHeaders {
+		fmt.Fprintf(&key, "%q ", r.Header.Values(name))
+	}
+	return key.String()
+}
+
+// decision is the answer of the service.
+type decision struct {
+	status int
+	header http.Header
+	// Body of denials.
+	body []byte
+}
+
+func (d *decision) allowed() bool {
+	return d.status >= 200 && d.status < 300
+}
+
+// cacheable tells whether the answer holds for other requests: failures of
+// the service and answers setting cookies don't.
+func (d *decision) cacheable() bool {
+	return d.status < 500 && len(d.header.Values("Set-Cookie")) == 0
+}
+
+func (d *decision) response() *http.Response {
+	return &http.Response{
+		StatusCode: d.status,
+		Status:     fmt.Sprintf("%d %s", d.status, http.StatusText(d.status)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     d.header.Clone(),
+		Body:       http.NoBody,
+	}
+}
+
+// remainingBody reads the body of a denial too large to be cached.
+type remainingBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,84 @@
+package forwardauth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"roxy/src/config"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	subrequests := 0
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subrequests++
+		if r.Method != "POST" || r.Header.Get("X-Forwarded-Uri") != "/orders?id=1" || r.Header.Get("X-Forwarded-For") != "192.0.2.1" || r.Header.Get("X-Other") != "" {
+			t.Errorf("subrequest %s %v", r.Method, r.Header)
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer alice":
+			w.Header().Set("X-User", "alice")
+			w.Header().Add("X-Roles", "admin")
+			w.Header().Set("X-Internal", "1")
+		case "":
+			http.Redirect(w, r, "https://login.example/", http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "bad token")
+		}
+	}))
+	defer service.Close()
+
+	authorizer := New(&config.ForwardAuth{
+		URL:             service.URL,
+		RequestHeaders:  []string{"Authorization"},
+		ResponseHeaders: []string{"X-User", "X-Roles"},
+		Timeout:         5,
+		CacheTTL:        60,
+	})
+
+	request := func(authorization string) *http.Request {
+		r := httptest.NewRequest("POST", "/orders?id=1", nil)
+		r.Header.Set("X-Other", "1")
+		r.Header.Set("X-User", "mallory")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+
+	// Twice, the second decision comes from the cache.
+	for range 2 {
+		r := request("Bearer alice")
+		denial, err := authorizer.Check(r, "192.0.2.1")
+		if err != nil || denial != nil {
+			t.Fatalf("allowed request: %v %v", denial, err)
+		}
+		if r.Header.Get("X-User") != "alice" || r.Header.Get("X-Roles") != "admin" || r.Header.Get("X-Internal") != "" {
+			t.Errorf("allowed request headers %v", r.Header)
+		}
+
+		denial, err = authorizer.Check(request("Bearer bob"), "192.0.2.1")
+		if err != nil || denial == nil || denial.StatusCode != http.StatusUnauthorized || denial.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("denied request: %v %v", denial, err)
+		}
+		if body, _ := io.ReadAll(denial.Body); string(body) != "bad token" {
+			t.Errorf("denial body %q", body)
+		}
+	}
+	if subrequests != 2 {
+		t.Errorf("subrequests = %d, want 2", subrequests)
+	}
+
+	// Redirects reach the client.
+	denial, err := authorizer.Check(request(""), "192.0.2.1")
+	if err != nil || denial == nil || denial.StatusCode != http.StatusFound || denial.Header.Get("Location") != "https://login.example/" {
+		t.Fatalf("redirected request: %v %v", denial, err)
+	}
+
+	service.Close()
+	if _, err := New(authorizer.options).Check(request("Bearer alice"), "192.0.2.1"); err == nil {
+		t.Error("unreachable service: no error")
+	}
+}
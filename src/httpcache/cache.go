@@ -0,0 +1,687 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"roxy/src/config"
+	"roxy/src/metrics"
+	local_http "roxy/src/server/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responses kept for the different Vary values of a single key, the oldest
+// ones are dropped beyond that.
+const maxVariants = 32
+
+// Fetcher sends a request to the origin and returns its response.
+type Fetcher func(*http.Request) (*http.Response, error)
+
+// Cache is a shared HTTP cache (RFC 9111) in front of the backends of a
+// forward pattern. Responses are stored according to their Cache-Control,
+// Expires and Vary headers, revalidated with their validators once stale,
+// and can be served stale while they are revalidated in the background or
+// when the origin fails, as allowed by stale-while-revalidate and
+// stale-if-error (RFC 5861).
+type Cache struct {
+	// Identifies the cache in the Cache-Status header (RFC 9211).
+	Name string
+
+	Storage       Storage
+	MaxObjectSize int64
+
+	// Response header holding the surrogate keys of a response.
+	TagHeader string
+
+	// Called with the errors of the storage, which are otherwise handled as
+	// misses.
+	ErrorLog func(error)
+
+	key keyTemplate
+
+	// How long concurrent requests for a key wait for the fetch in flight
+	// before going to the origin on their own, zero disables coalescing.
+	CoalesceTimeout time.Duration
+
+	mu sync.Mutex
+	// Keys being revalidated in the background.
+	revalidating map[string]bool
+	// Fetches other requests can wait for, by key.
+	flights map[string]*flight
+
+	Hits      *metrics.Counter
+	Misses    *metrics.Counter
+	Collapsed *metrics.Counter
+}
+
+// flight is a fetch from the origin that concurrent requests for the same
+// key wait for instead of sending their own.
+type flight struct {
+	done chan struct{}
+
+	// Response shared with the waiters, nil when the answer of the origin
+	// can't be shared.
+	response *Response
+}
+
+// New creates the cache described by options.
+func New(options *config.ResponseCache, labels metrics.Labels) (*Cache, error) {
+	key, err := parseKeyTemplate(options.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var storage Storage
+	switch options.Storage {
+	case "disk":
+		if storage, err = NewDiskStorage(options.Path, options.MaxBytes); err != nil {
+			return nil, err
+		}
+	default:
+		storage = NewMemoryStorage(options.MaxBytes)
+	}
+
+	metrics.Default.GaugeFunc("roxy_response_cache_bytes", "Bytes held by the response cache.", labels, func() float64 {
+		return float64(storage.Size())
+	})
+
+	cache := &Cache{
+		Name:          "roxy",
+		Storage:       storage,
+		MaxObjectSize: options.MaxObjectSize,
+		TagHeader:     options.TagHeader,
+		key:           key,
+		revalidating:  make(map[string]bool),
+		flights:       make(map[string]*flight),
+		Hits:          metrics.Default.Counter("roxy_response_cache_hits_total", "Requests answered by the response cache.", labels),
+		Misses:        metrics.Default.Counter("roxy_response_cache_misses_total", "Requests the response cache forwarded to a backend.", labels),
+		Collapsed:     metrics.Default.Counter("roxy_response_cache_collapsed_total", "Misses answered with the response fetched for a concurrent request.", labels),
+	}
+	if options.Coalesce {
+		cache.CoalesceTimeout = time.Duration(options.CoalesceTimeout) * time.Second
+	}
+
+	return cache, nil
+}
+
+// Serve answers r from the cache or with the response obtained by fetch. The
+// error of fetch is returned when no response could be sent, the caller is
+// then expected to answer with a Bad Gateway.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, fetch Fetcher) error {
+	if r.Header.Get("Upgrade") != "" {
+		return c.bypass(w, r, fetch, "bypass")
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return c.bypass(w, r, fetch, "method")
+	}
+
+	reqCC := parseDirectives(r.Header)
+	key := c.key.expand(r)
+	stored, fwd := c.lookup(key, r)
+
+	if stored == nil {
+		if reqCC.has("only-if-cached") {
+			resp := new(local_http.LocalResponse).Error(http.StatusGatewayTimeout)
+			resp.Header.Add("Cache-Status", c.status(cacheStatus{detail: "only-if-cached"}))
+			writeResponse(w, r, resp)
+			return nil
+		}
+
+		c.Misses.Inc()
+		land, answered := c.collapse(w, r, key, fwd)
+		if answered {
+			return nil
+		}
+
+		requestTime := time.Now()
+		resp, err := fetch(r)
+		if err != nil {
+			land(nil)
+			return err
+		}
+		land(c.relay(w, r, r, resp, key, requestTime, reqCC, cacheStatus{fwd: fwd}))
+		return nil
+	}
+
+	now := time.Now()
+	respCC := parseDirectives(stored.Header)
+	age := currentAge(stored, now)
+	ttl := freshnessLifetime(stored, respCC) - age
+
+	if usable(reqCC, respCC, age, ttl) {
+		c.Hits.Inc()
+		c.write(w, r, stored, age, cacheStatus{hit: true, ttl: ttl, hasTTL: true})
+		return nil
+	}
+
+	if ttl <= 0 && !reqCC.has("no-cache") && mayServeStale(respCC) && withinWindow(respCC, "stale-while-revalidate", -ttl) {
+		c.Hits.Inc()
+		c.revalidateInBackground(key, r, stored, fetch)
+		c.write(w, r, stored, age, cacheStatus{hit: true, ttl: ttl, hasTTL: true, detail: "stale-while-revalidate"})
+		return nil
+	}
+
+	// Fresh responses only get here when the client asks for validation.
+	fwd = "stale"
+	if ttl > 0 {
+		fwd = "request"
+	}
+
+	c.Misses.Inc()
+	land, answered := c.collapse(w, r, key, fwd)
+	if answered {
+		return nil
+	}
+
+	req := conditionalRequest(r, stored)
+	requestTime := time.Now()
+	resp, err := fetch(req)
+
+	if err != nil || resp.StatusCode >= 500 {
+		staleIfError := mayServeStale(respCC) &&
+			(withinWindow(respCC, "stale-if-error", -ttl) || withinWindow(reqCC, "stale-if-error", -ttl))
+		if staleIfError {
+			// Waiters fetch on their own after an error.
+			land(nil)
+			status := cacheStatus{fwd: fwd, detail: "stale-if-error"}
+			if resp != nil {
+				status.fwdStatus = resp.StatusCode
+				resp.Body.Close()
+			}
+			c.write(w, r, stored, age, status)
+			return nil
+		}
+		if err != nil {
+			land(nil)
+			return err
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := freshen(stored, resp.Header, requestTime, time.Now())
+		c.store(key, r, updated)
+		land(updated)
+		c.write(w, r, updated, currentAge(updated, time.Now()), cacheStatus{fwd: fwd, fwdStatus: http.StatusNotModified, stored: true})
+		return nil
+	}
+
+	land(c.relay(w, r, req, resp, key, requestTime, reqCC, cacheStatus{fwd: fwd}))
+	return nil
+}
+
+// collapse makes r wait for the fetch in flight for key and answers it with
+// the response of that fetch. answered reports whether r was answered.
+// Otherwise r must be sent to the origin and, when no fetch was in flight,
+// land called with the response stored for r (or nil) so that the requests
+// waiting meanwhile can share it. A failed fetch isn't shared, it may have
+// been cancelled by the client that made it, so its waiters fetch on their
+// own.
+func (c *Cache) collapse(w http.ResponseWriter, r *http.Request, key, fwd string) (land func(*Response), answered bool) {
+	land = func(*Response) {}
+	if c.CoalesceTimeout <= 0 {
+		return land, false
+	}
+
+	c.mu.Lock()
+	f, inFlight := c.flights[key]
+	if !inFlight {
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+	}
+	c.mu.Unlock()
+
+	if !inFlight {
+		return func(response *Response) {
+			c.mu.Lock()
+			delete(c.flights, key)
+			c.mu.Unlock()
+
+			f.response = response
+			close(f.done)
+		}, false
+	}
+
+	timer := time.NewTimer(c.CoalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+	case <-timer.C:
+		return land, false
+	case <-r.Context().Done():
+		// Nobody is left to answer.
+		return land, true
+	}
+
+	// The shared response must have been selected with the same values of
+	// the headers it varies on.
+	response := f.response
+	if response == nil || !slices.Equal(varyValues(r, varyNames(response.Header)), response.VaryValues) {
+		return land, false
+	}
+
+	c.Collapsed.Inc()
+	c.write(w, r, response, currentAge(response, time.Now()), cacheStatus{fwd: fwd, fwdStatus: response.Status, collapsed: true})
+	return land, true
+}
+
+// usable reports whether a stored response of the given age and remaining
+// freshness can be sent without contacting the origin.
+func usable(reqCC, respCC directives, age, ttl time.Duration) bool {
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	if ttl > 0 {
+		minFresh, _ := reqCC.seconds("min-fresh")
+		return ttl >= minFresh
+	}
+
+	if !reqCC.has("max-stale") || !mayServeStale(respCC) {
+		return false
+	}
+	if reqCC["max-stale"] == "" {
+		return true
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	return ok && -ttl <= maxStale
+}
+
+// withinWindow reports whether a response stale for staleness can still be
+// used according to the delta-seconds directive name.
+func withinWindow(cc directives, name string, staleness time.Duration) bool {
+	window, ok := cc.seconds(name)
+	return ok && staleness <= window
+}
+
+// lookup returns the response stored under key for r, or the reason of the
+// miss as a Cache-Status fwd value.
+func (c *Cache) lookup(key string, r *http.Request) (*Response, string) {
+	entry := c.load(key)
+	if entry == nil {
+		return nil, "uri-miss"
+	}
+
+	values := varyValues(r, entry.Vary)
+	for _, response := range entry.Responses {
+		if slices.Equal(response.VaryValues, values) {
+			return response, ""
+		}
+	}
+	return nil, "vary-miss"
+}
+
+func (c *Cache) load(key string) *Entry {
+	entry, err := c.Storage.Get(key)
+	if err != nil {
+		c.logError(err)
+	}
+	return entry
+}
+
+// store adds response to the entry of key, replacing the response stored for
+// the same Vary values. The whole entry is replaced when the response varies
+// on other headers than the stored ones.
+func (c *Cache) store(key string, r *http.Request, response *Response) {
+	vary := varyNames(response.Header)
+	response.VaryValues = varyValues(r, vary)
+
+	var responses []*Response
+	if entry := c.load(key); entry != nil && slices.Equal(entry.Vary, vary) {
+		for _, existing := range entry.Responses {
+			if !slices.Equal(existing.VaryValues, response.VaryValues) {
+				responses = append(responses, existing)
+			}
+		}
+	}
+	responses = append(responses, response)
+	if len(responses) > maxVariants {
+		responses = responses[len(responses)-maxVariants:]
+	}
+
+	if err := c.Storage.Put(&Entry{Key: key, Vary: vary, Responses: responses}); err != nil {
+		c.logError(err)
+	}
+}
+
+// relay sends resp, obtained for req, to the client and stores it when it is
+// allowed to. The stored response is returned.
+func (c *Cache) relay(w http.ResponseWriter, r, req *http.Request, resp *http.Response, key string, requestTime time.Time, reqCC directives, status cacheStatus) *Response {
+	defer resp.Body.Close()
+	responseTime := time.Now()
+
+	store := storable(req, reqCC, resp.StatusCode, resp.Header, parseDirectives(resp.Header)) &&
+		resp.ContentLength <= c.MaxObjectSize
+	header := resp.Header.Clone()
+
+	status.fwdStatus = resp.StatusCode
+	status.stored = store
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Add("Cache-Status", c.status(status))
+	w.WriteHeader(resp.StatusCode)
+
+	var client io.Writer = w
+	if r.Method == http.MethodHead {
+		client = io.Discard
+	}
+	if !store {
+		io.Copy(client, resp.Body)
+		return nil
+	}
+
+	body := &limitedBuffer{limit: c.MaxObjectSize}
+	if _, err := io.Copy(io.MultiWriter(client, body), resp.Body); err != nil || body.overflow {
+		return nil
+	}
+
+	if header.Get("Date") == "" {
+		header.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+	}
+	response := &Response{
+		Status:       resp.StatusCode,
+		Header:       header,
+		Body:         body.Bytes(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	c.store(key, r, response)
+	return response
+}
+
+// revalidateInBackground refreshes the response stored under key once the
+// current request is answered. Only one revalidation runs per key.
+func (c *Cache) revalidateInBackground(key string, r *http.Request, stored *Response, fetch Fetcher) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	// The revalidation outlives the client request.
+	req := conditionalRequest(r.WithContext(context.WithoutCancel(r.Context())), stored)
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+
+		requestTime := time.Now()
+		resp, err := fetch(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			c.store(key, req, freshen(stored, resp.Header, requestTime, time.Now()))
+			return
+		}
+
+		responseTime := time.Now()
+		if !storable(req, parseDirectives(req.Header), resp.StatusCode, resp.Header, parseDirectives(resp.Header)) {
+			return
+		}
+		body := &limitedBuffer{limit: c.MaxObjectSize}
+		if _, err := io.Copy(body, resp.Body); err != nil || body.overflow {
+			return
+		}
+		header := resp.Header.Clone()
+		if header.Get("Date") == "" {
+			header.Set("Date", responseTime.UTC().Format(http.TimeFormat))
+		}
+		c.store(key, req, &Response{
+			Status:       resp.StatusCode,
+			Header:       header,
+			Body:         body.Bytes(),
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+		})
+	}()
+}
+
+// bypass forwards requests the cache doesn't handle. Successful responses to
+// unsafe methods invalidate the stored responses of the request URI and of
+// their Location and Content-Location (RFC 9111 section 4.4).
+func (c *Cache) bypass(w http.ResponseWriter, r *http.Request, fetch Fetcher, reason string) error {
+	resp, err := fetch(r)
+	if err != nil {
+		return err
+	}
+
+	if !safeMethod(r.Method) && resp.StatusCode < 400 {
+		c.invalidate(r, resp)
+	}
+
+	resp.Header.Add("Cache-Status", c.status(cacheStatus{fwd: reason, fwdStatus: resp.StatusCode}))
+	writeResponse(w, r, resp)
+	return nil
+}
+
+func (c *Cache) invalidate(r *http.Request, resp *http.Response) {
+	targets := []*url.URL{r.URL}
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		target, err := r.URL.Parse(value)
+		if err == nil && (target.Host == "" || strings.EqualFold(target.Host, r.Host)) {
+			targets = append(targets, target)
+		}
+	}
+
+	for _, target := range targets {
+		req := r.Clone(r.Context())
+		req.Method = http.MethodGet
+		req.URL = &url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery}
+		if err := c.Storage.Delete(c.key.expand(req)); err != nil {
+			c.logError(err)
+		}
+	}
+}
+
+// write answers r with a stored response. Successful responses go through
+// http.ServeContent, which handles conditional and range requests.
+func (c *Cache) write(w http.ResponseWriter, r *http.Request, response *Response, age time.Duration, status cacheStatus) {
+	header := w.Header()
+	for name, values := range response.Header {
+		header[name] = append(header[name], values...)
+	}
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Add("Cache-Status", c.status(status))
+
+	if response.Status == http.StatusOK {
+		if _, ok := response.Header["Content-Type"]; !ok {
+			// Don't let ServeContent sniff a type the origin didn't send.
+			header["Content-Type"] = nil
+		}
+		modified, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", modified, bytes.NewReader(response.Body))
+		return
+	}
+
+	w.WriteHeader(response.Status)
+	if r.Method != http.MethodHead {
+		w.Write(response.Body)
+	}
+}
+
+func (c *Cache) logError(err error) {
+	if c.ErrorLog != nil {
+		c.ErrorLog(err)
+	}
+}
+
+// Close releases the storage.
+func (c *Cache) Close() error {
+	return c.Storage.Close()
+}
+
+// conditionalRequest returns a copy of r validating stored with the origin.
+// The conditions of the client are replaced by ours, they are evaluated
+// against the response sent to it instead.
+func conditionalRequest(r *http.Request, stored *Response) *http.Request {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range"} {
+		req.Header.Del(name)
+	}
+	if etag := stored.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := stored.Header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+	return req
+}
+
+// freshen returns stored updated with the header fields of a 304 Not
+// Modified response (RFC 9111 section 4.3.4).
+func freshen(stored *Response, header http.Header, requestTime, responseTime time.Time) *Response {
+	updated := *stored
+	updated.Header = stored.Header.Clone()
+	for name, values := range header {
+		if name != "Content-Length" {
+			updated.Header[name] = values
+		}
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// varyNames returns the sorted canonical names listed by the Vary header.
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// varyValues returns the normalized values of the headers names in r.
+func varyValues(r *http.Request, names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		var fields []string
+		for _, line := range r.Header.Values(name) {
+			for _, field := range strings.Split(line, ",") {
+				fields = append(fields, strings.TrimSpace(field))
+			}
+		}
+		values[i] = strings.Join(fields, ",")
+	}
+	return values
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// writeResponse copies resp to w, without its body for HEAD requests.
+func writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, resp.Body)
+	}
+}
+
+// cacheStatus describes how a request was handled, see RFC 9211.
+type cacheStatus struct {
+	hit bool
+
+	// Why the request was forwarded and the status the origin answered.
+	fwd       string
+	fwdStatus int
+
+	// Remaining freshness of the response sent, negative once stale.
+	ttl    time.Duration
+	hasTTL bool
+
+	stored bool
+	// The request waited for the fetch of a concurrent one.
+	collapsed bool
+	detail    string
+}
+
+// status formats a Cache-Status entry for the cache.
+func (c *Cache) status(status cacheStatus) string {
+	parts := []string{c.Name}
+	if status.hit {
+		parts = append(parts, "hit")
+	}
+	if status.fwd != "" {
+		parts = append(parts, "fwd="+status.fwd)
+	}
+	if status.fwdStatus != 0 {
+		parts = append(parts, fmt.Sprintf("fwd-status=%d", status.fwdStatus))
+	}
+	if status.hasTTL {
+		parts = append(parts, fmt.Sprintf("ttl=%d", int64(status.ttl/time.Second)))
+	}
+	if status.stored {
+		parts = append(parts, "stored")
+	}
+	if status.collapsed {
+		parts = append(parts, "collapsed")
+	}
+	if status.detail != "" {
+		parts = append(parts, "detail="+status.detail)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// limitedBuffer keeps what is written to it until limit is exceeded, it then
+// only remembers that it overflowed. Writes never fail so that the other
+// writers of an io.MultiWriter keep receiving the data.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow {
+		if int64(b.Len()+len(p)) > b.limit {
+			b.overflow = true
+			b.Reset()
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,408 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"roxy/src/metrics"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// origin serves handler and counts the requests it receives.
+type origin struct {
+	server   *httptest.Server
+	requests atomic.Int32
+}
+
+func newOrigin(t *testing.T, handler http.HandlerFunc) *origin {
+	o := &origin{}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+func (o *origin) fetch(r *http.Request) (*http.Response, error) {
+	req := r.Clone(r.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = strings.TrimPrefix(o.server.URL, "http://")
+	req.RequestURI = ""
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newCache(t *testing.T, options *config.ResponseCache) *Cache {
+	if options.Storage == "" {
+		options.Storage = "memory"
+	}
+	if options.MaxBytes == 0 {
+		options.MaxBytes = 1 << 20
+	}
+	if options.MaxObjectSize == 0 {
+		options.MaxObjectSize = 1 << 16
+	}
+	if options.Key == "" {
+		options.Key = "{scheme}://{host}{uri}"
+	}
+	cache, err := New(options, metrics.Labels{"test": t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func (c *Cache) get(t *testing.T, o *origin, target string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	if err := c.Serve(w, r, o.fetch); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestCacheFreshness(t *testing.T) {
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "session=1")
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	})
+	cache := newCache(t, &config.ResponseCache{})
+
+	w := cache.get(t, o, "http://example.com/fresh", nil)
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=uri-miss; fwd-status=200; stored" {
+		t.Errorf("first request: Cache-Status = %q", got)
+	}
+	w = cache.get(t, o, "http://example.com/fresh", nil)
+	if got := w.Header().Get("Cache-Status"); !strings.HasPrefix(got, "roxy; hit; ttl=") {
+		t.Errorf("second request: Cache-Status = %q", got)
+	}
+	if w.Body.String() != "body of /fresh" || w.Header().Get("Age") != "0" {
+		t.Errorf("second request: body %q, Age %q", w.Body.String(), w.Header().Get("Age"))
+	}
+
+	w = cache.get(t, o, "http://example.com/fresh", map[string]string{"Cache-Control": "no-cache"})
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=request; fwd-status=200; stored" {
+		t.Errorf("no-cache request: Cache-Status = %q", got)
+	}
+
+	for _, path := range []string{"/private", "/cookie"} {
+		cache.get(t, o, "http://example.com"+path, nil)
+		w = cache.get(t, o, "http://example.com"+path, nil)
+		if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=uri-miss; fwd-status=200" {
+			t.Errorf("%s: Cache-Status = %q", path, got)
+		}
+	}
+
+	if got := o.requests.Load(); got != 6 {
+		t.Errorf("origin received %d requests, want 6", got)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+	cache := newCache(t, &config.ResponseCache{})
+
+	cache.get(t, o, "http://example.com/", map[string]string{"Accept-Language": "en"})
+	w := cache.get(t, o, "http://example.com/", map[string]string{"Accept-Language": "fr"})
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=vary-miss; fwd-status=200; stored" {
+		t.Errorf("Cache-Status = %q", got)
+	}
+
+	for _, language := range []string{"en", "fr"} {
+		w = cache.get(t, o, "http://example.com/", map[string]string{"Accept-Language": language})
+		if w.Body.String() != language {
+			t.Errorf("Accept-Language %s: body = %q", language, w.Body.String())
+		}
+	}
+	if got := o.requests.Load(); got != 2 {
+		t.Errorf("origin received %d requests, want 2", got)
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var fail atomic.Bool
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// Age makes the response stale as soon as it is stored.
+		w.Header().Set("Cache-Control", "max-age=10, stale-if-error=3600")
+		w.Header().Set("Age", "20")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("v1"))
+	})
+	cache := newCache(t, &config.ResponseCache{})
+
+	cache.get(t, o, "http://example.com/", nil)
+	w := cache.get(t, o, "http://example.com/", nil)
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=stale; fwd-status=304; stored" {
+		t.Errorf("revalidation: Cache-Status = %q", got)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "v1" {
+		t.Errorf("revalidation: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	w = cache.get(t, o, "http://example.com/", map[string]string{"If-None-Match": `"v1"`})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional request: status %d, want 304", w.Code)
+	}
+
+	fail.Store(true)
+	w = cache.get(t, o, "http://example.com/", nil)
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=stale; fwd-status=503; detail=stale-if-error" {
+		t.Errorf("failing origin: Cache-Status = %q", got)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "v1" {
+		t.Errorf("failing origin: status %d, body %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=3600")
+		w.Header().Set("Age", "20")
+		w.Write([]byte{byte('0' + version.Add(1))})
+	})
+	cache := newCache(t, &config.ResponseCache{})
+
+	cache.get(t, o, "http://example.com/", nil)
+	w := cache.get(t, o, "http://example.com/", nil)
+	if got := w.Header().Get("Cache-Status"); got != "roxy; hit; ttl=-10; detail=stale-while-revalidate" {
+		t.Errorf("Cache-Status = %q", got)
+	}
+	if w.Body.String() != "1" {
+		t.Errorf("stale body = %q, want 1", w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.get(t, o, "http://example.com/", nil).Body.String() == "1" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the background revalidation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/other")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	})
+	cache := newCache(t, &config.ResponseCache{})
+
+	cache.get(t, o, "http://example.com/items", nil)
+	cache.get(t, o, "http://example.com/other", nil)
+
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/items", strings.NewReader("{}"))
+	w := httptest.NewRecorder()
+	if err := cache.Serve(w, r, o.fetch); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Cache-Status"); got != "roxy; fwd=method; fwd-status=201" {
+		t.Errorf("POST: Cache-Status = %q", got)
+	}
+
+	for _, path := range []string{"/items", "/other"} {
+		w = cache.get(t, o, "http://example.com"+path, nil)
+		if got := w.Header().Get("Cache-Status"); !strings.HasPrefix(got, "roxy; fwd=uri-miss") {
+			t.Errorf("%s after POST: Cache-Status = %q", path, got)
+		}
+	}
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &Entry{
+		Key: "http://example.com/",
+		Responses: []*Response{{
+			Status:       http.StatusOK,
+			Header:       http.Header{"Content-Type": {"text/plain"}},
+			Body:         []byte("hello"),
+			ResponseTime: time.Now(),
+		}},
+	}
+	if err := storage.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new storage picks up the entries of the previous one, removes the
+	// temporary files of interrupted writes and leaves other files alone.
+	os.WriteFile(filepath.Join(dir, tempPrefix+"123"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.entry"), []byte("not an entry"), 0644)
+	storage, err = NewDiskStorage(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := storage.Get(entry.Key)
+	if err != nil || got == nil {
+		t.Fatalf("Get = %v, %v", got, err)
+	}
+	if string(got.Responses[0].Body) != "hello" || got.Responses[0].Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Get returned %+v", got.Responses[0])
+	}
+	if storage.Size() == 0 {
+		t.Errorf("Size = 0 after loading an entry")
+	}
+	if _, err := os.Stat(filepath.Join(dir, tempPrefix+"123")); err == nil {
+		t.Errorf("temporary file kept")
+	}
+	for _, name := range []string{"index.html", "notes.entry"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s removed: %v", name, err)
+		}
+	}
+
+	// Peek leaves the LRU order kept in the modification times alone.
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(storage.path(entry.Key), past, past)
+	if got, err := storage.Peek(entry.Key); err != nil || got == nil {
+		t.Fatalf("Peek = %v, %v", got, err)
+	}
+	if info, _ := os.Stat(storage.path(entry.Key)); !info.ModTime().Equal(past) {
+		t.Errorf("Peek touched the entry file")
+	}
+
+	if err := storage.Delete(entry.Key); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := storage.Get(entry.Key); got != nil {
+		t.Errorf("entry still stored after Delete")
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var delay atomic.Int64
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	})
+	cache := newCache(t, &config.ResponseCache{})
+	cache.CoalesceTimeout = time.Second
+
+	getConcurrently := func(path string) []*httptest.ResponseRecorder {
+		responses := make([]*httptest.ResponseRecorder, 10)
+		done := make(chan struct{})
+		for i := range responses {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				responses[i] = cache.get(t, o, "http://example.com"+path, nil)
+			}()
+		}
+		for range responses {
+			<-done
+		}
+		return responses
+	}
+
+	delay.Store(int64(200 * time.Millisecond))
+	collapsed := 0
+	for _, w := range getConcurrently("/slow") {
+		if w.Body.String() != "/slow" {
+			t.Errorf("body = %q", w.Body.String())
+		}
+		if strings.HasSuffix(w.Header().Get("Cache-Status"), "; collapsed") {
+			collapsed++
+		}
+	}
+	if got := o.requests.Load(); got != 1 || collapsed != 9 {
+		t.Errorf("origin received %d requests and %d were collapsed, want 1 and 9", got, collapsed)
+	}
+
+	// Waiters stop waiting after the timeout.
+	cache.CoalesceTimeout = 10 * time.Millisecond
+	getConcurrently("/slower")
+	if got := o.requests.Load(); got != 11 {
+		t.Errorf("origin received %d requests, want 11", got)
+	}
+
+	// Waiters fetch on their own when the client of the leader goes away.
+	cache.CoalesceTimeout = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/cancelled", nil).WithContext(ctx)
+		leader <- cache.Serve(httptest.NewRecorder(), r, o.fetch)
+	}()
+	for o.requests.Load() != 12 {
+		time.Sleep(time.Millisecond)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	for _, w := range getConcurrently("/cancelled") {
+		if w.Code != http.StatusOK || w.Body.String() != "/cancelled" {
+			t.Errorf("waiter of a cancelled fetch: status %d, body %q", w.Code, w.Body.String())
+		}
+	}
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled leader: %v", err)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	o := newOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "all "+strings.Split(r.URL.Path, "/")[1])
+		w.Write([]byte(r.URL.Path))
+	})
+	cache := newCache(t, &config.ResponseCache{TagHeader: "Surrogate-Key"})
+
+	for _, path := range []string{"/assets/a.js", "/assets/b.js", "/docs/index.html", "/news/today"} {
+		cache.get(t, o, "http://example.com"+path, nil)
+	}
+
+	if purged, err := cache.PurgeKey("http://example.com/news/today"); !purged || err != nil {
+		t.Errorf("PurgeKey = %v, %v", purged, err)
+	}
+	if purged, err := cache.PurgePrefix("http://example.com/assets/"); purged != 2 || err != nil {
+		t.Errorf("PurgePrefix = %d, %v, want 2", purged, err)
+	}
+	if keys := cache.Keys(); len(keys) != 1 || keys[0] != "http://example.com/docs/index.html" {
+		t.Errorf("Keys = %v", keys)
+	}
+	if purged, err := cache.PurgeTag("docs"); purged != 1 || err != nil {
+		t.Errorf("PurgeTag = %d, %v, want 1", purged, err)
+	}
+	if keys := cache.Keys(); len(keys) != 0 {
+		t.Errorf("Keys = %v after purging everything", keys)
+	}
+}
@@ -0,0 +1,162 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives are the Cache-Control directives of a message indexed by their
+// lowercase name, with the quotes of their value removed.
+type directives map[string]string
+
+func parseDirectives(header http.Header) directives {
+	parsed := make(directives)
+	for _, line := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			parsed[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	// Pragma only matters to caches when Cache-Control is absent.
+	if len(header.Values("Cache-Control")) == 0 {
+		for _, line := range header.Values("Pragma") {
+			if strings.Contains(strings.ToLower(line), "no-cache") {
+				parsed["no-cache"] = ""
+			}
+		}
+	}
+
+	return parsed
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive. Invalid values are
+// treated as absent.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	value, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Statuses whose responses can be stored without explicit freshness (RFC
+// 9110 section 15.1).
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Statuses a shared cache doesn't store, the cache can't combine partial
+// content and the others aren't final responses to the request.
+var uncacheableStatus = map[int]bool{
+	206: true, 304: true,
+}
+
+// storable reports whether a shared cache may store the response to req.
+func storable(req *http.Request, reqCC directives, status int, header http.Header, respCC directives) bool {
+	switch {
+	case req.Method != http.MethodGet:
+		return false
+	case status < 200 || uncacheableStatus[status]:
+		return false
+	case reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private"):
+		return false
+	case header.Get("Vary") == "*":
+		return false
+	// Responses setting cookies are meant for a single client.
+	case len(header.Values("Set-Cookie")) > 0:
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("must-revalidate") && !respCC.has("s-maxage") {
+		return false
+	}
+
+	if _, ok := respCC.seconds("s-maxage"); ok {
+		return true
+	}
+	if _, ok := respCC.seconds("max-age"); ok {
+		return true
+	}
+	return header.Get("Expires") != "" || respCC.has("public") || heuristicallyCacheable[status]
+}
+
+// freshnessLifetime returns how long response stays fresh after it was
+// generated (RFC 9111 section 4.2.1).
+func freshnessLifetime(response *Response, respCC directives) time.Duration {
+	if lifetime, ok := respCC.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := respCC.seconds("max-age"); ok {
+		return lifetime
+	}
+
+	date := responseDate(response)
+	if expires := response.Header.Get("Expires"); expires != "" {
+		// Invalid dates, "0" in particular, mean already expired.
+		at, err := http.ParseTime(expires)
+		if err != nil || at.Before(date) {
+			return 0
+		}
+		return at.Sub(date)
+	}
+
+	// Heuristic freshness, a tenth of the time since the last modification
+	// capped to a day.
+	if heuristicallyCacheable[response.Status] || respCC.has("public") {
+		if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil && modified.Before(date) {
+			return min(date.Sub(modified)/10, 24*time.Hour)
+		}
+	}
+
+	return 0
+}
+
+// currentAge returns the time elapsed since response was generated or
+// validated by the origin (RFC 9111 section 4.2.3).
+func currentAge(response *Response, now time.Time) time.Duration {
+	apparentAge := max(0, response.ResponseTime.Sub(responseDate(response)))
+
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(response.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	responseDelay := response.ResponseTime.Sub(response.RequestTime)
+	correctedAgeValue := ageValue + responseDelay
+
+	correctedInitialAge := max(apparentAge, correctedAgeValue)
+	residentTime := now.Sub(response.ResponseTime)
+	return correctedInitialAge + residentTime
+}
+
+// responseDate returns the Date of response, or the time it was received
+// when the origin didn't send a valid one.
+func responseDate(response *Response) time.Time {
+	if date, err := http.ParseTime(response.Header.Get("Date")); err == nil {
+		return date
+	}
+	return response.ResponseTime
+}
+
+// mayServeStale reports whether the directives of a stored response allow
+// serving it once stale.
+func mayServeStale(respCC directives) bool {
+	return !respCC.has("must-revalidate") && !respCC.has("proxy-revalidate") &&
+		!respCC.has("s-maxage") && !respCC.has("no-cache")
+}
@@ -0,0 +1,256 @@
+package httpcache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const entryExtension = ".entry"
+
+// Prefix of the temporary files written by Put.
+const tempPrefix = ".tmp-"
+
+// DiskStorage keeps every entry in its own file under a directory. The file
+// starts with the key on its own line followed by the gob encoded entry.
+// Only the keys and sizes are held in memory, the least recently used files
+// are removed beyond MaxBytes. Entries stored by a previous process are
+// picked up when the storage is created.
+type DiskStorage struct {
+	mu    sync.Mutex
+	dir   string
+	index *index
+}
+
+func NewDiskStorage(dir string, maxBytes int64) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	storage := &DiskStorage{dir: dir, index: newIndex(maxBytes)}
+	if err := storage.load(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// load indexes the entries found in the directory, oldest first so that the
+// most recently used ones end up at the front of the LRU.
+func (s *DiskStorage) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	type stored struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var entries []stored
+
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.Name())
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), tempPrefix) {
+			// Left over by an interrupted Put.
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), entryExtension) {
+			continue
+		}
+
+		// Files that aren't entries of this storage are left alone.
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		key, err := readKey(path)
+		if err != nil || s.path(key) != path {
+			continue
+		}
+		entries = append(entries, stored{key: key, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, entry := range entries {
+		for _, evicted := range s.index.add(&item{key: entry.key, size: entry.size}) {
+			os.Remove(s.path(evicted))
+		}
+	}
+
+	return nil
+}
+
+func (s *DiskStorage) Get(key string) (*Entry, error) {
+	return s.read(key, true)
+}
+
+// Peek leaves the file of the entry untouched as well.
+func (s *DiskStorage) Peek(key string) (*Entry, error) {
+	return s.read(key, false)
+}
+
+// read returns the entry stored under key, marking it as recently used in
+// the index and on disk when touch is true.
+func (s *DiskStorage) read(key string, touch bool) (*Entry, error) {
+	s.mu.Lock()
+	var found *item
+	if touch {
+		found = s.index.get(key)
+	} else {
+		found = s.index.peek(key)
+	}
+	s.mu.Unlock()
+	if found == nil {
+		return nil, nil
+	}
+
+	path := s.path(key)
+	file, err := os.Open(path)
+	if err != nil {
+		s.forget(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if _, err := reader.ReadString('\n'); err != nil {
+		s.Delete(key)
+		return nil, fmt.Errorf("cache file %s: %w", path, err)
+	}
+	entry := new(Entry)
+	if err := gob.NewDecoder(reader).Decode(entry); err != nil {
+		s.Delete(key)
+		return nil, fmt.Errorf("cache file %s: %w", path, err)
+	}
+
+	if touch {
+		// Keep the order of the LRU across restarts.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+
+	return entry, nil
+}
+
+// Put writes entry to a temporary file renamed over the previous one, so
+// that readers never see a partial entry.
+func (s *DiskStorage) Put(entry *Entry) error {
+	if strings.Contains(entry.Key, "\n") {
+		return fmt.Errorf("cache key %q contains a newline", entry.Key)
+	}
+
+	file, err := os.CreateTemp(s.dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString(entry.Key + "\n")
+	err = gob.NewEncoder(writer).Encode(entry)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(file.Name())
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.index.maxBytes {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(file.Name(), s.path(entry.Key)); err != nil {
+		return err
+	}
+	for _, evicted := range s.index.add(&item{key: entry.Key, size: info.Size()}) {
+		os.Remove(s.path(evicted))
+	}
+	return nil
+}
+
+func (s *DiskStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index.remove(key)
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStorage) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.keys()
+}
+
+func (s *DiskStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.used
+}
+
+func (s *DiskStorage) Close() error {
+	return nil
+}
+
+// forget drops key from the index without touching its file.
+func (s *DiskStorage) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.remove(key)
+}
+
+// path returns the file of the entry stored under key.
+func (s *DiskStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+entryExtension)
+}
+
+// readKey returns the key written on the first line of an entry file.
+func readKey(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
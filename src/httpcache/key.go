@@ -0,0 +1,63 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var placeholder = regexp.MustCompile(`\{([a-z]+)(?:\.([^{}]+))?\}`)
+
+// keyTemplate builds the cache key of a request from a template such as
+// "{scheme}://{host}{uri}".
+type keyTemplate string
+
+func parseKeyTemplate(template string) (keyTemplate, error) {
+	for _, match := range placeholder.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "method", "scheme", "host", "path", "query", "uri":
+			if match[2] != "" {
+				return "", fmt.Errorf("invalid cache key placeholder %q", match[0])
+			}
+		case "header", "cookie":
+			if match[2] == "" {
+				return "", fmt.Errorf("cache key placeholder %q requires a name", match[0])
+			}
+		default:
+			return "", fmt.Errorf("unknown cache key placeholder %q", match[0])
+		}
+	}
+	return keyTemplate(template), nil
+}
+
+// expand returns the key of r.
+func (t keyTemplate) expand(r *http.Request) string {
+	return placeholder.ReplaceAllStringFunc(string(t), func(match string) string {
+		parts := placeholder.FindStringSubmatch(match)
+		switch parts[1] {
+		case "method":
+			return r.Method
+		case "scheme":
+			if r.TLS != nil {
+				return "https"
+			}
+			return "http"
+		case "host":
+			return strings.ToLower(r.Host)
+		case "path":
+			return r.URL.EscapedPath()
+		case "query":
+			return r.URL.RawQuery
+		case "uri":
+			return r.URL.RequestURI()
+		case "header":
+			return strings.Join(r.Header.Values(parts[2]), ",")
+		case "cookie":
+			if cookie, err := r.Cookie(parts[2]); err == nil {
+				return cookie.Value
+			}
+		}
+		return ""
+	})
+}
@@ -0,0 +1,72 @@
+package httpcache
+
+import "sync"
+
+// MemoryStorage keeps entries in memory and evicts the least recently used
+// ones beyond MaxBytes.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	index *index
+}
+
+func NewMemoryStorage(maxBytes int64) *MemoryStorage {
+	return &MemoryStorage{index: newIndex(maxBytes)}
+}
+
+func (s *MemoryStorage) Get(key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if found := s.index.get(key); found != nil {
+		return found.entry, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStorage) Peek(key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if found := s.index.peek(key); found != nil {
+		return found.entry, nil
+	}
+	return nil, nil
+}
+
+// Put stores entry, which must not be modified afterwards.
+func (s *MemoryStorage) Put(entry *Entry) error {
+	size := entry.size()
+	if size > s.index.maxBytes {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index.add(&item{key: entry.Key, size: size, entry: entry})
+	return nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index.remove(key)
+	return nil
+}
+
+func (s *MemoryStorage) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.keys()
+}
+
+func (s *MemoryStorage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.used
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
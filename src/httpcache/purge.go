@@ -0,0 +1,96 @@
+package httpcache
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Keys returns the sorted keys of the stored entries.
+func (c *Cache) Keys() []string {
+	keys := c.Storage.Keys()
+	slices.Sort(keys)
+	return keys
+}
+
+// Inspect returns the entry stored under key, or nil. The entry isn't
+// marked as recently used.
+func (c *Cache) Inspect(key string) (*Entry, error) {
+	return c.Storage.Peek(key)
+}
+
+// Tags returns the surrogate keys of response.
+func (c *Cache) Tags(response *Response) []string {
+	var tags []string
+	for _, line := range response.Header.Values(c.TagHeader) {
+		tags = append(tags, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		})...)
+	}
+	return tags
+}
+
+// PurgeKey removes the entry stored under key and reports whether there was
+// one.
+func (c *Cache) PurgeKey(key string) (bool, error) {
+	if !slices.Contains(c.Storage.Keys(), key) {
+		return false, nil
+	}
+	return true, c.Storage.Delete(key)
+}
+
+// PurgePrefix removes the entries whose key starts with prefix and returns
+// how many were removed. With the default key template, the prefix is a URL
+// such as "https://example.com/assets/".
+func (c *Cache) PurgePrefix(prefix string) (int, error) {
+	var keys []string
+	for _, key := range c.Storage.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return c.purge(keys)
+}
+
+// PurgeTag removes the entries holding a response tagged with tag and
+// returns how many were removed. Every entry is read, which can be slow with
+// a large disk storage.
+func (c *Cache) PurgeTag(tag string) (int, error) {
+	var keys []string
+	for _, key := range c.Storage.Keys() {
+		entry, err := c.Storage.Peek(key)
+		if err != nil {
+			c.logError(err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		for _, response := range entry.Responses {
+			if slices.Contains(c.Tags(response), tag) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return c.purge(keys)
+}
+
+func (c *Cache) purge(keys []string) (int, error) {
+	for i, key := range keys {
+		if err := c.Storage.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Age returns the current age of response.
+func (response *Response) Age(now time.Time) time.Duration {
+	return currentAge(response, now)
+}
+
+// TTL returns how long response stays fresh, negative once it is stale.
+func (response *Response) TTL(now time.Time) time.Duration {
+	return freshnessLifetime(response, parseDirectives(response.Header)) - currentAge(response, now)
+}
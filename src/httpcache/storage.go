@@ -0,0 +1,158 @@
+package httpcache
+
+import (
+	"container/list"
+	"net/http"
+	"time"
+)
+
+// Entry holds the responses stored under a cache key, one for every
+// combination of the values of the request headers named by Vary.
+type Entry struct {
+	Key string
+
+	// Canonical names of the request headers selecting a response, empty
+	// when the responses don't vary.
+	Vary []string
+
+	Responses []*Response
+}
+
+// Response is a stored response.
+type Response struct {
+	// Values of the Vary request headers the response was selected with,
+	// aligned with Entry.Vary.
+	VaryValues []string
+
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// When the request that obtained or last validated the response was
+	// sent, and when its answer was received.
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// Storage keeps entries by key. Implementations are safe for concurrent use
+// and evict entries on their own to stay within their size bound.
+type Storage interface {
+	// Get returns the entry stored under key, or nil.
+	Get(key string) (*Entry, error)
+
+	// Peek returns the entry stored under key, or nil, like Get but without
+	// marking it as recently used.
+	Peek(key string) (*Entry, error)
+
+	// Put stores entry under its key, replacing any previous entry.
+	Put(entry *Entry) error
+
+	Delete(key string) error
+
+	// Keys returns the keys of the stored entries.
+	Keys() []string
+
+	// Size returns the number of bytes used by the stored entries.
+	Size() int64
+
+	Close() error
+}
+
+// size approximates the memory used by entry.
+func (entry *Entry) size() int64 {
+	size := int64(len(entry.Key))
+	for _, name := range entry.Vary {
+		size += int64(len(name))
+	}
+	for _, response := range entry.Responses {
+		size += int64(len(response.Body))
+		for _, value := range response.VaryValues {
+			size += int64(len(value))
+		}
+		for name, values := range response.Header {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+// index is an LRU of keys bounded by the sum of their sizes, shared by the
+// storages. It isn't safe for concurrent use.
+type index struct {
+	maxBytes int64
+	used     int64
+
+	// Most recently used items at the front.
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type item struct {
+	key  string
+	size int64
+
+	// Only used by the memory storage.
+	entry *Entry
+}
+
+func newIndex(maxBytes int64) *index {
+	return &index{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the item stored under key and marks it as recently used.
+func (i *index) get(key string) *item {
+	element, ok := i.items[key]
+	if !ok {
+		return nil
+	}
+	i.lru.MoveToFront(element)
+	return element.Value.(*item)
+}
+
+// peek returns the item stored under key without changing the order.
+func (i *index) peek(key string) *item {
+	element, ok := i.items[key]
+	if !ok {
+		return nil
+	}
+	return element.Value.(*item)
+}
+
+// add stores an item and returns the keys evicted to make room for it.
+func (i *index) add(added *item) []string {
+	i.remove(added.key)
+
+	i.items[added.key] = i.lru.PushFront(added)
+	i.used += added.size
+
+	var evicted []string
+	for i.used > i.maxBytes {
+		oldest := i.lru.Back().Value.(*item)
+		i.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (i *index) keys() []string {
+	keys := make([]string, 0, len(i.items))
+	for key := range i.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (i *index) remove(key string) {
+	if element, ok := i.items[key]; ok {
+		i.lru.Remove(element)
+		delete(i.items, key)
+		i.used -= element.Value.(*item).size
+	}
+}
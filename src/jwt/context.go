@@ -0,0 +1,21 @@
+package jwt
+
+import "context"
+
+type claimsKey struct{}
+
+// NewContext returns a copy of ctx carrying the claims of the token verified
+// by Check.
+func NewContext(ctx context.Context, claims map[string]any) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// Claim returns the claim name of the token verified for the request of ctx,
+// formatted as a header value. It returns false when no token was verified
+// or the claim is missing, so that the claims of tokens that were never
+// verified can't be used to identify clients.
+func Claim(ctx context.Context, name string) (string, bool) {
+	claims, _ := ctx.Value(claimsKey{}).(map[string]any)
+	value, ok := HeaderValue(claims[name])
+	return value, ok && value != ""
+}
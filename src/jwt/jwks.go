@@ -0,0 +1,237 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"roxy/src/watch"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Least time between two fetches of the JWKS URL triggered by tokens
+	// signed by unknown keys.
+	unknownKeyInterval = time.Minute
+
+	fetchTimeout = 10 * time.Second
+	maxJWKSBytes = 1 << 20
+)
+
+// key is a public key of a JWKS.
+type key struct {
+	id string
+	// Algorithm the key is restricted to, empty if any.
+	algorithm string
+	public    crypto.PublicKey
+}
+
+// jwk is a JSON Web Key (RFC 7517), only the members of public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signature keys of a JWKS document, skipping keys of
+// unsupported types.
+func parseJWKS(data []byte) ([]key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []key
+	for i, candidate := range set.Keys {
+		if candidate.Use != "" && candidate.Use != "sig" {
+			continue
+		}
+		public, err := candidate.publicKey()
+		if errors.Is(err, errUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%q): %w", i, candidate.Kid, err)
+		}
+		keys = append(keys, key{id: candidate.Kid, algorithm: candidate.Alg, public: public})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signature key")
+	}
+	return keys, nil
+}
+
+var errUnsupportedKey = errors.New("unsupported key type")
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		var exchange ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, exchange = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, exchange = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, exchange = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, errUnsupportedKey
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid coordinates")
+		}
+		// Rejects points that are not on the curve.
+		if _, err := exchange.NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, errUnsupportedKey
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// keySet holds the keys of a JWKS file, read again when it changes, or of a
+// JWKS URL, fetched again every refresh and when a token is signed by an
+// unknown key. Keys that can't be loaded again stay in force.
+type keySet struct {
+	file *watch.File[[]key]
+
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	// Called with the errors of the loads.
+	errorLog func(error)
+
+	mu      sync.Mutex
+	keys    []key
+	checked time.Time
+	// Closed when the fetch in progress is over, nil when there is none.
+	fetched chan struct{}
+}
+
+// lookup returns the keys. Keys that are due are fetched again in the
+// background, while the previous ones keep being used, but the request
+// waits for them if they don't include kid.
+func (s *keySet) lookup(kid string, now time.Time) []key {
+	if s.file != nil {
+		keys, err := s.file.Get(now)
+		if err != nil {
+			s.errorLog(fmt.Errorf("jwks: %w", err))
+		}
+		return keys
+	}
+
+	s.mu.Lock()
+	keys := s.keys
+	due := now.Sub(s.checked) >= s.refresh
+	unknown := kid != "" && now.Sub(s.checked) >= unknownKeyInterval &&
+		!slices.ContainsFunc(keys, func(k key) bool { return k.id == kid })
+	fetched := s.fetched
+	if (due || unknown) && fetched == nil {
+		fetched = make(chan struct{})
+		s.fetched = fetched
+		s.checked = now
+		go func() {
+			if err := s.load(); err != nil {
+				s.errorLog(err)
+			}
+			s.mu.Lock()
+			s.fetched = nil
+			s.mu.Unlock()
+			close(fetched)
+		}()
+	}
+	s.mu.Unlock()
+
+	if !unknown {
+		return keys
+	}
+	<-fetched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys
+}
+
+// load fetches the keys of the URL.
+func (s *keySet) load() error {
+	data, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("jwks %s: %w", s.url, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("jwks %s: %w", s.url, err)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *keySet) fetch() ([]byte, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
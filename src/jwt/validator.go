@@ -0,0 +1,332 @@
+// Package jwt requires requests to carry a JSON Web Token (RFC 7519) signed
+// by a key of a JWKS, and forwards some of its claims to the backends.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"roxy/src/watch"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validator applies the [`config.JWT`] options of a pattern.
+type Validator struct {
+	options *config.JWT
+	keys    *keySet
+	leeway  time.Duration
+
+	// Called with the errors of the JWKS, the previous keys stay in force
+	// until it can be loaded again.
+	ErrorLog func(error)
+}
+
+// New creates the validator described by options. A JWKS file must be
+// valid, while a JWKS URL that can't be fetched yet only makes requests
+// fail until it can.
+func New(options *config.JWT) (*Validator, error) {
+	validator := &Validator{
+		options: options,
+		keys: &keySet{
+			url:     options.JWKSURL,
+			refresh: time.Duration(options.JWKSRefresh) * time.Second,
+			client:  &http.Client{Timeout: fetchTimeout},
+		},
+		leeway: time.Duration(options.Leeway) * time.Second,
+	}
+	validator.keys.errorLog = func(err error) {
+		if validator.ErrorLog != nil {
+			validator.ErrorLog(err)
+		}
+	}
+
+	if options.JWKSFile != "" {
+		file, err := watch.NewFile(options.JWKSFile, parseJWKS)
+		if err != nil {
+			return nil, fmt.Errorf("jwks: %w", err)
+		}
+		validator.keys.file = file
+		return validator, nil
+	}
+
+	validator.keys.load()
+	validator.keys.checked = time.Now()
+	return validator, nil
+}
+
+// Check verifies the token of r and sets the headers forwarding its claims.
+// It returns the claims of the token, or the response refusing r when the
+// token isn't valid.
+func (v *Validator) Check(r *http.Request) (map[string]any, *http.Response) {
+	for _, header := range v.options.ForwardClaims {
+		r.Header.Del(header)
+	}
+
+	token := v.token(r)
+	if token == "" {
+		return nil, new(local_http.LocalResponse).Unauthorized("Bearer")
+	}
+
+	claims, err := v.verify(token, time.Now())
+	if err != nil {
+		return nil, new(local_http.LocalResponse).Unauthorized(fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+	}
+
+	for claim, header := range v.options.ForwardClaims {
+		if value, ok := HeaderValue(claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	return claims, nil
+}
+
+// Verify checks the signature and the claims of token, as Check does, and
+// returns its claims.
+func (v *Validator) Verify(token string) (map[string]any, error) {
+	return v.verify(token, time.Now())
+}
+
+// token returns the token sent in the cookie or header of r.
+func (v *Validator) token(r *http.Request) string {
+	if v.options.Cookie != "" {
+		if cookie, err := r.Cookie(v.options.Cookie); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+
+	value := strings.TrimSpace(r.Header.Get(v.options.Header))
+	if !strings.EqualFold(v.options.Header, "Authorization") {
+		return value
+	}
+	scheme, token, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and the claims of token and returns its
+// claims.
+func (v *Validator) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	if !slices.Contains(v.options.Algorithms, h.Alg) {
+		return nil, fmt.Errorf("algorithm %s not accepted", h.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	keys := v.keys.lookup(h.Kid, now)
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := slices.ContainsFunc(keys, func(k key) bool {
+		return (h.Kid == "" || k.id == h.Kid) && (k.algorithm == "" || k.algorithm == h.Alg) &&
+			verifySignature(h.Alg, k.public, signed, signature)
+	})
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment, numbers as
+// [`json.Number`].
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+var hashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+// ECDSA curve sizes, in bits, of the ES algorithms.
+var curveSizes = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func verifySignature(algorithm string, public crypto.PublicKey, signed, signature []byte) bool {
+	if algorithm == "EdDSA" {
+		key, ok := public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, signed, signature)
+	}
+
+	hash := hashes[algorithm[2:]]
+	digester := hash.New()
+	digester.Write(signed)
+	digest := digester.Sum(nil)
+
+	switch algorithm[:2] {
+	case "RS":
+		key, ok := public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case "PS":
+		key, ok := public.(*rsa.PublicKey)
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		return ok && rsa.VerifyPSS(key, hash, digest, signature, options) == nil
+	case "ES":
+		key, ok := public.(*ecdsa.PublicKey)
+		if !ok || key.Curve.Params().BitSize != curveSizes[algorithm] {
+			return false
+		}
+		// The signature is R and S, each as long as the curve order.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// checkClaims checks the registered claims of a token, which must expire,
+// and the required ones.
+func (v *Validator) checkClaims(claims map[string]any, now time.Time) error {
+	expires, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		return errors.New("token without expiry")
+	}
+	if now.After(expires.Add(v.leeway)) {
+		return errors.New("token expired")
+	}
+
+	notBefore, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if now.Add(v.leeway).Before(notBefore) {
+		return errors.New("token not valid yet")
+	}
+
+	issuedAt, err := numericDate(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if now.Add(v.leeway).Before(issuedAt) {
+		return errors.New("token issued in the future")
+	}
+
+	if v.options.Issuer != "" && claims["iss"] != v.options.Issuer {
+		return errors.New("unexpected issuer")
+	}
+
+	if len(v.options.Audience) > 0 {
+		var audiences []any
+		switch audience := claims["aud"].(type) {
+		case string:
+			audiences = []any{audience}
+		case []any:
+			audiences = audience
+		}
+		if !slices.ContainsFunc(audiences, func(audience any) bool {
+			value, ok := audience.(string)
+			return ok && slices.Contains(v.options.Audience, value)
+		}) {
+			return errors.New("unexpected audience")
+		}
+	}
+
+	for _, name := range v.options.RequiredClaims {
+		if _, ok := claims[name]; !ok {
+			return fmt.Errorf("missing claim %s", name)
+		}
+	}
+
+	return nil
+}
+
+// numericDate returns the time of a NumericDate claim, zero if it is
+// absent.
+func numericDate(claims map[string]any, name string) (time.Time, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid %s claim", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s claim", name)
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second))), nil
+}
+
+// HeaderValue formats a claim as a header value, arrays as comma separated
+// lists and objects as JSON. Values that can't be sent in a header are
+// dropped.
+func HeaderValue(claim any) (string, bool) {
+	var value string
+	switch claim := claim.(type) {
+	case nil:
+		return "", false
+	case string:
+		value = claim
+	case json.Number:
+		value = claim.String()
+	case bool:
+		value = strconv.FormatBool(claim)
+	case []any:
+		items := make([]string, 0, len(claim))
+		for _, item := range claim {
+			if formatted, ok := HeaderValue(item); ok {
+				items = append(items, formatted)
+			}
+		}
+		value = strings.Join(items, ",")
+	default:
+		encoded, err := json.Marshal(claim)
+		if err != nil {
+			return "", false
+		}
+		value = string(encoded)
+	}
+
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return "", false
+	}
+	return value, true
+}
@@ -0,0 +1,268 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"testing"
+	"time"
+)
+
+var encode = base64.RawURLEncoding.EncodeToString
+
+type signer struct {
+	id        string
+	algorithm string
+	private   crypto.Signer
+}
+
+func (s *signer) jwk() map[string]string {
+	switch public := s.private.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.id, "n": encode(public.N.Bytes()), "e": encode(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.id, "crv": "P-256", "x": encode(public.X.FillBytes(make([]byte, 32))), "y": encode(public.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.id, "crv": "Ed25519", "x": encode(public)}
+	}
+	return nil
+}
+
+func (s *signer) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.algorithm, "kid": s.id, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+
+	var signature []byte
+	var err error
+	digest := sha256.Sum256([]byte(signed))
+	switch s.algorithm {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, s.private.(*rsa.PrivateKey), crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var sigR, sigS *big.Int
+		sigR, sigS, err = ecdsa.Sign(rand.Reader, s.private.(*ecdsa.PrivateKey), digest[:])
+		signature = append(sigR.FillBytes(make([]byte, 32)), sigS.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		signature = ed25519.Sign(s.private.(ed25519.PrivateKey), []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encode(signature)
+}
+
+func writeJWKS(t *testing.T, path string, signers ...*signer) {
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signers(t *testing.T) []*signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	return []*signer{
+		{id: "rsa", algorithm: "RS256", private: rsaKey},
+		{id: "pss", algorithm: "PS256", private: rsaKey},
+		{id: "ec", algorithm: "ES256", private: ecKey},
+		{id: "ed", algorithm: "EdDSA", private: edKey},
+	}
+}
+
+func request(token string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func status(_ map[string]any, resp *http.Response) int {
+	if resp == nil {
+		return http.StatusOK
+	}
+	return resp.StatusCode
+}
+
+func TestValidate(t *testing.T) {
+	keys := signers(t)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys...)
+
+	validator, err := New(&config.JWT{
+		Header:         "Authorization",
+		JWKSFile:       jwks,
+		Algorithms:     config.JWTAlgorithms,
+		Issuer:         "https://issuer.example",
+		Audience:       []string{"api"},
+		Leeway:         30,
+		RequiredClaims: []string{"sub"},
+		ForwardClaims:  map[string]string{"sub": "X-User", "groups": "X-Groups"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]any{"iss": "https://issuer.example", "aud": []string{"web", "api"}, "sub": "alice", "groups": []string{"admin", "dev"}, "exp": now + 60}
+	for _, s := range keys {
+		r := request(s.sign(t, valid))
+		r.Header.Set("X-User", "mallory")
+		claims, resp := validator.Check(r)
+		if got := status(claims, resp); got != http.StatusOK {
+			t.Errorf("%s: status = %d", s.algorithm, got)
+			continue
+		}
+		if r.Header.Get("X-User") != "alice" || r.Header.Get("X-Groups") != "admin,dev" {
+			t.Errorf("%s: forwarded headers %v", s.algorithm, r.Header)
+		}
+		if sub, _ := Claim(NewContext(r.Context(), claims), "sub"); sub != "alice" {
+			t.Errorf("%s: verified sub = %q", s.algorithm, sub)
+		}
+	}
+
+	with := func(name string, value any) map[string]any {
+		claims := make(map[string]any)
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	for name, token := range map[string]string{
+		"missing":          "",
+		"expired":          keys[0].sign(t, with("exp", now-60)),
+		"without expiry":   keys[0].sign(t, with("exp", nil)),
+		"not valid yet":    keys[0].sign(t, with("nbf", now+60)),
+		"wrong issuer":     keys[0].sign(t, with("iss", "https://other.example")),
+		"wrong audience":   keys[0].sign(t, with("aud", "web")),
+		"missing claim":    keys[0].sign(t, with("sub", nil)),
+		"tampered":         keys[0].sign(t, valid)[:40] + "x" + keys[0].sign(t, valid)[41:],
+		"wrong key":        (&signer{id: "ec", algorithm: "EdDSA", private: keys[3].private}).sign(t, valid),
+		"alg none":         encode([]byte(`{"alg":"none"}`)) + "." + encode([]byte(`{"sub":"alice"}`)) + ".",
+		"malformed header": "a.b.c",
+	} {
+		r := request(token)
+		claims, resp := validator.Check(r)
+		if status(claims, resp) != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: status = %d", name, status(claims, resp))
+		}
+		if r.Header.Get("X-User") != "" {
+			t.Errorf("%s: forwarded headers %v", name, r.Header)
+		}
+	}
+
+	// Within the leeway.
+	if got := status(validator.Check(request(keys[0].sign(t, with("exp", now-10))))); got != http.StatusOK {
+		t.Errorf("expired within the leeway: status = %d", got)
+	}
+
+	// The file is read again once it changes.
+	rotated := &signer{id: "rotated", algorithm: "EdDSA", private: keys[3].private}
+	writeJWKS(t, jwks, rotated)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(jwks, later, later)
+	validator.keys.file.Expire()
+	if got := status(validator.Check(request(rotated.sign(t, valid)))); got != http.StatusOK {
+		t.Errorf("rotated key: status = %d", got)
+	}
+	if got := status(validator.Check(request(keys[0].sign(t, valid)))); got != http.StatusUnauthorized {
+		t.Errorf("removed key: status = %d", got)
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	keys := signers(t)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, keys[0])
+	fetches := 0
+	var blocked chan struct{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if blocked != nil {
+			<-blocked
+		}
+		fetches++
+		http.ServeFile(w, r, jwks)
+	}))
+	defer server.Close()
+
+	validator, err := New(&config.JWT{
+		Header:      "X-Token",
+		JWKSURL:     server.URL,
+		JWKSRefresh: 3600,
+		Algorithms:  []string{"RS256", "EdDSA"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"exp": time.Now().Unix() + 60}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Token", keys[0].sign(t, claims))
+	if got := status(validator.Check(r)); got != http.StatusOK || fetches != 1 {
+		t.Fatalf("status = %d, fetches = %d", got, fetches)
+	}
+
+	// Algorithms outside the list are refused.
+	r.Header.Set("X-Token", keys[2].sign(t, claims))
+	if got := status(validator.Check(r)); got != http.StatusUnauthorized {
+		t.Errorf("ES256 token: status = %d", got)
+	}
+
+	// An unknown key is fetched again, at most once a minute.
+	writeJWKS(t, jwks, keys[0], keys[3])
+	r.Header.Set("X-Token", keys[3].sign(t, claims))
+	if got := status(validator.Check(r)); got != http.StatusUnauthorized || fetches != 1 {
+		t.Errorf("unknown key right after a fetch: status = %d, fetches = %d", got, fetches)
+	}
+	validator.keys.checked = time.Now().Add(-2 * time.Minute)
+	if got := status(validator.Check(r)); got != http.StatusOK || fetches != 2 {
+		t.Errorf("unknown key: status = %d, fetches = %d", got, fetches)
+	}
+
+	// Due keys are fetched again in the background, the known ones serve
+	// meanwhile.
+	writeJWKS(t, jwks, keys[3])
+	release := make(chan struct{})
+	blocked = release
+	validator.keys.checked = time.Now().Add(-2 * time.Hour)
+	r.Header.Set("X-Token", keys[0].sign(t, claims))
+	if got := status(validator.Check(r)); got != http.StatusOK {
+		t.Errorf("key of the previous fetch: status = %d", got)
+	}
+	validator.keys.mu.Lock()
+	fetched := validator.keys.fetched
+	validator.keys.mu.Unlock()
+	close(release)
+	<-fetched
+	if got := status(validator.Check(r)); got != http.StatusUnauthorized || fetches != 3 {
+		t.Errorf("removed key: status = %d, fetches = %d", got, fetches)
+	}
+}
@@ -15,6 +15,14 @@ type Error string
 func (e Error) Error() string { return string(e) }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		if err := purge(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	config, err := config.NewConfig().Load("config.toml")
 
 	if err != nil {
@@ -35,5 +43,5 @@ func main() {
 		local_server.ShutdownOn()
 	}()
 
-	go local_server.Run()
+	local_server.Run()
 }
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels identify a series within a metric family.
+type Labels map[string]string
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if g.bits.CompareAndSwap(old, new) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+type family struct {
+	name string
+	help string
+	kind string
+
+	// Series indexed by their rendered labels.
+	series map[string]*series
+}
+
+type series struct {
+	// Counter or Gauge, nil for gauge functions.
+	metric any
+	value  func() float64
+}
+
+// Registry holds metric families and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry exposed by the metrics listener.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter identified by name and labels, creating it if
+// needed.
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	counter := &Counter{}
+	if existing := r.register(name, help, "counter", labels, counter, func() float64 {
+		return float64(counter.Value())
+	}); existing != nil {
+		return existing.(*Counter)
+	}
+	return counter
+}
+
+// Gauge returns the gauge identified by name and labels, creating it if
+// needed.
+func (r *Registry) Gauge(name, help string, labels Labels) *Gauge {
+	gauge := &Gauge{}
+	if existing := r.register(name, help, "gauge", labels, gauge, gauge.Value); existing != nil {
+		return existing.(*Gauge)
+	}
+	return gauge
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when scraped.
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, "gauge", labels, nil, fn)
+}
+
+// register adds a series and returns the metric previously registered under
+// the same name and labels, if any, so that they keep counting.
+func (r *Registry) register(name, help, kind string, labels Labels, metric any, value func() float64) any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+
+	key := renderLabels(labels)
+	if existing, ok := f.series[key]; ok && existing.metric != nil && metric != nil {
+		return existing.metric
+	}
+
+	f.series[key] = &series{metric: metric, value: value}
+	return nil
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&out, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&out, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := strconv.FormatFloat(f.series[key].value(), 'g', -1, 64)
+			fmt.Fprintf(&out, "%s%s %s\n", f.name, key, value)
+		}
+	}
+	r.mu.Unlock()
+
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// Handler serves the registry to Prometheus scrapers.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+func renderLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,319 @@
+// Package oidc logs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE, and keeps their session in an encrypted
+// cookie.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	local_http "roxy/src/server/http"
+	"strings"
+	"time"
+)
+
+// Seconds a user has to log in with the provider.
+const loginLifetime = 600
+
+// Header carrying the access token to the backends, see
+// [`config.OIDC.PassAccessToken`].
+const accessTokenHeader = "X-Forwarded-Access-Token"
+
+// Authenticator applies the [`config.OIDC`] options of a pattern.
+type Authenticator struct {
+	options  *config.OIDC
+	provider *provider
+	sealer   *sealer
+
+	// Path of the redirect URL, handled by the authenticator.
+	callbackPath string
+	// Cookies are only sent over HTTPS when the redirect URL uses it.
+	secure bool
+
+	now func() time.Time
+
+	// Called with the failures of the provider and of the tokens it issues.
+	ErrorLog func(error)
+}
+
+// New creates the authenticator described by options. The provider is
+// discovered when the first user logs in.
+func New(options *config.OIDC) *Authenticator {
+	redirect, _ := url.Parse(options.RedirectURL)
+	authenticator := &Authenticator{
+		options:      options,
+		sealer:       newSealer(options.CookieSecret),
+		callbackPath: redirect.Path,
+		secure:       redirect.Scheme == "https",
+		now:          time.Now,
+	}
+	authenticator.provider = newProvider(options, authenticator.logError)
+	return authenticator
+}
+
+// Check lets r go on with the identity headers of its session, setting the
+// cookies of refreshed sessions on w, and returns nil. Otherwise it returns
+// the response handling r: a redirect to the provider, the end of a login or
+// of the session, or a refusal. The error is returned when the provider
+// can't be reached.
+func (a *Authenticator) Check(w http.ResponseWriter, r *http.Request) (*http.Response, error) {
+	for _, header := range a.options.ClaimHeaders {
+		r.Header.Del(header)
+	}
+	r.Header.Del(accessTokenHeader)
+
+	switch r.URL.Path {
+	case a.callbackPath:
+		return a.callback(w, r)
+	case a.options.LogoutPath:
+		if a.options.LogoutPath != "" {
+			writeCookie(w, r, a.options.CookieName, "", -1, a.secure)
+			return new(local_http.LocalResponse).Redirect(http.StatusFound, "/"), nil
+		}
+	}
+
+	current := a.session(r)
+	if current != nil && a.now().Unix() >= current.Expiry {
+		current = a.refresh(w, r, current)
+	}
+	if current == nil {
+		return a.login(w, r)
+	}
+
+	for claim, header := range a.options.ClaimHeaders {
+		if value, ok := jwt.HeaderValue(current.Claims[claim]); ok {
+			r.Header.Set(header, value)
+		}
+	}
+	if a.options.PassAccessToken && current.AccessToken != "" {
+		r.Header.Set(accessTokenHeader, current.AccessToken)
+	}
+	return nil, nil
+}
+
+// session returns the session of r, nil if it has none or it ended.
+func (a *Authenticator) session(r *http.Request) *session {
+	sealed := readCookie(r, a.options.CookieName)
+	if sealed == "" {
+		return nil
+	}
+	var current session
+	if err := a.sealer.open(a.options.CookieName, sealed, &current); err != nil {
+		return nil
+	}
+	if a.now().Unix() >= current.Created+int64(a.options.SessionLifetime) {
+		return nil
+	}
+	return &current
+}
+
+// login redirects the user to the provider, remembering where to bring them
+// back.
+func (a *Authenticator) login(w http.ResponseWriter, r *http.Request) (*http.Response, error) {
+	// Only browsers navigating can follow the provider's pages.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return new(local_http.LocalResponse).Unauthorized(), nil
+	}
+
+	endpoints, _, err := a.provider.discover(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	pending := login{State: random(), Verifier: random(), Nonce: random(), Return: r.URL.RequestURI()}
+	sealed, err := a.sealer.seal(a.loginCookie(), pending)
+	if err != nil {
+		return nil, err
+	}
+	writeCookie(w, r, a.loginCookie(), sealed, loginLifetime, a.secure)
+
+	challenge := sha256.Sum256([]byte(pending.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.options.ClientID},
+		"redirect_uri":          {a.options.RedirectURL},
+		"scope":                 {strings.Join(a.options.Scopes, " ")},
+		"state":                 {pending.State},
+		"nonce":                 {pending.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(endpoints.Authorization, "?") {
+		separator = "&"
+	}
+	return new(local_http.LocalResponse).Redirect(http.StatusFound, endpoints.Authorization+separator+query.Encode()), nil
+}
+
+// callback exchanges the authorization code sent back by the provider for
+// tokens and starts the session.
+func (a *Authenticator) callback(w http.ResponseWriter, r *http.Request) (*http.Response, error) {
+	var pending login
+	sealed := readCookie(r, a.loginCookie())
+	if sealed == "" || a.sealer.open(a.loginCookie(), sealed, &pending) != nil {
+		return new(local_http.LocalResponse).Error(http.StatusBadRequest), nil
+	}
+	writeCookie(w, r, a.loginCookie(), "", -1, a.secure)
+
+	query := r.URL.Query()
+	if query.Get("state") != pending.State {
+		return new(local_http.LocalResponse).Error(http.StatusBadRequest), nil
+	}
+	if query.Get("error") != "" {
+		a.logError(fmt.Errorf("login: %s %s", query.Get("error"), query.Get("error_description")))
+		return new(local_http.LocalResponse).Forbidden(), nil
+	}
+
+	endpoints, validator, err := a.provider.discover(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	issued, err := a.provider.token(r.Context(), endpoints.Token, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {a.options.RedirectURL},
+		"code_verifier": {pending.Verifier},
+	})
+	if errors.Is(err, errRejected) {
+		a.logError(fmt.Errorf("login: %w", err))
+		return new(local_http.LocalResponse).Forbidden(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := validator.Verify(issued.IDToken)
+	if err == nil && claims["nonce"] != pending.Nonce {
+		err = errors.New("unexpected nonce")
+	}
+	if err != nil {
+		a.logError(fmt.Errorf("login: id token: %w", err))
+		return new(local_http.LocalResponse).Forbidden(), nil
+	}
+
+	now := a.now()
+	current := &session{Created: now.Unix()}
+	a.update(current, issued, claims, now)
+	if err := a.save(w, r, current); err != nil {
+		return nil, err
+	}
+
+	// Only paths of this site, not //host URLs.
+	destination := pending.Return
+	if !strings.HasPrefix(destination, "/") || strings.HasPrefix(destination, "//") || strings.HasPrefix(destination, "/\\") {
+		destination = "/"
+	}
+	return new(local_http.LocalResponse).Redirect(http.StatusFound, destination), nil
+}
+
+// refresh renews the tokens of an expired session, and returns the renewed
+// session or nil if the user must log in again.
+func (a *Authenticator) refresh(w http.ResponseWriter, r *http.Request, current *session) *session {
+	if current.RefreshToken == "" {
+		return nil
+	}
+
+	endpoints, validator, err := a.provider.discover(r.Context())
+	if err != nil {
+		a.logError(err)
+		return nil
+	}
+	issued, err := a.provider.token(r.Context(), endpoints.Token, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {current.RefreshToken},
+	})
+	if err != nil {
+		if !errors.Is(err, errRejected) {
+			a.logError(fmt.Errorf("refresh: %w", err))
+		}
+		return nil
+	}
+
+	claims := current.Claims
+	if issued.IDToken != "" {
+		if claims, err = validator.Verify(issued.IDToken); err != nil {
+			a.logError(fmt.Errorf("refresh: id token: %w", err))
+			return nil
+		}
+	}
+	if issued.RefreshToken == "" {
+		issued.RefreshToken = current.RefreshToken
+	}
+
+	a.update(current, issued, claims, a.now())
+	if err := a.save(w, r, current); err != nil {
+		a.logError(err)
+		return nil
+	}
+	return current
+}
+
+// update stores newly issued tokens and the claims of their ID token in a
+// session.
+func (a *Authenticator) update(current *session, issued *tokens, claims map[string]any, now time.Time) {
+	current.Claims = make(map[string]any)
+	for claim := range a.options.ClaimHeaders {
+		if value, ok := claims[claim]; ok {
+			current.Claims[claim] = value
+		}
+	}
+
+	current.AccessToken = ""
+	if a.options.PassAccessToken {
+		current.AccessToken = issued.AccessToken
+	}
+	current.RefreshToken = issued.RefreshToken
+
+	if issued.ExpiresIn > 0 {
+		current.Expiry = now.Unix() + issued.ExpiresIn
+	} else if expiry, err := claimTime(claims["exp"]); err == nil {
+		current.Expiry = expiry
+	} else {
+		current.Expiry = now.Unix()
+	}
+}
+
+// save writes the session cookie, lasting until the end of the session.
+func (a *Authenticator) save(w http.ResponseWriter, r *http.Request, current *session) error {
+	sealed, err := a.sealer.seal(a.options.CookieName, current)
+	if err != nil {
+		return err
+	}
+	maxAge := current.Created + int64(a.options.SessionLifetime) - a.now().Unix()
+	writeCookie(w, r, a.options.CookieName, sealed, int(maxAge), a.secure)
+	return nil
+}
+
+func (a *Authenticator) loginCookie() string {
+	return a.options.CookieName + "_login"
+}
+
+func (a *Authenticator) logError(err error) {
+	if a.ErrorLog != nil {
+		a.ErrorLog(err)
+	}
+}
+
+// claimTime returns the Unix time of a NumericDate claim.
+func claimTime(claim any) (int64, error) {
+	value, ok := jwt.HeaderValue(claim)
+	if !ok {
+		return 0, errors.New("missing time")
+	}
+	var seconds float64
+	_, err := fmt.Sscan(value, &seconds)
+	return int64(seconds), err
+}
+
+// random returns a random URL safe string, unguessable.
+func random() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"roxy/src/config"
+	"testing"
+	"time"
+)
+
+// mockProvider is an OpenID Connect provider issuing tokens for alice.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// Authorization request of the pending code.
+	authorization url.Values
+	refreshes     int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{t: t, key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "1", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, _ := r.BasicAuth(); id != "roxy" || secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if p.authorization == nil || r.PostFormValue("code") != "code-1" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.authorization.Get("code_challenge") ||
+			r.PostFormValue("redirect_uri") != p.authorization.Get("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access-1",
+			"refresh_token": "refresh-1",
+			"expires_in":    300,
+			"id_token":      p.idToken(p.authorization.Get("nonce")),
+		})
+	case "refresh_token":
+		p.refreshes++
+		if r.PostFormValue("refresh_token") != "refresh-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access-2", "expires_in": 300})
+	}
+}
+
+func (p *mockProvider) idToken(nonce string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "1"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": p.server.URL, "aud": "roxy", "sub": "alice", "email": "alice@example.com",
+		"nonce": nonce, "iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	return signed + "." + encode(signature)
+}
+
+// browse sends a request with the cookies of jar to a, and stores the
+// cookies of the answer in jar.
+func browse(t *testing.T, a *Authenticator, jar map[string]string, method, target string) (*http.Request, *http.Response) {
+	r := httptest.NewRequest(method, target, nil)
+	for name, value := range jar {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	w := httptest.NewRecorder()
+	resp, err := a.Check(w, r)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(jar, cookie.Name)
+		} else {
+			jar[cookie.Name] = cookie.Value
+		}
+	}
+	return r, resp
+}
+
+func TestLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	authenticator := New(&config.OIDC{
+		Issuer:          provider.server.URL,
+		ClientID:        "roxy",
+		ClientSecret:    "secret",
+		RedirectURL:     "https://app.example/oauth2/callback",
+		LogoutPath:      "/logout",
+		Scopes:          []string{"openid", "email"},
+		CookieName:      "roxy_session",
+		CookieSecret:    "0123456789abcdef0123456789abcdef",
+		SessionLifetime: 86400,
+		ClaimHeaders:    map[string]string{"sub": "X-Forwarded-User", "email": "X-Forwarded-Email"},
+		PassAccessToken: true,
+	})
+	jar := make(map[string]string)
+
+	// Unauthenticated users go to the provider.
+	_, resp := browse(t, authenticator, jar, "GET", "/dashboard?tab=1")
+	if resp == nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("anonymous request: %v", resp)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	provider.authorization = location.Query()
+	if location.Path != "/authorize" || provider.authorization.Get("code_challenge_method") != "S256" ||
+		provider.authorization.Get("scope") != "openid email" || jar["roxy_session_login"] == "" {
+		t.Fatalf("redirect to %s, cookies %v", location, jar)
+	}
+
+	// A forged state is refused.
+	forged := make(map[string]string)
+	for name, value := range jar {
+		forged[name] = value
+	}
+	if _, resp := browse(t, authenticator, forged, "GET", "/oauth2/callback?code=code-1&state=forged"); resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged state: %v", resp)
+	}
+
+	_, resp = browse(t, authenticator, jar, "GET", "/oauth2/callback?code=code-1&state="+provider.authorization.Get("state"))
+	if resp == nil || resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/dashboard?tab=1" {
+		t.Fatalf("callback: %v", resp)
+	}
+	if jar["roxy_session"] == "" || jar["roxy_session_login"] != "" {
+		t.Fatalf("cookies after the callback %v", jar)
+	}
+
+	r, resp := browse(t, authenticator, jar, "GET", "/dashboard")
+	if resp != nil || r.Header.Get("X-Forwarded-User") != "alice" || r.Header.Get("X-Forwarded-Email") != "alice@example.com" ||
+		r.Header.Get("X-Forwarded-Access-Token") != "access-1" {
+		t.Fatalf("logged in request: %v %v", resp, r.Header)
+	}
+
+	// Expired tokens are refreshed.
+	authenticator.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	r, resp = browse(t, authenticator, jar, "GET", "/dashboard")
+	if resp != nil || provider.refreshes != 1 || r.Header.Get("X-Forwarded-Access-Token") != "access-2" || r.Header.Get("X-Forwarded-User") != "alice" {
+		t.Fatalf("refreshed request: %v %d %v", resp, provider.refreshes, r.Header)
+	}
+	r, _ = browse(t, authenticator, jar, "GET", "/dashboard")
+	if provider.refreshes != 1 || r.Header.Get("X-Forwarded-Access-Token") != "access-2" {
+		t.Errorf("refreshed session not saved: %d refreshes", provider.refreshes)
+	}
+
+	// Other requests than navigations are refused instead of redirected.
+	if _, resp := browse(t, authenticator, make(map[string]string), "POST", "/api"); resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous POST: %v", resp)
+	}
+
+	if _, resp := browse(t, authenticator, jar, "GET", "/logout"); resp == nil || resp.StatusCode != http.StatusFound || len(jar) != 0 {
+		t.Errorf("logout: %v, cookies %v", resp, jar)
+	}
+}
+
+func TestCookieChunks(t *testing.T) {
+	value := make([]byte, 2*chunkSize+10)
+	for i := range value {
+		value[i] = 'a' + byte(i%26)
+	}
+
+	w := httptest.NewRecorder()
+	writeCookie(w, httptest.NewRequest("GET", "/", nil), "session", string(value), 60, true)
+	r := httptest.NewRequest("GET", "/", nil)
+	cookies := w.Result().Cookies()
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	if len(cookies) != 3 || readCookie(r, "session") != string(value) {
+		t.Fatalf("%d cookies", len(cookies))
+	}
+
+	// Shorter values expire the chunks left over.
+	w = httptest.NewRecorder()
+	writeCookie(w, r, "session", "short", 60, true)
+	cookies = w.Result().Cookies()
+	if len(cookies) != 3 || cookies[0].Value != "short" || cookies[1].MaxAge != -1 || cookies[2].MaxAge != -1 {
+		t.Errorf("cookies %v", cookies)
+	}
+}
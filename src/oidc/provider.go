@@ -0,0 +1,166 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Least time between two attempts to discover the provider.
+	discoveryRetry = 10 * time.Second
+
+	requestTimeout   = 10 * time.Second
+	maxResponseBytes = 1 << 20
+
+	// Seconds of clock skew tolerated with the provider.
+	leeway = 60
+)
+
+// errRejected is wrapped by the errors of requests the provider refused,
+// as opposed to the failures to reach it.
+var errRejected = errors.New("rejected by the provider")
+
+// endpoints are the parts of the provider metadata that roxy uses.
+type endpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	JWKS          string `json:"jwks_uri"`
+}
+
+// provider is an OpenID Connect provider, discovered the first time it is
+// needed.
+type provider struct {
+	options *config.OIDC
+	client  *http.Client
+
+	mu        sync.Mutex
+	endpoints *endpoints
+	// Verifies the ID tokens signed by the keys of the provider.
+	validator *jwt.Validator
+	failed    time.Time
+	errorLog  func(error)
+}
+
+func newProvider(options *config.OIDC, errorLog func(error)) *provider {
+	return &provider{
+		options:  options,
+		client:   &http.Client{Timeout: requestTimeout},
+		errorLog: errorLog,
+	}
+}
+
+// discover returns the endpoints and the ID token validator of the
+// provider, fetching its metadata if not done yet.
+func (p *provider) discover(ctx context.Context) (*endpoints, *jwt.Validator, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, p.validator, nil
+	}
+	if time.Since(p.failed) < discoveryRetry {
+		return nil, nil, errors.New("provider discovery failed recently")
+	}
+
+	discovered, err := p.fetchMetadata(ctx)
+	if err != nil {
+		p.failed = time.Now()
+		return nil, nil, err
+	}
+
+	validator, _ := jwt.New(&config.JWT{
+		JWKSURL:     discovered.JWKS,
+		JWKSRefresh: 3600,
+		Algorithms:  config.JWTAlgorithms,
+		Issuer:      p.options.Issuer,
+		Audience:    []string{p.options.ClientID},
+		Leeway:      leeway,
+	})
+	validator.ErrorLog = p.errorLog
+
+	p.endpoints, p.validator = discovered, validator
+	return p.endpoints, p.validator, nil
+}
+
+func (p *provider) fetchMetadata(ctx context.Context) (*endpoints, error) {
+	location := strings.TrimSuffix(p.options.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s: status %s", location, resp.Status)
+	}
+
+	var discovered endpoints
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&discovered); err != nil {
+		return nil, fmt.Errorf("discovery: %s: %w", location, err)
+	}
+	if discovered.Issuer != p.options.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q instead of %q", discovered.Issuer, p.options.Issuer)
+	}
+	if discovered.Authorization == "" || discovered.Token == "" || discovered.JWKS == "" {
+		return nil, fmt.Errorf("discovery: %s: missing endpoints", location)
+	}
+	return &discovered, nil
+}
+
+// tokens is a response of the token endpoint.
+type tokens struct {
+	AccessToken  string `json:"access_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// token sends a grant to the token endpoint, authenticating with the client
+// secret if there is one.
+func (p *provider) token(ctx context.Context, endpoint string, grant url.Values) (*tokens, error) {
+	grant.Set("client_id", p.options.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(grant.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.options.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.options.ClientID), url.QueryEscape(p.options.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result tokens
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&result)
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, fmt.Errorf("token endpoint: %w: %s %s", errRejected, result.Error, result.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("token endpoint: status %s", resp.Status)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("token endpoint: %w", decodeErr)
+	}
+	return &result, nil
+}
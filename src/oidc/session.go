@@ -0,0 +1,135 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Cookies longer than this are split, browsers keeping about 4KB per
+	// cookie.
+	chunkSize = 3800
+	maxChunks = 8
+)
+
+// session is the content of the session cookie.
+type session struct {
+	// Claims of the ID token sent to the backends.
+	Claims map[string]any `json:"c,omitempty"`
+	// Kept only when it is sent to the backends.
+	AccessToken  string `json:"a,omitempty"`
+	RefreshToken string `json:"r,omitempty"`
+	// Unix times the tokens expire and the session started.
+	Expiry  int64 `json:"e"`
+	Created int64 `json:"t"`
+}
+
+// login is the content of the cookie kept while the user logs in with the
+// provider.
+type login struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	// URI requested before logging in.
+	Return string `json:"r"`
+}
+
+// sealer encrypts and authenticates the content of cookies.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secret string) *sealer {
+	key := sha256.Sum256([]byte(secret))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &sealer{aead: aead}
+}
+
+// seal encodes value for the cookie name, which other cookies can't be
+// swapped for.
+func (s *sealer) seal(name string, value any) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (s *sealer) open(name, sealed string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+// chunkName is the name of the cookie holding the index chunk of the value
+// of the cookie name.
+func chunkName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	return name + "_" + strconv.Itoa(index)
+}
+
+// readCookie returns the value of the cookie name, joining its chunks.
+func readCookie(r *http.Request, name string) string {
+	var value strings.Builder
+	for index := range maxChunks {
+		cookie, err := r.Cookie(chunkName(name, index))
+		if err != nil {
+			break
+		}
+		value.WriteString(cookie.Value)
+	}
+	return value.String()
+}
+
+// writeCookie sets the cookie name to value, split in chunks if needed, and
+// expires the chunks of its previous value that are left over. An empty
+// value expires the cookie.
+func writeCookie(w http.ResponseWriter, r *http.Request, name, value string, maxAge int, secure bool) {
+	var chunks []string
+	for len(value) > 0 {
+		size := min(chunkSize, len(value))
+		chunks = append(chunks, value[:size])
+		value = value[size:]
+	}
+
+	for index := range maxChunks {
+		cookie := &http.Cookie{
+			Name:     chunkName(name, index),
+			Path:     "/",
+			MaxAge:   maxAge,
+			Secure:   secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if index < len(chunks) {
+			cookie.Value = chunks[index]
+		} else if _, err := r.Cookie(cookie.Name); err == nil {
+			cookie.MaxAge = -1
+		} else {
+			break
+		}
+		http.SetCookie(w, cookie)
+	}
+}
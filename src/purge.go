@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"roxy/src/config"
+)
+
+// purge implements the purge subcommand, which asks the admin API of a
+// running instance to purge cached responses:
+//
+//	roxy purge [-admin address] [-host name] [-route route] -key K | -prefix P | -tag T
+func purge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	admin := flags.String("admin", "", "address of the admin API, read from the [admin] table of config.toml by default")
+	key := flags.String("key", "", "purge the entry stored under this key")
+	prefix := flags.String("prefix", "", "purge the entries whose key starts with this prefix")
+	tag := flags.String("tag", "", "purge the entries tagged with this surrogate key")
+	host := flags.String("host", "", "only purge the caches of this host")
+	route := flags.String("route", "", "only purge the cache of this route")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	address := *admin
+	if address == "" {
+		adminConfig, err := config.LoadAdmin("config.toml")
+		if err != nil {
+			return err
+		}
+		if adminConfig == nil {
+			return fmt.Errorf("no [admin] table in config.toml, use -admin")
+		}
+		address = adminConfig.Listen
+	}
+
+	query := url.Values{}
+	for name, value := range map[string]string{"key": *key, "prefix": *prefix, "tag": *tag, "host": *host, "route": *route} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	resp, err := http.Post("http://"+address+"/cache/purge?"+query.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Purged int    `json:"purged"`
+		Error  string `json:"error"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("unexpected answer from the admin API: %s", body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("purge failed: %s", result.Error)
+	}
+
+	fmt.Printf("Purged %d entries\n", result.Purged)
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"roxy/src/admin"
+	"roxy/src/httpcache"
+	"roxy/src/service"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	cache := &httpcache.Cache{Storage: httpcache.NewMemoryStorage(1 << 20), TagHeader: "Surrogate-Key"}
+	for _, path := range []string{"/a.js", "/b.js", "/index.html"} {
+		cache.Storage.Put(&httpcache.Entry{
+			Key: "http://example.com" + path,
+			Responses: []*httpcache.Response{{
+				Status:       http.StatusOK,
+				Header:       http.Header{"Surrogate-Key": {strings.TrimPrefix(path, "/")}},
+				RequestTime:  time.Now(),
+				ResponseTime: time.Now(),
+			}},
+		})
+	}
+	server := httptest.NewServer(admin.NewHandler([]service.CachedRoute{{Host: "example.com", Route: "/", Cache: cache}}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	for _, args := range [][]string{
+		{"-key", "http://example.com/a.js"},
+		{"-tag", "b.js", "-host", "example.com"},
+		{"-prefix", "http://example.com/", "-route", "/"},
+	} {
+		if err := purge(append([]string{"-admin", address}, args...)); err != nil {
+			t.Errorf("purge %v: %v", args, err)
+		}
+	}
+	if keys := cache.Keys(); len(keys) != 0 {
+		t.Errorf("keys left: %v", keys)
+	}
+
+	// The error of the admin API is reported.
+	err := purge([]string{"-admin", address, "-key", "k", "-tag", "t"})
+	if err == nil || !strings.Contains(err.Error(), "exactly one") {
+		t.Errorf("purge with two selectors: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Policy is the limit applied to a key.
+type Policy struct {
+	Requests int
+	Window   time.Duration
+
+	// Capacity of the token bucket.
+	Burst int
+
+	// Let every request of the key through.
+	Unlimited bool
+}
+
+// idle returns how long a key must stay unused before its state is back to
+// the one of a new key, and can be forgotten.
+func (p Policy) idle() time.Duration {
+	refill := time.Duration(float64(p.Burst) / float64(p.Requests) * float64(p.Window))
+	return max(2*p.Window, refill)
+}
+
+// Decision is the outcome of a request against its limit.
+type Decision struct {
+	Allowed bool
+	Policy  Policy
+
+	// Limit is the number of requests a client can send at once and
+	// Remaining the number it can still send.
+	Limit     int
+	Remaining int
+
+	// Time until the limit is fully restored, and for rejected requests the
+	// time until the next one can be accepted.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// state is what a limiter remembers about a key.
+type state struct {
+	key      string
+	lastSeen time.Time
+
+	// How long the key can stay unused before being forgotten.
+	idle time.Duration
+
+	// Token bucket.
+	tokens  float64
+	updated time.Time
+
+	// Sliding window, the number of requests accepted during the current
+	// window and the previous one.
+	windowStart time.Time
+	previous    int
+	current     int
+}
+
+// tokenBucket refills Requests tokens every Window up to Burst, each request
+// takes one.
+func tokenBucket(s *state, policy Policy, now time.Time, fresh bool) Decision {
+	rate := float64(policy.Requests) / policy.Window.Seconds()
+	capacity := float64(policy.Burst)
+
+	if fresh {
+		s.tokens = capacity
+	} else {
+		s.tokens = min(capacity, s.tokens+now.Sub(s.updated).Seconds()*rate)
+	}
+	s.updated = now
+
+	decision := Decision{Policy: policy, Limit: policy.Burst}
+	if s.tokens >= 1 {
+		s.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - s.tokens) / rate)
+	}
+
+	decision.Remaining = int(s.tokens)
+	decision.Reset = seconds((capacity - s.tokens) / rate)
+	return decision
+}
+
+// slidingWindow counts the requests of the current fixed window, plus those
+// of the previous window weighted by how much of it still overlaps the
+// sliding window ending now.
+func slidingWindow(s *state, policy Policy, now time.Time, fresh bool) Decision {
+	start := now.Truncate(policy.Window)
+	switch {
+	case fresh || !start.Before(s.windowStart.Add(2*policy.Window)):
+		s.previous, s.current = 0, 0
+	case start.After(s.windowStart):
+		s.previous, s.current = s.current, 0
+	}
+	s.windowStart = start
+
+	elapsed := now.Sub(start)
+	overlap := 1 - elapsed.Seconds()/policy.Window.Seconds()
+	estimate := float64(s.previous)*overlap + float64(s.current)
+
+	decision := Decision{Policy: policy, Limit: policy.Requests}
+	if estimate+1 <= float64(policy.Requests) {
+		s.current++
+		estimate++
+		decision.Allowed = true
+	} else {
+		// The estimate decreases as the previous window slides out, the
+		// request is accepted once it falls below the limit or when the
+		// next window starts.
+		decision.RetryAfter = policy.Window - elapsed
+		if s.previous > 0 {
+			excess := estimate + 1 - float64(policy.Requests)
+			wait := seconds(excess / float64(s.previous) * policy.Window.Seconds())
+			decision.RetryAfter = min(decision.RetryAfter, wait)
+		}
+	}
+
+	decision.Remaining = max(0, policy.Requests-int(math.Ceil(estimate)))
+	decision.Reset = policy.Window - elapsed
+	return decision
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
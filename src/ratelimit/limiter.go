@@ -0,0 +1,206 @@
+// Package ratelimit limits the rate of requests of the clients of a route
+// with a token bucket or a sliding window.
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	"roxy/src/metrics"
+	"roxy/src/watch"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter applies a policy to every key, a client address, header value or
+// token claim. Keys unused for long enough to be back to their initial
+// state are forgotten, and at most MaxKeys keys are tracked, the least
+// recently seen ones being dropped first.
+type Limiter struct {
+	policy    Policy
+	algorithm func(*state, Policy, time.Time, bool) Decision
+
+	// Kind of key, "ip", "route", "header" or "jwt", and the name of the
+	// header or claim.
+	kind string
+	name string
+
+	MaxKeys int
+
+	// Called with the errors of the overrides file, the previous overrides
+	// stay in force until it is fixed.
+	ErrorLog func(error)
+
+	// Read again when the file changes, a file that can't be read keeps the
+	// previous policies in force.
+	overrides *watch.File[overrides]
+
+	mu     sync.Mutex
+	states map[string]*list.Element
+	// Most recently seen keys at the front.
+	lru *list.List
+
+	Limited *metrics.Counter
+}
+
+// New creates the limiter described by options and loads its overrides
+// file.
+func New(options *config.RateLimit, labels metrics.Labels) (*Limiter, error) {
+	limiter := &Limiter{
+		policy: Policy{
+			Requests: options.Requests,
+			Window:   time.Duration(options.Window) * time.Second,
+			Burst:    options.Burst,
+		},
+		algorithm: tokenBucket,
+		MaxKeys:   options.MaxKeys,
+		states:    make(map[string]*list.Element),
+		lru:       list.New(),
+		Limited:   metrics.Default.Counter("roxy_rate_limited_total", "Requests rejected by a rate limit.", labels),
+	}
+	if options.Algorithm == "sliding_window" {
+		limiter.algorithm = slidingWindow
+	}
+
+	limiter.kind, limiter.name, _ = strings.Cut(options.Key, ":")
+
+	if options.Overrides != "" {
+		overrides, err := watch.NewFile(options.Overrides, parseOverrides(limiter.policy, limiter.kind))
+		if err != nil {
+			return nil, fmt.Errorf("rate limit overrides: %w", err)
+		}
+		limiter.overrides = overrides
+	}
+
+	metrics.Default.GaugeFunc("roxy_rate_limit_keys", "Keys tracked by a rate limit.", labels, func() float64 {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return float64(len(limiter.states))
+	})
+
+	return limiter, nil
+}
+
+// Allow counts r against the limit of its client, identified by clientIP
+// unless the limiter is keyed by a header present in r or a claim of its
+// verified token.
+func (l *Limiter) Allow(r *http.Request, clientIP string) Decision {
+	kind, value := l.key(r, clientIP)
+	return l.allow(kind, value, time.Now())
+}
+
+func (l *Limiter) allow(kind, value string, now time.Time) Decision {
+	policy := l.policy
+	if l.overrides != nil {
+		overrides, err := l.overrides.Get(now)
+		if err != nil && l.ErrorLog != nil {
+			l.ErrorLog(fmt.Errorf("overrides: %w", err))
+		}
+		if override, ok := overrides[kind+":"+value]; ok {
+			policy = override
+		}
+	}
+	if policy.Unlimited {
+		return Decision{Allowed: true, Policy: policy}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.evictIdle(now)
+
+	// The kind is part of the key so that a header value can't pass for the
+	// address of another client.
+	key := kind + ":" + value
+	element, ok := l.states[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		element = l.lru.PushFront(&state{key: key})
+		l.states[key] = element
+		for len(l.states) > l.MaxKeys {
+			l.remove(l.lru.Back())
+		}
+	}
+
+	s := element.Value.(*state)
+	decision := l.algorithm(s, policy, now, !ok)
+	s.lastSeen = now
+	s.idle = policy.idle()
+
+	if !decision.Allowed {
+		l.Limited.Inc()
+	}
+	return decision
+}
+
+// evictIdle forgets the least recently seen keys that have been idle long
+// enough to be back to their initial state.
+func (l *Limiter) evictIdle(now time.Time) {
+	for element := l.lru.Back(); element != nil; element = l.lru.Back() {
+		if s := element.Value.(*state); now.Sub(s.lastSeen) < s.idle {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+func (l *Limiter) remove(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.states, element.Value.(*state).key)
+}
+
+// key returns the kind of key identifying the client of r and its value.
+func (l *Limiter) key(r *http.Request, clientIP string) (string, string) {
+	switch l.kind {
+	case "route":
+		return "route", ""
+	case "header":
+		if value := r.Header.Get(l.name); value != "" {
+			return "header", value
+		}
+	case "jwt":
+		if value, ok := jwt.Claim(r.Context(), l.name); ok {
+			return "jwt", value
+		}
+	}
+	return "ip", clientIP
+}
+
+// ByClaim tells whether the limiter is keyed by a claim of the token that
+// the JWT check of the route verifies, which must run before Allow.
+func (l *Limiter) ByClaim() bool {
+	return l.kind == "jwt"
+}
+
+// SetHeaders adds the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset
+// and RateLimit-Policy headers describing decision, and Retry-After when
+// the request was rejected.
+func (decision Decision) SetHeaders(header http.Header) {
+	if decision.Policy.Unlimited {
+		return
+	}
+
+	header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+	policy := fmt.Sprintf("%d;w=%d", decision.Policy.Requests, ceilSeconds(decision.Policy.Window))
+	if decision.Policy.Burst != decision.Policy.Requests {
+		policy += fmt.Sprintf(";burst=%d", decision.Policy.Burst)
+	}
+	header.Set("RateLimit-Policy", policy)
+
+	if !decision.Allowed {
+		header.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(decision.RetryAfter))))
+	}
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
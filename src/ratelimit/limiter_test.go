@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	"roxy/src/metrics"
+	"testing"
+	"time"
+)
+
+func newLimiter(t *testing.T, options config.RateLimit) *Limiter {
+	if options.Key == "" {
+		options.Key = "ip"
+	}
+	if options.MaxKeys == 0 {
+		options.MaxKeys = 100
+	}
+	if options.Burst == 0 {
+		options.Burst = options.Requests
+	}
+	limiter, err := New(&options, metrics.Labels{"test": t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limiter
+}
+
+func TestTokenBucket(t *testing.T) {
+	limiter := newLimiter(t, config.RateLimit{Requests: 2, Window: 1, Burst: 3})
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if decision := limiter.allow("ip", "10.0.0.1", now); !decision.Allowed || decision.Remaining != 2-i {
+			t.Fatalf("request %d: %+v", i, decision)
+		}
+	}
+
+	decision := limiter.allow("ip", "10.0.0.1", now)
+	if decision.Allowed || decision.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("request over the burst: %+v", decision)
+	}
+	if !limiter.allow("ip", "10.0.0.2", now).Allowed {
+		t.Fatalf("other clients are limited too")
+	}
+
+	// Two tokens per second.
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.allow("ip", "10.0.0.1", now).Allowed || limiter.allow("ip", "10.0.0.1", now).Allowed {
+		t.Fatalf("the bucket didn't refill one token")
+	}
+
+	header := http.Header{}
+	decision.SetHeaders(header)
+	for name, want := range map[string]string{
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "2",
+		"RateLimit-Policy":    "2;w=1;burst=3",
+		"Retry-After":         "1",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	limiter := newLimiter(t, config.RateLimit{Algorithm: "sliding_window", Requests: 4, Window: 10})
+	start := time.Unix(1000, 0)
+
+	for i := 0; i < 4; i++ {
+		if !limiter.allow("ip", "10.0.0.1", start.Add(time.Duration(i)*time.Second)).Allowed {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	if limiter.allow("ip", "10.0.0.1", start.Add(5*time.Second)).Allowed {
+		t.Fatalf("fifth request accepted")
+	}
+
+	// A quarter of the next window, three quarters of the 4 previous requests
+	// still count.
+	if !limiter.allow("ip", "10.0.0.1", start.Add(12500*time.Millisecond)).Allowed {
+		t.Fatalf("request rejected once the window slid")
+	}
+	decision := limiter.allow("ip", "10.0.0.1", start.Add(12500*time.Millisecond))
+	if decision.Allowed || decision.RetryAfter != 2500*time.Millisecond {
+		t.Fatalf("request over the estimate: %+v", decision)
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	limiter := newLimiter(t, config.RateLimit{Requests: 1, Window: 60, MaxKeys: 2})
+	now := time.Unix(1000, 0)
+
+	limiter.allow("ip", "10.0.0.1", now)
+	limiter.allow("ip", "10.0.0.2", now)
+	limiter.allow("ip", "10.0.0.3", now)
+	if len(limiter.states) != 2 {
+		t.Fatalf("%d keys tracked, want 2", len(limiter.states))
+	}
+	if !limiter.allow("ip", "10.0.0.1", now).Allowed {
+		t.Errorf("the least recently seen key wasn't forgotten")
+	}
+
+	// Keys are back to their initial state after two windows.
+	limiter.allow("ip", "10.0.0.4", now.Add(2*time.Minute))
+	if len(limiter.states) != 1 {
+		t.Errorf("%d keys tracked after they were idle, want 1", len(limiter.states))
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	overrides := filepath.Join(t.TempDir(), "limits.toml")
+	content := "[keys.partner]\nrequests = 100\n\n[keys.\"10.0.0.9\"]\nunlimited = true\n"
+	if err := os.WriteFile(overrides, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	limiter := newLimiter(t, config.RateLimit{Requests: 1, Window: 60, Key: "jwt:sub", Overrides: overrides})
+
+	// Claims only count once the JWT check verified them.
+	request := func(sub string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer e30."+base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"forged"}`))+".c2ln")
+		if sub != "" {
+			r = r.WithContext(jwt.NewContext(r.Context(), map[string]any{"sub": sub}))
+		}
+		return r
+	}
+
+	if kind, value := limiter.key(request("alice"), "10.0.0.1"); kind != "jwt" || value != "alice" {
+		t.Errorf("key = %s, %s", kind, value)
+	}
+	if kind, value := limiter.key(request(""), "10.0.0.1"); kind != "ip" || value != "10.0.0.1" {
+		t.Errorf("key of an unverified token = %s, %s", kind, value)
+	}
+
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow(request("partner"), "10.0.0.1").Allowed {
+			t.Fatalf("partner request %d rejected", i)
+		}
+		if !limiter.Allow(request(""), "10.0.0.9").Allowed {
+			t.Fatalf("unlimited client request %d rejected", i)
+		}
+	}
+	limiter.Allow(request("alice"), "10.0.0.1")
+	if limiter.Allow(request("alice"), "10.0.0.1").Allowed {
+		t.Errorf("overrides apply to other keys")
+	}
+
+	// The override of an address doesn't apply to a header value equal to it.
+	limiter = newLimiter(t, config.RateLimit{Requests: 1, Window: 60, Key: "header:X-API-Key", Overrides: overrides})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", "10.0.0.9")
+	limiter.Allow(r, "10.0.0.1")
+	if limiter.Allow(r, "10.0.0.1").Allowed {
+		t.Errorf("a header value took the override of an address")
+	}
+	r.Header.Set("X-API-Key", "partner")
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow(r, "10.0.0.1").Allowed {
+			t.Fatalf("partner request %d rejected", i)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// overrides are per-key policies read from a TOML file such as:
+//
+//	[keys."api-key-of-a-partner"]
+//	requests = 1000
+//	window = 60
+//
+//	[keys."10.0.0.5"]
+//	unlimited = true
+//
+// Keys that are IP addresses apply to clients identified by their address,
+// the others to the header values or claims the limiter is keyed by. Missing
+// fields keep the value of the route. Policies are indexed by the kind of key
+// and the key, like the states of the limiter, so that a header value can't
+// take the policy of an address.
+type overrides map[string]Policy
+
+type overridesFile struct {
+	Keys map[string]struct {
+		Requests  int  `toml:"requests"`
+		Window    int  `toml:"window"`
+		Burst     int  `toml:"burst"`
+		Unlimited bool `toml:"unlimited"`
+	} `toml:"keys"`
+}
+
+// parseOverrides returns a parser of overrides files whose policies derive
+// from base, for a limiter keyed by kind.
+func parseOverrides(base Policy, kind string) func([]byte) (overrides, error) {
+	return func(data []byte) (overrides, error) {
+		var file overridesFile
+		if _, err := toml.Decode(string(data), &file); err != nil {
+			return nil, err
+		}
+
+		policies := make(overrides, len(file.Keys))
+		for key, override := range file.Keys {
+			policy := base
+			policy.Unlimited = override.Unlimited
+			if override.Requests > 0 {
+				policy.Requests = override.Requests
+				// The burst follows the number of requests unless it is set.
+				if base.Burst == base.Requests {
+					policy.Burst = override.Requests
+				}
+			}
+			if override.Window > 0 {
+				policy.Window = time.Duration(override.Window) * time.Second
+			}
+			if override.Burst > 0 {
+				policy.Burst = override.Burst
+			}
+			if override.Requests < 0 || override.Window < 0 || override.Burst < 0 {
+				return nil, fmt.Errorf("negative limit for key %q", key)
+			}
+			if _, err := netip.ParseAddr(key); err == nil {
+				policies["ip:"+key] = policy
+			} else {
+				policies[kind+":"+key] = policy
+			}
+		}
+		return policies, nil
+	}
+}
@@ -0,0 +1,106 @@
+package router
+
+// node is a vertex of a compressed prefix tree keyed by literal request
+// paths. Routes are stored at the node where their literal path ends.
+type node struct {
+	// Edge label leading to this node from its parent.
+	prefix string
+
+	children []*node
+
+	// Routes matching any path that starts with the key of this node.
+	prefixRoutes []*Route
+
+	// Routes matching only the exact key of this node.
+	exactRoutes []*Route
+}
+
+// insert stores route under key. When exact is true the route only matches
+// requests whose path is equal to key.
+func (n *node) insert(key string, route *Route, exact bool) {
+	current := n
+
+	for {
+		if key == "" {
+			if exact {
+				current.exactRoutes = append(current.exactRoutes, route)
+			} else {
+				current.prefixRoutes = append(current.prefixRoutes, route)
+			}
+			return
+		}
+
+		child := current.child(key[0])
+		if child == nil {
+			child = &node{prefix: key}
+			current.children = append(current.children, child)
+			current = child
+			key = ""
+			continue
+		}
+
+		common := commonPrefix(key, child.prefix)
+		if common < len(child.prefix) {
+			// Split the edge so that the shared part becomes its own node.
+			split := &node{
+				prefix:   child.prefix[:common],
+				children: []*node{child},
+			}
+			child.prefix = child.prefix[common:]
+			current.replaceChild(child, split)
+			child = split
+		}
+
+		current = child
+		key = key[common:]
+	}
+}
+
+// walk visits every route whose key is a prefix of path, from the shortest
+// key to the longest. Exact routes are only visited when their key is equal
+// to path.
+func (n *node) walk(path string, visit func(routes []*Route)) {
+	current := n
+
+	for {
+		visit(current.prefixRoutes)
+		if path == "" {
+			visit(current.exactRoutes)
+			return
+		}
+
+		child := current.child(path[0])
+		if child == nil || len(path) < len(child.prefix) || path[:len(child.prefix)] != child.prefix {
+			return
+		}
+
+		current = child
+		path = path[len(child.prefix):]
+	}
+}
+
+func (n *node) child(label byte) *node {
+	for _, child := range n.children {
+		if child.prefix[0] == label {
+			return child
+		}
+	}
+	return nil
+}
+
+func (n *node) replaceChild(old, new *node) {
+	for i, child := range n.children {
+		if child == old {
+			n.children[i] = new
+			return
+		}
+	}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
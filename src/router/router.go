@@ -0,0 +1,174 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"roxy/src/config"
+	"strings"
+)
+
+// Route is a compiled [[match]] pattern.
+type Route struct {
+	// Pattern this route was compiled from.
+	Pattern *config.Pattern
+
+	// Position of the pattern in the configuration file.
+	Index int
+
+	// Length of the literal path matched by this route, used to prefer the
+	// longest match when priorities are equal.
+	specificity int
+
+	methods map[string]bool
+}
+
+// Router selects the pattern that handles a request. Literal paths are
+// stored in a radix tree so that lookups only depend on the length of the
+// request path, regex paths are evaluated after that.
+type Router struct {
+	root  *node
+	regex []*Route
+}
+
+// New compiles patterns into a Router. Patterns must have been resolved by
+// the config package, which compiles their regular expressions.
+func New(patterns []config.Pattern) *Router {
+	router := &Router{root: &node{}}
+
+	for index := range patterns {
+		pattern := &patterns[index]
+		route := &Route{Pattern: pattern, Index: index}
+
+		if len(pattern.Methods) > 0 {
+			route.methods = make(map[string]bool)
+			for _, method := range pattern.Methods {
+				route.methods[strings.ToUpper(method)] = true
+			}
+		}
+
+		switch {
+		case pattern.CompiledPathRegex != nil:
+			prefix, _ := pattern.CompiledPathRegex.LiteralPrefix()
+			route.specificity = len(prefix)
+			router.regex = append(router.regex, route)
+		case pattern.Path != "":
+			// An exact path is more specific than a prefix of the same length.
+			route.specificity = len(pattern.Path) + 1
+			router.root.insert(pattern.Path, route, true)
+		default:
+			route.specificity = len(pattern.URI)
+			router.root.insert(pattern.URI, route, false)
+		}
+	}
+
+	return router
+}
+
+// Match returns the route that should handle r or nil if none matches.
+func (router *Router) Match(r *http.Request) *Route {
+	var best *Route
+
+	consider := func(route *Route) {
+		if !route.matches(r) {
+			return
+		}
+		if best == nil || route.beats(best) {
+			best = route
+		}
+	}
+
+	path := r.URL.Path
+	router.root.walk(path, func(routes []*Route) {
+		for _, route := range routes {
+			consider(route)
+		}
+	})
+
+	for _, route := range router.regex {
+		if route.Pattern.CompiledPathRegex.MatchString(path) {
+			consider(route)
+		}
+	}
+
+	return best
+}
+
+// beats reports whether route should be preferred over other.
+func (route *Route) beats(other *Route) bool {
+	if route.Pattern.Priority != other.Pattern.Priority {
+		return route.Pattern.Priority > other.Pattern.Priority
+	}
+	if route.specificity != other.specificity {
+		return route.specificity > other.specificity
+	}
+	return route.Index < other.Index
+}
+
+// matches checks every non-path matcher of the route against r.
+func (route *Route) matches(r *http.Request) bool {
+	pattern := route.Pattern
+
+	method := r.Method
+	// Preflight requests ask about the method of the request to come.
+	if pattern.CORS != nil && method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	if route.methods != nil && !route.methods[method] {
+		return false
+	}
+
+	if len(pattern.Hosts) > 0 && !MatchHost(pattern.Hosts, r.Host) {
+		return false
+	}
+
+	for name, value := range pattern.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !contains(values, value)) {
+			return false
+		}
+	}
+
+	if len(pattern.Query) > 0 {
+		query := r.URL.Query()
+		for name, value := range pattern.Query {
+			values, ok := query[name]
+			if !ok || (value != "" && !contains(values, value)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// MatchHost checks host against exact names and "*." wildcards. Wildcards
+// match any number of labels in front of the domain. A port in host is
+// ignored.
+func MatchHost(hosts []string, host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, candidate := range hosts {
+		candidate = strings.ToLower(candidate)
+		if suffix, ok := strings.CutPrefix(candidate, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == candidate {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
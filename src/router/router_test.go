@@ -0,0 +1,72 @@
+package router
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"roxy/src/config"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	patterns := []config.Pattern{
+		{URI: "/"},
+		{URI: "/api"},
+		{URI: "/api/v1"},
+		{Path: "/api/v1/health"},
+		{URI: "/api", Methods: []string{"post"}, Priority: 10},
+		{URI: "/", Hosts: []string{"*.example.com"}, Priority: 5},
+		{URI: "/", Headers: map[string]string{"X-Canary": ""}, Priority: 20},
+		{URI: "/", Query: map[string]string{"debug": "1"}, Priority: 30},
+		{PathRegex: "^/files/[0-9]+$", CompiledPathRegex: regexp.MustCompile("^/files/[0-9]+$")},
+	}
+
+	router := New(patterns)
+
+	tests := []struct {
+		method  string
+		target  string
+		host    string
+		header  string
+		wantIdx int
+	}{
+		{"GET", "/index.html", "roxy.dev", "", 0},
+		{"GET", "/api/users", "roxy.dev", "", 1},
+		{"GET", "/api/v1/users", "roxy.dev", "", 2},
+		{"GET", "/api/v1/health", "roxy.dev", "", 3},
+		{"GET", "/api/v1/health/deep", "roxy.dev", "", 2},
+		{"POST", "/api/users", "roxy.dev", "", 4},
+		{"GET", "/api/users", "www.example.com:8100", "", 5},
+		{"GET", "/api/users", "example.com", "", 1},
+		{"GET", "/api/users", "roxy.dev", "X-Canary", 6},
+		{"GET", "/api/users?debug=1", "roxy.dev", "X-Canary", 7},
+		{"GET", "/files/12", "roxy.dev", "", 8},
+		{"GET", "/files/abc", "roxy.dev", "", 0},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Host = test.host
+		if test.header != "" {
+			req.Header.Set(test.header, "yes")
+		}
+
+		route := router.Match(req)
+		if route == nil {
+			t.Errorf("Match(%s %s) = nil, want %d", test.method, test.target, test.wantIdx)
+			continue
+		}
+		if route.Index != test.wantIdx {
+			t.Errorf("Match(%s %s %s) = %d, want %d", test.method, test.host, test.target, route.Index, test.wantIdx)
+		}
+	}
+}
+
+func TestMatchNone(t *testing.T) {
+	router := New([]config.Pattern{{URI: "/api"}, {Path: "/health"}})
+
+	for _, target := range []string{"/", "/ap", "/health/x"} {
+		if route := router.Match(httptest.NewRequest("GET", target, nil)); route != nil {
+			t.Errorf("Match(%s) = %d, want nil", target, route.Index)
+		}
+	}
+}
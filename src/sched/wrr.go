@@ -28,7 +28,7 @@ func NewWeightedRoundRobin(backends []config.Backend) *WeightedRoundRobin {
 		weight := backend.Weight
 		addrs, err := net.ResolveTCPAddr("tcp", backend.Address)
 		if err != nil {
-			fmt.Errorf("Error resolving address: %v | NewWeightedRoundRobin fn", err)
+			fmt.Printf("Error resolving address: %v | NewWeightedRoundRobin fn\n", err)
 		}
 		for weight > 0 {
 			cycle = append(cycle, addrs)
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// connQueue is a [`net.Listener`] fed by [`Listener.Listen`]. The accept loop
+// decides which connections are allowed in and hands them to the HTTP server
+// through this queue.
+type connQueue struct {
+	conns  chan net.Conn
+	addr   net.Addr
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		conns:  make(chan net.Conn),
+		addr:   addr,
+		closed: make(chan struct{}),
+	}
+}
+
+// push hands conn to the HTTP server. It returns false if the queue has
+// been closed, in which case the caller still owns conn.
+func (q *connQueue) push(conn net.Conn) bool {
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *connQueue) Close() error {
+	q.once.Do(func() { close(q.closed) })
+	return nil
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// trackedConn signals done once the HTTP server closes the connection.
+type trackedConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	return &trackedConn{Conn: conn, done: make(chan struct{})}
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
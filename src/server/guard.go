@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"sync"
+	"time"
+)
+
+// How often the transfer rates of a connection are checked.
+const guardCheckInterval = 500 * time.Millisecond
+
+// Extra bytes read by the HTTP server beyond max_header_bytes before it
+// rejects the request, see [`http.Server.MaxHeaderBytes`].
+const headerBytesSlack = 4096
+
+// What the server expects from the client of a guarded connection.
+const (
+	// The headers of a request, or of the next one on keep-alive
+	// connections.
+	phaseHeader = iota
+	// The body of the request being handled.
+	phaseBody
+	// Nothing, the request is being handled.
+	phaseHandling
+)
+
+// guard enforces the [`config.ConnectionLimits`] of a listener on the
+// connections it accepts and the requests they carry.
+type guard struct {
+	limits  *config.ConnectionLimits
+	grace   time.Duration
+	logName string
+}
+
+func newGuard(limits *config.ConnectionLimits, logName string) *guard {
+	return &guard{
+		limits:  limits,
+		grace:   time.Duration(limits.GracePeriod) * time.Second,
+		logName: logName,
+	}
+}
+
+// wrap returns conn measuring what it receives from the client.
+func (g *guard) wrap(conn net.Conn) *guardedConn {
+	c := &guardedConn{Conn: conn, guard: g, phase: phaseHeader, start: time.Now()}
+	if g.limits.MinHeaderRate > 0 || g.limits.MinBodyRate > 0 {
+		c.timer = time.AfterFunc(guardCheckInterval, c.check)
+	}
+	return c
+}
+
+type guardedConnKey struct{}
+
+// connContext makes the guarded connection under c available to the
+// handler, see [`http.Server.ConnContext`].
+func (g *guard) connContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if tracked, ok := c.(*trackedConn); ok {
+		c = tracked.Conn
+	}
+	if guarded, ok := c.(*guardedConn); ok {
+		return context.WithValue(ctx, guardedConnKey{}, guarded)
+	}
+	return ctx
+}
+
+// handler rejects requests with too many header fields and tells the
+// connection of the other requests when their body is being read.
+func (g *guard) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, values := range r.Header {
+			count += len(values)
+		}
+		if count > g.limits.MaxHeaderCount {
+			fmt.Printf("%s => Closing connection from %s, %d header fields\n", g.logName, r.RemoteAddr, count)
+			resp := new(local_http.LocalResponse).Error(http.StatusRequestHeaderFieldsTooLarge)
+			for name, values := range resp.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+
+		conn, ok := r.Context().Value(guardedConnKey{}).(*guardedConn)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			conn.enter(phaseBody)
+			r.Body = &guardedBody{ReadCloser: r.Body, conn: conn}
+		} else {
+			conn.enter(phaseHandling)
+		}
+		defer conn.enter(phaseHeader)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guardedConn closes the connection of clients sending headers or bodies
+// slower than the minimum rates once the grace period is over. The rate of
+// headers is measured from the end of the previous request, the one of
+// bodies only while the handler is reading them, so that slow backends
+// don't count against clients.
+type guardedConn struct {
+	net.Conn
+	guard *guard
+
+	mu    sync.Mutex
+	phase int
+	start time.Time
+	// Bytes received during the phase.
+	bytes int64
+	// Time spent by the handler waiting for the body, besides the read in
+	// progress started at reading.
+	waited  time.Duration
+	reading time.Time
+	// Whether the headers exceeding max_header_bytes were logged.
+	oversized bool
+
+	timer  *time.Timer
+	closed bool
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	if c.phase == phaseHeader {
+		c.bytes += int64(n)
+		if !c.oversized && c.bytes > int64(c.guard.limits.MaxHeaderBytes+headerBytesSlack) {
+			// The HTTP server answers with 431 and closes the connection.
+			c.oversized = true
+			fmt.Printf("%s => Closing connection from %s, headers larger than %d bytes\n", c.guard.logName, c.RemoteAddr(), c.guard.limits.MaxHeaderBytes)
+		}
+	}
+	c.mu.Unlock()
+
+	return n, err
+}
+
+func (c *guardedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// enter starts phase, the rate of the previous one is no longer checked.
+func (c *guardedConn) enter(phase int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.phase = phase
+	c.start = time.Now()
+	c.bytes = 0
+	c.waited = 0
+	c.reading = time.Time{}
+}
+
+// check closes the connection if the client is too slow, and schedules the
+// next check otherwise.
+func (c *guardedConn) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	now := time.Now()
+	var waited time.Duration
+	var rate int
+	var received string
+	switch c.phase {
+	case phaseHeader:
+		waited, rate, received = now.Sub(c.start), c.guard.limits.MinHeaderRate, "headers"
+	case phaseBody:
+		waited, rate, received = c.waited, c.guard.limits.MinBodyRate, "body"
+		if !c.reading.IsZero() {
+			waited += now.Sub(c.reading)
+		}
+	}
+
+	if rate > 0 && waited > c.guard.grace+time.Duration(float64(c.bytes)/float64(rate)*float64(time.Second)) {
+		if c.phase == phaseHeader && c.bytes == 0 {
+			fmt.Printf("%s => Closing connection from %s, no request within %v\n", c.guard.logName, c.RemoteAddr(), c.guard.grace)
+		} else {
+			fmt.Printf("%s => Closing connection from %s, %s received at less than %d bytes/s\n", c.guard.logName, c.RemoteAddr(), received, rate)
+		}
+		c.closed = true
+		c.Conn.Close()
+		return
+	}
+
+	c.timer.Reset(guardCheckInterval)
+}
+
+// guardedBody measures the time the handler waits for the request body.
+type guardedBody struct {
+	io.ReadCloser
+	conn *guardedConn
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	c := b.conn
+
+	c.mu.Lock()
+	if c.phase == phaseBody {
+		c.reading = time.Now()
+	}
+	c.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+
+	c.mu.Lock()
+	if c.phase == phaseBody {
+		c.waited += time.Since(c.reading)
+		c.reading = time.Time{}
+		c.bytes += int64(n)
+		if err != nil {
+			c.phase = phaseHandling
+		}
+	}
+	c.mu.Unlock()
+
+	return n, err
+}
+
+// clientConns counts the connections of every client address, trusted
+// proxies excepted.
+type clientConns struct {
+	max     int
+	trusted []*net.IPNet
+
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func newClientConns(max int, trusted []*net.IPNet) *clientConns {
+	return &clientConns{max: max, trusted: trusted, count: make(map[string]int)}
+}
+
+// acquire counts a new connection from addr, it returns false if the client
+// already holds as many as allowed.
+func (c *clientConns) acquire(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if c.max == 0 || c.isTrusted(ip) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.count[ip.String()] >= c.max {
+		return false
+	}
+	c.count[ip.String()]++
+	return true
+}
+
+// release forgets a connection counted by acquire.
+func (c *clientConns) release(addr net.Addr) {
+	ip := remoteIP(addr)
+	if c.max == 0 || c.isTrusted(ip) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.count[ip.String()]--; c.count[ip.String()] <= 0 {
+		delete(c.count, ip.String())
+	}
+}
+
+func (c *clientConns) isTrusted(ip net.IP) bool {
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+type guardedListener struct {
+	net.Listener
+	guard *guard
+}
+
+func (l guardedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.guard.wrap(conn), nil
+}
+
+// serveGuarded serves handler behind a guard with a short grace period and
+// returns the address to connect to.
+func serveGuarded(t *testing.T, limits config.ConnectionLimits, handler http.Handler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGuard(&limits, "test")
+	g.grace = 200 * time.Millisecond
+
+	server := &http.Server{Handler: g.handler(handler), MaxHeaderBytes: limits.MaxHeaderBytes, ConnContext: g.connContext}
+	go server.Serve(guardedListener{Listener: ln, guard: g})
+	t.Cleanup(func() { server.Close() })
+
+	return ln.Addr().String()
+}
+
+// closedWithin reports whether the server closes conn before timeout.
+func closedWithin(conn net.Conn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.ReadAll(conn)
+	return err == nil
+}
+
+func TestGuardClosesSlowClients(t *testing.T) {
+	limits := config.ConnectionLimits{MinHeaderRate: 1000, MinBodyRate: 1000, MaxHeaderBytes: 1 << 20, MaxHeaderCount: 100}
+	addr := serveGuarded(t, limits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// Waiting for a backend doesn't count against the client.
+			time.Sleep(1500 * time.Millisecond)
+		}
+		io.ReadAll(r.Body)
+	}))
+
+	conn, _ := net.Dial("tcp", addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\n")
+	if !closedWithin(conn, 2*time.Second) {
+		t.Error("connection with slow headers is still open")
+	}
+
+	conn, _ = net.Dial("tcp", addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 100\r\n\r\npartial")
+	if !closedWithin(conn, 2*time.Second) {
+		t.Error("connection with slow body is still open")
+	}
+
+	conn, _ = net.Dial("tcp", addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /slow HTTP/1.1\r\nHost: a\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("request to a slow handler: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestGuardRejectsTooManyHeaders(t *testing.T) {
+	limits := config.ConnectionLimits{MaxHeaderBytes: 1 << 20, MaxHeaderCount: 5}
+	// The transport adds User-Agent and Accept-Encoding.
+	addr := serveGuarded(t, limits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for count, want := range map[int]int{2: http.StatusOK, 8: http.StatusRequestHeaderFieldsTooLarge} {
+		request, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+		for i := range count {
+			request.Header.Set(fmt.Sprintf("X-Header-%d", i), "value")
+		}
+		resp, err := http.DefaultTransport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%d headers: status = %d, want %d", count, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestClientConns(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	clients := newClientConns(2, []*net.IPNet{proxy})
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	if !clients.acquire(client) || !clients.acquire(client) {
+		t.Fatal("connections under the limit refused")
+	}
+	if clients.acquire(client) {
+		t.Error("third connection accepted")
+	}
+	if !clients.acquire(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}) {
+		t.Error("connection from another client refused")
+	}
+
+	clients.release(client)
+	if !clients.acquire(client) {
+		t.Error("connection refused after a release")
+	}
+
+	for range 5 {
+		if !clients.acquire(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+			t.Fatal("connection from a trusted proxy refused")
+		}
+	}
+	if strings.Contains(fmt.Sprint(clients.count), "10.1.2.3") {
+		t.Error("trusted proxy counted")
+	}
+}
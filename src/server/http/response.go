@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 // BoxBodyResponse is the common type for all responses.
@@ -63,6 +64,60 @@ func (lr *LocalResponse) BadGateway() *http.Response {
 	}
 }
 
+// Unauthorized generates a 401 Unauthorized response asking for the
+// credentials described by challenges, WWW-Authenticate header values.
+func (lr *LocalResponse) Unauthorized(challenges ...string) *http.Response {
+	resp := lr.Error(http.StatusUnauthorized)
+	for _, challenge := range challenges {
+		resp.Header.Add("WWW-Authenticate", challenge)
+	}
+	return resp
+}
+
+// Forbidden generates a generic HTTP 403 Forbidden response.
+func (lr *LocalResponse) Forbidden() *http.Response {
+	return lr.Error(http.StatusForbidden)
+}
+
+// Error generates a generic response for any error status code.
+func (lr *LocalResponse) Error(status int) *http.Response {
+	headers := lr.Builder()
+	headers.Set("Content-Type", "text/plain")
+	body := fmt.Sprintf("HTTP %d %s", status, strings.ToUpper(http.StatusText(status)))
+	return &http.Response{
+		StatusCode: status,
+		Header:     headers,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+// Redirect generates a redirection to location with the given status code.
+func (lr *LocalResponse) Redirect(status int, location string) *http.Response {
+	headers := lr.Builder()
+	headers.Set("Location", location)
+	headers.Set("Content-Type", "text/plain")
+	body := fmt.Sprintf("HTTP %d %s", status, strings.ToUpper(http.StatusText(status)))
+	return &http.Response{
+		StatusCode: status,
+		Header:     headers,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+// Static generates a response with a fixed status, headers and body.
+func (lr *LocalResponse) Static(status int, header map[string]string, body string) *http.Response {
+	headers := lr.Builder()
+	headers.Set("Content-Type", "text/plain")
+	for name, value := range header {
+		headers.Set(name, value)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     headers,
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
 // roxyServerHeader returns the server header string.
 func roxyServerHeader() string {
 	return fmt.Sprintf("roxy/%s", "0.1.0") // Replace "0.1.0" with the appropriate version variable if available
@@ -3,7 +3,11 @@ package server
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"roxy/src/admin"
 	"roxy/src/config"
+	"roxy/src/metrics"
+	"roxy/src/service"
 	"roxy/src/synchronizer"
 	"sync"
 )
@@ -13,6 +17,10 @@ type Master struct {
 	States         []StateInfo
 	Shutdown       context.Context
 	ShutdownCancel context.CancelFunc
+
+	// Listeners exposing metrics and the admin API, nil when disabled.
+	Metrics *http.Server
+	Admin   *http.Server
 }
 
 type StateInfo struct {
@@ -23,10 +31,18 @@ type StateInfo struct {
 func NewMaster(config *config.Config) (*Master, error) {
 	var servers []*Server
 	var states []StateInfo
-	ctx, cancel := context.WithCancel(context.Background())
 
-	for index, _ := range config.Server.LISTEN {
-		server, err := Init(config, int8(index))
+	// All the listeners share the same hosts, so that load balancing state
+	// is global.
+	vhosts, err := service.NewVirtualHosts(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := vhosts.TLSConfig()
+	clients := newClientConns(config.Server.Limits.MaxConnectionsPerIP, config.Server.TrustedNetworks)
+
+	for index := range config.Server.LISTEN {
+		server, err := Init(config, int8(index), vhosts, tlsConfig, clients)
 		if err != nil {
 			return nil, err
 		}
@@ -35,11 +51,27 @@ func NewMaster(config *config.Config) (*Master, error) {
 		servers = append(servers, server)
 	}
 
+	var metricsServer *http.Server
+	if config.Metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		metricsServer = &http.Server{Addr: config.Metrics.Listen, Handler: mux}
+	}
+
+	var adminServer *http.Server
+	if config.Admin != nil {
+		adminServer = &http.Server{Addr: config.Admin.Listen, Handler: admin.NewHandler(vhosts.ResponseCaches())}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Master{
 		Servers:        servers,
 		States:         states,
 		Shutdown:       ctx,
 		ShutdownCancel: cancel,
+		Metrics:        metricsServer,
+		Admin:          adminServer,
 	}, nil
 }
 
@@ -60,8 +92,44 @@ func (m *Master) Run() error {
 		}(server)
 	}
 
+	if m.Metrics != nil {
+		go func() {
+			fmt.Printf("Master => Metrics available on http://%s/metrics\n", m.Metrics.Addr)
+			if err := m.Metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Master => Metrics listener failed: %v\n", err)
+			}
+		}()
+	}
+
+	if m.Admin != nil {
+		go func() {
+			fmt.Printf("Master => Admin API available on http://%s\n", m.Admin.Addr)
+			if err := m.Admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Master => Admin listener failed: %v\n", err)
+			}
+		}()
+	}
+
 	<-m.Shutdown.Done()
 	fmt.Println("Master => Sending shutdown signal to all servers")
+
+	if m.Metrics != nil {
+		m.Metrics.Close()
+	}
+	if m.Admin != nil {
+		m.Admin.Close()
+	}
+
+	// Our own subscriptions must acknowledge the shutdown as well, otherwise
+	// the servers would wait for them forever.
+	for _, state := range m.States {
+		go func(sub *synchronizer.Subscription) {
+			if _, ok := sub.ReceiveNotification(); ok {
+				sub.AcknowledgeNotification()
+			}
+		}(state.StateSub)
+	}
+
 	for _, server := range m.Servers {
 		server.Shutdown_on()
 	}
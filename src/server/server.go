@@ -1,20 +1,35 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"roxy/src/service"
 	"roxy/src/synchronizer"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/semaphore"
 )
 
 type State int
 
+// Time given to a rejected client to receive its 503 response, and how much
+// of its request is read meanwhile.
+const (
+	shedTimeout    = 5 * time.Second
+	shedDrainBytes = 64 << 10
+)
+
 const (
 	Starting State = iota
 	StateListening
@@ -55,28 +70,52 @@ type Server struct {
 	// shutdown process.
 	Shutdown context.Context
 
+	// Cancels the Shutdown context.
+	ShutdownCancel context.CancelFunc
+
+	// Options of the socket this server listens on.
+	Listen config.Listen
+
+	// Handler of the requests received on accepted connections, usually the
+	// virtual hosts.
+	Handler http.Handler
+
+	// TLS configuration used when Listen.TLS is set.
+	TLSConfig *tls.Config
+
 	// Connections are limited to a maximum number. In order to allow a new
 	// connection we'll have a acquire a permit from the semaphore.
 	Connections *semaphore.Weighted
 
+	// Connections of every client address, shared by the servers of a
+	// master so that max_connections_per_ip holds across listeners.
+	Clients *clientConns
+
 	mutex sync.Mutex
 }
 
-func Init(config *config.Config, replica int8) (*Server, error) {
+// Init creates the server of the listen entry at index replica. clients is
+// shared by the servers of a master.
+func Init(config *config.Config, replica int8, handler http.Handler, tlsConfig *tls.Config, clients *clientConns) (*Server, error) {
 	state := &atomic.Value{}
 	state.Store(StateListening)
 	var ln net.Listener
 	var err error
 
-	resolvedAddrs, err := net.ResolveTCPAddr("tcp", config.Server.LISTEN[replica])
+	listen := config.Server.LISTEN[replica]
+	if listen.TLS && tlsConfig == nil {
+		return nil, fmt.Errorf("%s: TLS listener but no host has a certificate", listen.Address)
+	}
+
+	resolvedAddrs, err := net.ResolveTCPAddr("tcp", listen.Address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve TCP address: %w", err)
 	}
 
 	if resolvedAddrs.IP.To4() != nil {
-		ln, err = net.Listen("tcp4", config.Server.LISTEN[replica])
+		ln, err = net.Listen("tcp4", listen.Address)
 	} else {
-		ln, err = net.Listen("tcp6", config.Server.LISTEN[replica])
+		ln, err = net.Listen("tcp6", listen.Address)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create listener: %w", err)
@@ -84,17 +123,33 @@ func Init(config *config.Config, replica int8) (*Server, error) {
 
 	address := ln.Addr()
 	notifier := synchronizer.NewNotifier()
-	shutdownCtx, _ := context.WithCancel(context.Background())
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
 	connections := semaphore.NewWeighted(int64(config.Server.MAXCONN))
 
 	server := &Server{
-		Config:      &config.Server,
-		Notifier:    notifier,
-		State:       state,
-		Listener:    ln,
-		Address:     address.String(),
-		Shutdown:    shutdownCtx,
-		Connections: connections,
+		Config:         &config.Server,
+		Notifier:       notifier,
+		State:          state,
+		Listener:       ln,
+		Address:        address.String(),
+		Shutdown:       shutdownCtx,
+		ShutdownCancel: shutdownCancel,
+		Connections:    connections,
+		Clients:        clients,
+		Listen:         listen,
+		Handler:        handler,
+	}
+
+	if listen.TLS {
+		server.TLSConfig = tlsConfig
+	}
+
+	if listen.RedirectToHTTPS {
+		server.Handler = service.RedirectToHTTPS(listen, server.Handler)
+	}
+
+	if listen.HSTS != nil {
+		server.Handler = service.StrictTransportSecurity(listen.HSTS, server.Handler)
 	}
 
 	server.State.Store(Starting)
@@ -103,21 +158,13 @@ func Init(config *config.Config, replica int8) (*Server, error) {
 
 }
 
-// Implementing the Shutdown_on method
+// Shutdown_on starts the shutdown process, [`Server.Run`] returns once all
+// pending connections are closed.
 func (s *Server) Shutdown_on() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Close the listener to stop accepting new connections
-	if s.Listener != nil {
-		s.Listener.Close()
-	}
-
-	// Send a shutdown notification
-	s.Notifier.Send(synchronizer.Shutdown)
-
-	// Collect acknowledgements
-	s.Notifier.CollectAcknowledgements()
+	s.ShutdownCancel()
 
 	log.Println("Server has been shut down gracefully.")
 }
@@ -145,12 +192,26 @@ func (s *Server) Run() error {
 	state.Store(StateListening)
 	fmt.Printf("%s => Listening for requests\n", logName)
 
+	guard := newGuard(&config.Limits, logName)
+	queue := newConnQueue(listener.Addr())
+	httpServer := &http.Server{
+		Handler:        guard.handler(s.Handler),
+		MaxHeaderBytes: config.Limits.MaxHeaderBytes,
+		ConnContext:    guard.connContext,
+	}
+	go httpServer.Serve(queue)
+
 	listenerObj := &Listener{
 		Config:      config,
 		Connections: connections,
+		Clients:     s.Clients,
+		Shutdown:    shutdown,
 		Listener:    listener,
 		Notifier:    notifier,
 		State:       state,
+		TLSConfig:   s.TLSConfig,
+		queue:       queue,
+		guard:       guard,
 	}
 
 	errChan := make(chan error, 1)
@@ -172,6 +233,10 @@ func (s *Server) Run() error {
 
 	s.Listener.Close()
 
+	// Stop taking new requests, idle connections are closed right away and
+	// active ones once their response has been sent.
+	go httpServer.Shutdown(context.Background())
+
 	// Send shutdown notification
 	if numTasks := notifier.Send(synchronizer.Shutdown); numTasks > 0 {
 		if numTasks > 0 {
@@ -197,42 +262,147 @@ type Listener struct {
 	Notifier    *synchronizer.Notifier
 	State       *atomic.Value
 	Connections *semaphore.Weighted
+	Clients     *clientConns
+	TLSConfig   *tls.Config
+
+	// Cancelled when the server shuts down, interrupts the wait for a
+	// permit.
+	Shutdown context.Context
+
+	// Accepted connections are served by the HTTP server reading this queue.
+	queue *connQueue
+
+	// Slow clients and oversized requests protection.
+	guard *guard
 }
 
 func (l *Listener) Listen() error {
 	for {
-		if !l.Connections.TryAcquire(1) {
-			fmt.Printf("%s => Reached max connections: %d\n", l.Config.LOGNAME, l.Config.MAXCONN)
-			l.State.Store(StateMaxConnectionsReached)
+		// In "wait" mode the permit is taken before accepting, new clients
+		// wait in the backlog of the socket until a connection is closed.
+		acquired := false
+		if l.Config.Overload == "wait" {
+			if acquired = l.Connections.TryAcquire(1); !acquired {
+				l.overloaded()
+				if err := l.Connections.Acquire(l.Shutdown, 1); err != nil {
+					return nil
+				}
+				acquired = true
+			}
+			l.recovered()
 		}
 
 		conn, err := l.Listener.Accept()
 		if err != nil {
+			if acquired {
+				l.Connections.Release(1)
+			}
 			return err
 		}
 
+		// In "reject" mode it is taken once the connection is accepted,
+		// which is answered with 503 if there is none left.
+		if !acquired {
+			if !l.Connections.TryAcquire(1) {
+				l.overloaded()
+				fmt.Printf("%s => Rejected connection from %s, max connections reached\n", l.Config.LOGNAME, conn.RemoteAddr().String())
+				go l.shed(conn)
+				continue
+			}
+			l.recovered()
+		}
+
 		fmt.Printf("%s => Accepted connection from %s\n", l.Config.LOGNAME, conn.RemoteAddr().String())
 
 		go func() {
-			defer l.Connections.Release(1)
+			defer l.release()
+
+			if !l.Clients.acquire(conn.RemoteAddr()) {
+				fmt.Printf("%s => Closing connection from %s, already %d connections from this address\n", l.Config.LOGNAME, conn.RemoteAddr().String(), l.Config.Limits.MaxConnectionsPerIP)
+				conn.Close()
+				return
+			}
+			defer l.Clients.release(conn.RemoteAddr())
+
 			l.handleConnection(conn)
 		}()
 	}
 }
 
-func (l *Listener) handleConnection(conn net.Conn) {
+// release gives back the permit of a closed connection.
+func (l *Listener) release() {
+	l.Connections.Release(1)
+	l.recovered()
+}
+
+// overloaded moves the server to [`StateMaxConnectionsReached`].
+func (l *Listener) overloaded() {
+	if l.State.CompareAndSwap(StateListening, StateMaxConnectionsReached) {
+		fmt.Printf("%s => Reached max connections: %d\n", l.Config.LOGNAME, l.Config.MAXCONN)
+	}
+}
+
+// recovered moves the server back to [`StateListening`] once connections
+// are accepted again.
+func (l *Listener) recovered() {
+	if l.State.CompareAndSwap(StateMaxConnectionsReached, StateListening) {
+		fmt.Printf("%s => Accepting connections again\n", l.Config.LOGNAME)
+	}
+}
+
+// shed answers conn with 503 Service Unavailable and closes it, the server
+// being at max_connections in "reject" overload mode.
+func (l *Listener) shed(conn net.Conn) {
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(shedTimeout))
+
+	var served net.Conn = conn
+	if l.TLSConfig != nil {
+		served = tls.Server(conn, l.TLSConfig)
+	}
+
+	resp := new(local_http.LocalResponse).Error(http.StatusServiceUnavailable)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Close = true
+	resp.Header.Set("Retry-After", strconv.Itoa(l.Config.OverloadRetryAfter))
+	if err := resp.Write(served); err != nil {
+		return
+	}
 
+	// Closing with the request unread would reset the connection, and the
+	// client could lose the response.
+	if closer, ok := served.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	io.Copy(io.Discard, io.LimitReader(served, shedDrainBytes))
+}
+
+func (l *Listener) handleConnection(conn net.Conn) {
 	subscription := l.Notifier.Subscribe()
-	defer subscription.AcknowledgeNotification()
 
-	for {
-		// Handle the connection
-		notification, ok := subscription.ReceiveNotification()
-		if !ok || notification == synchronizer.Shutdown {
-			subscription.AcknowledgeNotification()
-			break
-		}
+	tracked := newTrackedConn(l.guard.wrap(conn))
+	var served net.Conn = tracked
+	if l.TLSConfig != nil {
+		served = tls.Server(tracked, l.TLSConfig)
+	}
+
+	if !l.queue.push(served) {
+		conn.Close()
+		subscription.Unsubscribe()
+		return
+	}
+
+	select {
+	case <-tracked.done:
+		subscription.Unsubscribe()
+	case <-subscription.Notifications():
+		// The HTTP server closes the connection once the request in flight
+		// has been answered.
+		<-tracked.done
+		subscription.AcknowledgeNotification()
 	}
 
 	fmt.Printf("Connection from %s closed\n", conn.RemoteAddr().String())
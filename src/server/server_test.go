@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	"roxy/src/synchronizer"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// listenOne starts a listener allowing a single connection at a time.
+func listenOne(t *testing.T, overload string) (string, *atomic.Value) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &config.ServerConfig{
+		MAXCONN:            1,
+		Overload:           overload,
+		OverloadRetryAfter: 3,
+		LOGNAME:            "test",
+		Limits:             config.ConnectionLimits{MaxHeaderBytes: 1 << 20, MaxHeaderCount: 100},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &atomic.Value{}
+	state.Store(StateListening)
+	queue := newConnQueue(ln.Addr())
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go httpServer.Serve(queue)
+
+	listener := &Listener{
+		Listener:    ln,
+		Config:      serverConfig,
+		Notifier:    synchronizer.NewNotifier(),
+		State:       state,
+		Connections: semaphore.NewWeighted(1),
+		Clients:     newClientConns(0, nil),
+		Shutdown:    ctx,
+		queue:       queue,
+		guard:       newGuard(&serverConfig.Limits, "test"),
+	}
+	go listener.Listen()
+
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+		httpServer.Close()
+	})
+	return ln.Addr().String(), state
+}
+
+// get sends a request on a new connection kept open and returns its
+// response, or nil if none came before timeout.
+func get(t *testing.T, addr string, timeout time.Duration) (net.Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, resp
+}
+
+func waitState(t *testing.T, state *atomic.Value, want State) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); state.Load() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %v, want %v", state.Load(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOverloadReject(t *testing.T) {
+	addr, state := listenOne(t, "reject")
+
+	first, resp := get(t, addr, time.Second)
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("first connection: %v", resp)
+	}
+
+	_, resp = get(t, addr, time.Second)
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "3" {
+		t.Fatalf("connection over the limit: %v", resp)
+	}
+	waitState(t, state, StateMaxConnectionsReached)
+
+	first.Close()
+	waitState(t, state, StateListening)
+
+	if _, resp = get(t, addr, time.Second); resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("connection after recovery: %v", resp)
+	}
+}
+
+func TestOverloadWait(t *testing.T) {
+	addr, state := listenOne(t, "wait")
+
+	first, resp := get(t, addr, time.Second)
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("first connection: %v", resp)
+	}
+
+	second, resp := get(t, addr, 300*time.Millisecond)
+	if resp != nil {
+		t.Fatalf("connection over the limit served: %v", resp.Status)
+	}
+	waitState(t, state, StateMaxConnectionsReached)
+
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("waiting connection: %v %v", resp, err)
+	}
+
+	second.Close()
+	waitState(t, state, StateListening)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"roxy/src/config"
+)
+
+// LimitBody makes reading the body of r fail once it exceeds max bytes, and
+// tells whether its announced length already does. The connection is closed
+// after the response when the limit is reached.
+func LimitBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if r.ContentLength > max {
+		return false
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+	return true
+}
+
+// BodyTooLarge tells whether err comes from reading a body beyond the limit
+// set by [`LimitBody`].
+func BodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// BufferBody reads the whole body of r, in memory up to the memory limit of
+// options and in a temporary file beyond, and replaces it with the buffered
+// copy, which GetBody can provide again. The returned function releases the
+// buffer once the request is done.
+func BufferBody(r *http.Request, options *config.RequestBuffering) (func(), error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() {}, nil
+	}
+	defer r.Body.Close()
+
+	memory, err := io.ReadAll(io.LimitReader(r.Body, int64(options.MemoryLimit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(memory) <= options.MemoryLimit {
+		setBufferedBody(r, int64(len(memory)), func() io.ReadCloser {
+			return io.NopCloser(bytes.NewReader(memory))
+		})
+		return func() {}, nil
+	}
+
+	file, err := os.CreateTemp(options.TempDir, "roxy-body-*")
+	if err != nil {
+		return nil, err
+	}
+	release := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(memory), r.Body))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	setBufferedBody(r, size, func() io.ReadCloser {
+		return io.NopCloser(io.NewSectionReader(file, 0, size))
+	})
+	return release, nil
+}
+
+// setBufferedBody makes r send a complete body of size bytes, read from the
+// bodies that open returns.
+func setBufferedBody(r *http.Request, size int64, open func() io.ReadCloser) {
+	r.Body = open()
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return open(), nil
+	}
+	if size == 0 {
+		r.Body = http.NoBody
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"roxy/src/config"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 100)))
+	if LimitBody(httptest.NewRecorder(), r, 10) {
+		t.Error("announced length over the limit accepted")
+	}
+
+	// Bodies of unknown length fail once forwarded beyond the limit.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	r = httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", 100))))
+	r.ContentLength = -1
+	if !LimitBody(httptest.NewRecorder(), r, 10) {
+		t.Fatal("body of unknown length refused")
+	}
+	_, err := Forward(context.Background(), r, strings.TrimPrefix(backend.URL, "http://"))
+	if !BodyTooLarge(err) {
+		t.Errorf("Forward() error = %v", err)
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	dir := t.TempDir()
+	options := &config.RequestBuffering{MemoryLimit: 16, TempDir: dir}
+
+	for _, body := range []string{"", "small", strings.Repeat("large ", 100)} {
+		r := httptest.NewRequest("POST", "/upload", io.MultiReader(strings.NewReader(body)))
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+
+		release, err := BufferBody(r, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ContentLength != int64(len(body)) || r.TransferEncoding != nil {
+			t.Errorf("%d bytes: content length %d, transfer encoding %v", len(body), r.ContentLength, r.TransferEncoding)
+		}
+		// The body can be read again, for retries.
+		for range 2 {
+			if read, _ := io.ReadAll(r.Body); string(read) != body {
+				t.Errorf("%d bytes: read %d bytes", len(body), len(read))
+			}
+			if r.GetBody != nil {
+				r.Body, _ = r.GetBody()
+			}
+		}
+
+		files, _ := os.ReadDir(dir)
+		if spilled := len(body) > options.MemoryLimit; (len(files) == 1) != spilled {
+			t.Errorf("%d bytes: %d temporary files", len(body), len(files))
+		}
+		release()
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%d bytes: %d temporary files left", len(body), len(files))
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"roxy/src/filecache"
+	"strings"
+)
+
+// loadEntry reads file, and its precompressed siblings, into a cache entry.
+// It returns nil if the file is too large to be cached, or if it or one of
+// its siblings resolves outside of root, where the watcher of the cache
+// can't see it change.
+func loadEntry(file, root string, info os.FileInfo, options *config.ServeOptions, cache *filecache.Cache) *filecache.Entry {
+	if info.Size() > cache.MaxFileSize {
+		return nil
+	}
+
+	realRoot, err := filepath.Abs(root)
+	if err == nil {
+		realRoot, err = filepath.EvalSymlinks(realRoot)
+	}
+	if err != nil {
+		return nil
+	}
+	realFile, err := filepath.EvalSymlinks(file)
+	if err != nil || !within(realFile, realRoot) {
+		return nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil || int64(len(content)) > cache.MaxFileSize {
+		return nil
+	}
+
+	entry := &filecache.Entry{
+		Files:    []string{file},
+		ModTime:  info.ModTime(),
+		ETag:     fileETag(info),
+		Header:   http.Header{},
+		Variants: map[string][]byte{"": content},
+	}
+
+	// Changes to the target of a symlink are reported under its own name.
+	if realFile != file {
+		entry.Files = append(entry.Files, realFile)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	entry.Header.Set("Content-Type", contentType)
+
+	if cacheControl := cacheControlFor(options, file); cacheControl != "" {
+		entry.Header.Set("Cache-Control", cacheControl)
+	}
+
+	if len(options.Precompressed) > 0 {
+		entry.Header.Set("Vary", "Accept-Encoding")
+	}
+
+	for _, encoding := range options.Precompressed {
+		variant := file + precompressedExtensions[encoding]
+		stat := os.Lstat
+		if options.Symlinks == config.SymlinksFollow {
+			stat = os.Stat
+		}
+		variantInfo, err := stat(variant)
+		if err != nil || !variantInfo.Mode().IsRegular() || variantInfo.Size() > cache.MaxFileSize {
+			continue
+		}
+		if realVariant, err := filepath.EvalSymlinks(variant); err != nil || !within(realVariant, realRoot) {
+			return nil
+		}
+		variantContent, err := os.ReadFile(variant)
+		if err != nil {
+			continue
+		}
+		entry.Variants[encoding] = variantContent
+		entry.Encodings = append(entry.Encodings, encoding)
+		entry.Files = append(entry.Files, variant)
+	}
+
+	return entry
+}
+
+// sendCached writes entry like sendFile would write the files it was read
+// from.
+func sendCached(entry *filecache.Entry, w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = values
+	}
+
+	content := entry.Variants[""]
+	etag := entry.ETag
+	if encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"), entry.Encodings); encoding != "" {
+		header.Set("Content-Encoding", encoding)
+		content = entry.Variants[encoding]
+		etag = strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+	}
+
+	header.Set("ETag", etag)
+
+	http.ServeContent(w, r, "", entry.ModTime, bytes.NewReader(content))
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		remote       string
+		forwardedFor string
+		expected     string
+	}{
+		{"203.0.113.7:4000", "", "203.0.113.7"},
+		// Only trusted proxies can tell who the client is.
+		{"203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.1:4000", "198.51.100.1", "198.51.100.1"},
+		// Addresses added by the client itself are ignored.
+		{"10.0.0.1:4000", "192.0.2.66, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:4000", "10.0.0.3", "10.0.0.3"},
+		{"10.0.0.1:4000", "garbage, 10.0.0.2", "10.0.0.2"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if got := ClientIP(r, trusted); got != test.expected {
+			t.Errorf("ClientIP(%s, %q) = %s, want %s", test.remote, test.forwardedFor, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"roxy/src/config"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// File extensions of precompressed siblings, indexed by encoding.
+var precompressedExtensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// Encoders are expensive to allocate, zstd ones in particular.
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zstdWriters = sync.Pool{New: func() any {
+		encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return encoder
+	}}
+)
+
+// NegotiateEncoding picks the encoding of offered, listed in order of
+// preference, that the Accept-Encoding header ranks the highest. It returns
+// an empty string if none is acceptable.
+func NegotiateEncoding(acceptEncoding string, offered []string) string {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if coding == "*" {
+			wildcard = q
+		} else {
+			weights[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// CompressWriter compresses the response body on the fly once it is known
+// to be eligible: successful, not encoded yet, of a compressible type and at
+// least MinSize bytes long. Bodies of unknown length are buffered until
+// MinSize bytes have been written.
+type CompressWriter struct {
+	http.ResponseWriter
+
+	// Negotiated encoding, empty when the client accepts none.
+	encoding string
+	options  *config.Compress
+
+	status      int
+	wroteHeader bool
+
+	// Whether the status line has been sent, after which the decision to
+	// compress can't change.
+	decided bool
+
+	encoder io.WriteCloser
+	buffer  []byte
+}
+
+// NewCompressWriter wraps w so that the response is compressed with
+// encoding when eligible. Close must be called once the response is
+// complete.
+func NewCompressWriter(w http.ResponseWriter, encoding string, options *config.Compress) *CompressWriter {
+	return &CompressWriter{ResponseWriter: w, encoding: encoding, options: options}
+}
+
+func (c *CompressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	c.status = status
+
+	header := c.Header()
+	if status == http.StatusNotModified && c.encoding != "" {
+		// Revalidates the compressed representation the client holds.
+		weakenETag(header)
+	}
+
+	if !c.compressibleType(header.Get("Content-Type")) || header.Get("Content-Encoding") != "" {
+		c.decide(false)
+		return
+	}
+
+	if !strings.Contains(strings.ToLower(strings.Join(header.Values("Vary"), ",")), "accept-encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if c.encoding == "" || status != http.StatusOK || header.Get("Content-Range") != "" {
+		c.decide(false)
+		return
+	}
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		c.decide(length >= c.options.MinSize)
+	}
+}
+
+func (c *CompressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.decided {
+		if c.encoder != nil {
+			return c.encoder.Write(p)
+		}
+		return c.ResponseWriter.Write(p)
+	}
+
+	c.buffer = append(c.buffer, p...)
+	if len(c.buffer) >= c.options.MinSize {
+		c.decide(true)
+		if err := c.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close sends what is left of the body and terminates the compressed stream.
+func (c *CompressWriter) Close() error {
+	if !c.wroteHeader {
+		return nil
+	}
+
+	if !c.decided {
+		c.decide(false)
+		if err := c.flushBuffer(); err != nil {
+			return err
+		}
+	}
+
+	if c.encoder == nil {
+		return nil
+	}
+
+	err := c.encoder.Close()
+	switch encoder := c.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Reset(io.Discard)
+		gzipWriters.Put(encoder)
+	case *zstd.Encoder:
+		encoder.Reset(io.Discard)
+		zstdWriters.Put(encoder)
+	}
+	c.encoder = nil
+
+	return err
+}
+
+// decide sends the status line, with the encoding headers when compress is
+// true.
+func (c *CompressWriter) decide(compress bool) {
+	c.decided = true
+
+	if compress {
+		header := c.Header()
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		weakenETag(header)
+
+		switch c.encoding {
+		case "gzip":
+			encoder := gzipWriters.Get().(*gzip.Writer)
+			encoder.Reset(c.ResponseWriter)
+			c.encoder = encoder
+		case "zstd":
+			encoder := zstdWriters.Get().(*zstd.Encoder)
+			encoder.Reset(c.ResponseWriter)
+			c.encoder = encoder
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+// weakenETag turns the strong ETag of header into a weak one. The compressed
+// body differs byte for byte from the one the backend validates, but a weak
+// ETag still matches it on the If-None-Match of conditional requests.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+func (c *CompressWriter) flushBuffer() error {
+	if len(c.buffer) == 0 {
+		return nil
+	}
+
+	var err error
+	if c.encoder != nil {
+		_, err = c.encoder.Write(c.buffer)
+	} else {
+		_, err = c.ResponseWriter.Write(c.buffer)
+	}
+	c.buffer = nil
+
+	return err
+}
+
+func (c *CompressWriter) compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+
+	for _, candidate := range c.options.Types {
+		if prefix, ok := strings.CutSuffix(candidate, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == candidate {
+			return true
+		}
+	}
+
+	return false
+}
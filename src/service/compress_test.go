@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"zstd", "gzip"}
+	tests := map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"gzip, zstd":           "zstd",
+		"gzip;q=1, zstd;q=0.5": "gzip",
+		"zstd;q=0, *":          "gzip",
+		"br":                   "",
+		"identity":             "",
+	}
+
+	for accept, want := range tests {
+		if got := NegotiateEncoding(accept, offered); got != want {
+			t.Errorf("NegotiateEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	options := &config.Compress{MinSize: 16, Types: []string{"text/*"}}
+	large := strings.Repeat("roxy ", 100)
+
+	compressed := func(encoding, contentType, contentEncoding, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c := NewCompressWriter(w, encoding, options)
+		c.Header().Set("Content-Type", contentType)
+		if contentEncoding != "" {
+			c.Header().Set("Content-Encoding", contentEncoding)
+		}
+		io.WriteString(c, body)
+		c.Close()
+		return w
+	}
+
+	w := compressed("gzip", "text/html", "", large)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(reader); string(body) != large {
+		t.Errorf("gzip body = %q", body)
+	}
+
+	w = compressed("zstd", "text/css", "", large)
+	decoder, _ := zstd.NewReader(w.Body)
+	if body, _ := io.ReadAll(decoder); string(body) != large {
+		t.Errorf("zstd body = %q", body)
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"small":   compressed("gzip", "text/html", "", "tiny"),
+		"image":   compressed("gzip", "image/png", "", large),
+		"encoded": compressed("gzip", "text/html", "br", large),
+		"refused": compressed("", "text/html", "", large),
+	} {
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" && encoding != "br" {
+			t.Errorf("%s: Content-Encoding = %q, want none", name, encoding)
+		}
+	}
+
+	if vary := compressed("", "text/html", "", large).Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", vary)
+	}
+}
+
+func TestCompressWriterConditional(t *testing.T) {
+	options := &config.Compress{MinSize: 16, Types: []string{"text/*"}}
+	modTime := time.Now()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		c := NewCompressWriter(w, NegotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}), options)
+		defer c.Close()
+		c.Header().Set("ETag", `"v1"`)
+		c.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(c, r, "", modTime, strings.NewReader(strings.Repeat("roxy ", 100)))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("Content-Encoding") != "gzip" || etag != `W/"v1"` {
+		t.Fatalf("Content-Encoding = %q, ETag = %q", w.Header().Get("Content-Encoding"), etag)
+	}
+
+	// The ETag of the compressed response revalidates it.
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("conditional GET: status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestTransferPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0644)
+	os.WriteFile(filepath.Join(root, "app.js.br"), []byte("brotli"), 0644)
+	os.WriteFile(filepath.Join(root, "app.js.gz"), []byte("gzip"), 0644)
+
+	options := &config.ServeOptions{Symlinks: config.SymlinksWithinRoot, Precompressed: []string{"br", "zstd", "gzip"}}
+
+	tests := map[string]string{
+		"br, gzip":   "brotli",
+		"zstd, gzip": "gzip",
+		"":           "console.log(1)",
+	}
+
+	for accept, want := range tests {
+		w, err := transfer(root, "/app.js", options, http.Header{"Accept-Encoding": {accept}})
+		if err != nil || !bytes.Equal(w.Body.Bytes(), []byte(want)) {
+			t.Errorf("Transfer(%q) = %v %q, want %q", accept, err, w.Body.String(), want)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+			t.Errorf("Transfer(%q) Content-Type = %q", accept, got)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Transfer(%q) Vary = %q", accept, w.Header().Get("Vary"))
+		}
+	}
+}
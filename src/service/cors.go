@@ -0,0 +1,134 @@
+package service
+
+import (
+	"net/http"
+	"roxy/src/config"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IsPreflight tells whether r is a CORS preflight request.
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// AllowedOrigin tells whether the policy lets scripts of origin use the
+// responses.
+func AllowedOrigin(policy *config.CORS, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if policy.AnyOrigin || slices.Contains(policy.Origins, origin) {
+		return true
+	}
+	for _, compiled := range policy.CompiledOrigins {
+		if compiled.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Preflight answers the preflight request r with 204 No Content if the
+// policy allows the request it announces, and returns false without
+// answering otherwise.
+func Preflight(w http.ResponseWriter, r *http.Request, policy *config.CORS) bool {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !AllowedOrigin(policy, origin) || !slices.Contains(policy.Methods, method) {
+		return false
+	}
+
+	var requested []string
+	for _, field := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			requested = append(requested, field)
+		}
+	}
+	allowedHeaders := requested
+	if len(policy.Headers) > 0 {
+		for _, field := range requested {
+			if !slices.ContainsFunc(policy.Headers, func(allowed string) bool { return strings.EqualFold(allowed, field) }) {
+				return false
+			}
+		}
+		allowedHeaders = policy.Headers
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	setAllowOrigin(header, policy, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	if len(allowedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+	}
+	if policy.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// setAllowOrigin sets the headers letting origin read the response.
+func setAllowOrigin(header http.Header, policy *config.CORS, origin string) {
+	if policy.AnyOrigin && !policy.Credentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if policy.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// CORSWriter replaces the CORS headers of a response with those of the
+// policy of its pattern for the origin of the request.
+type CORSWriter struct {
+	http.ResponseWriter
+
+	policy      *config.CORS
+	origin      string
+	wroteHeader bool
+}
+
+// NewCORSWriter wraps w, the response to a request sent from origin.
+func NewCORSWriter(w http.ResponseWriter, origin string, policy *config.CORS) *CORSWriter {
+	return &CORSWriter{ResponseWriter: w, origin: origin, policy: policy}
+}
+
+func (c *CORSWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	header := c.Header()
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(header, name)
+		}
+	}
+
+	// Responses depend on the origin unless every origin gets the same.
+	if !c.policy.AnyOrigin || c.policy.Credentials {
+		header.Add("Vary", "Origin")
+	}
+
+	if AllowedOrigin(c.policy, c.origin) {
+		setAllowOrigin(header, c.policy, c.origin)
+		if len(c.policy.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(c.policy.ExposeHeaders, ", "))
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *CORSWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(p)
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"roxy/src/config"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	policy := &config.CORS{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "PUT"},
+		Headers: []string{"Content-Type", "Authorization"},
+		MaxAge:  600,
+	}
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/api", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		r.Header.Set("Access-Control-Request-Headers", headers)
+		if !IsPreflight(r) {
+			t.Fatal("not a preflight request")
+		}
+		w := httptest.NewRecorder()
+		if !Preflight(w, r, policy) {
+			w.Code = http.StatusForbidden
+		}
+		return w
+	}
+
+	w := preflight("https://app.example.com", "PUT", "content-type, authorization")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, PUT" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("allowed preflight: %d %v", w.Code, w.Header())
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"origin": preflight("https://evil.example", "PUT", ""),
+		"method": preflight("https://app.example.com", "DELETE", ""),
+		"header": preflight("https://app.example.com", "PUT", "X-Debug"),
+	} {
+		if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("preflight with a refused %s: %d %v", name, w.Code, w.Header())
+		}
+	}
+}
+
+func TestCORSWriter(t *testing.T) {
+	policy := &config.CORS{
+		Origins:       []string{"https://app.example.com"},
+		ExposeHeaders: []string{"X-Request-Id"},
+		Credentials:   true,
+	}
+
+	for origin, want := range map[string]string{"https://app.example.com": "https://app.example.com", "https://evil.example": ""} {
+		recorder := httptest.NewRecorder()
+		w := NewCORSWriter(recorder, origin, policy)
+		// The headers of the backend are replaced.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte("ok"))
+
+		header := recorder.Header()
+		if header.Get("Access-Control-Allow-Origin") != want || header.Get("Vary") != "Origin" {
+			t.Errorf("%s: headers %v", origin, header)
+		}
+		if want != "" && (header.Get("Access-Control-Allow-Credentials") != "true" || header.Get("Access-Control-Expose-Headers") != "X-Request-Id") {
+			t.Errorf("%s: headers %v", origin, header)
+		}
+	}
+}
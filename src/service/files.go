@@ -1,49 +1,418 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"roxy/src/config"
+	"roxy/src/filecache"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-// Transfer serves the content of a file as the HTTP response body.
-func Transfer(path, root string, w http.ResponseWriter) error {
-	directory, err := filepath.Abs(root)
+// ErrNotFound is returned by [`Transfer`] when the request doesn't map to a
+// file that can be sent.
+var ErrNotFound = errors.New("file not found")
+
+// Types missing from the tables of many systems. mime.TypeByExtension also
+// reads /etc/mime.types and friends when they exist.
+var extraTypes = map[string]string{
+	".avif":        "image/avif",
+	".css":         "text/css; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".ico":         "image/x-icon",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".md":          "text/markdown; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".mp4":         "video/mp4",
+	".otf":         "font/otf",
+	".svg":         "image/svg+xml",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "text/xml; charset=utf-8",
+	".yaml":        "application/yaml",
+	".yml":         "application/yaml",
+	".zip":         "application/zip",
+}
+
+func init() {
+	for ext, contentType := range extraTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, contentType)
+		}
+	}
+}
+
+// StatusError is returned by [`Transfer`] when a "=code" try_files entry is
+// reached.
+type StatusError int
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("try_files status %d", int(e))
+}
+
+// Transfer serves the file that path maps to under root as the HTTP response
+// body. Directories are served through their index files, or listed when
+// browsing is enabled. When try_files is configured its candidates are used
+// instead of path. Conditional and range requests are handled as well.
+// Small files are kept in cache when it isn't nil. Nothing is written when
+// an error is returned.
+func Transfer(path, root string, options *config.ServeOptions, cache *filecache.Cache, w http.ResponseWriter, r *http.Request) error {
+	var generation uint64
+	if cache != nil {
+		if entry := cache.Get(path); entry != nil {
+			sendCached(entry, w, r)
+			return nil
+		}
+		generation = cache.Generation()
+	}
+
+	loc, err := locate(path, root, options)
 	if err != nil {
-		http.NotFound(w, nil)
 		return err
 	}
 
-	file, err := filepath.Abs(filepath.Join(directory, path))
-	if err != nil || !strings.HasPrefix(file, directory) || !fileExists(file) {
-		http.NotFound(w, nil)
-		return err
+	switch {
+	case loc.directory != "" && !strings.HasSuffix(r.URL.Path, "/"):
+		// Relative links in the index only work if the URL ends with a slash.
+		target := r.URL.EscapedPath() + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return nil
+	case loc.file == "":
+		return listDirectory(loc.directory, loc.path, root, options, w, r)
 	}
 
-	contentType := "text/plain"
-	switch filepath.Ext(file) {
-	case ".html":
-		contentType = "text/html"
-	case ".css":
-		contentType = "text/css"
-	case ".js":
-		contentType = "application/javascript"
-	case ".png":
-		contentType = "image/png"
-	case ".jpeg", ".jpg":
-		contentType = "image/jpeg"
+	if cache != nil {
+		if entry := loadEntry(loc.file, root, loc.info, options, cache); entry != nil {
+			cache.Put(path, entry, generation)
+			sendCached(entry, w, r)
+			return nil
+		}
+	}
+
+	return sendFile(loc.file, loc.info, options, w, r)
+}
+
+// location is what a request path maps to, either a regular file or a
+// directory that has to be listed.
+type location struct {
+	// Regular file to send, empty when the directory has to be listed.
+	file string
+	info os.FileInfo
+
+	// Directory the request maps to, if any, and the path of the directory.
+	directory string
+	path      string
+}
+
+// locate maps path to a file or directory under root, going through the
+// try_files candidates when configured.
+func locate(path, root string, options *config.ServeOptions) (*location, error) {
+	if len(options.TryFiles) == 0 {
+		file, info, err := resolveFile(path, root, options)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return locateDirectory(file, path, root, options)
+		}
+		return &location{file: file, info: info}, nil
+	}
+
+	for _, entry := range options.TryFiles {
+		if status, ok := strings.CutPrefix(entry, "="); ok {
+			code, _ := strconv.Atoi(status)
+			if code == http.StatusNotFound {
+				return nil, ErrNotFound
+			}
+			return nil, StatusError(code)
+		}
+
+		candidate := strings.ReplaceAll(entry, "$uri", path)
+		file, info, err := resolveFile(candidate, root, options)
+		if err != nil {
+			continue
+		}
+
+		// Like nginx, only candidates ending with a slash match directories.
+		if strings.HasSuffix(candidate, "/") {
+			if !info.IsDir() {
+				continue
+			}
+			loc, err := locateDirectory(file, candidate, root, options)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return loc, err
+		}
+
+		if !info.IsDir() {
+			return &location{file: file, info: info}, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// locateDirectory finds the index file of directory, which path maps to, or
+// returns the directory itself when it can be listed.
+func locateDirectory(directory, path, root string, options *config.ServeOptions) (*location, error) {
+	for _, index := range options.Index {
+		file, info, err := resolveFile(pathpkg.Join(path, index), root, options)
+		if err == nil && !info.IsDir() {
+			return &location{file: file, info: info, directory: directory, path: path}, nil
+		}
+	}
+
+	if options.Browse {
+		return &location{directory: directory, path: path}, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// ErrorDocument answers with the error page configured for status, read
+// from root. It returns false, without writing anything, when there is no
+// such page.
+func ErrorDocument(status int, root string, options *config.ServeOptions, w http.ResponseWriter, r *http.Request) bool {
+	page, ok := options.ErrorPages[strconv.Itoa(status)]
+	if !ok {
+		return false
+	}
+
+	file, info, err := resolveFile(page, root, options)
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
 	}
 
 	w.Header().Set("Content-Type", contentType)
-	http.ServeFile(w, nil, file)
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(content)
+	}
+
+	return true
+}
+
+// resolveFile maps path to a file under root, enforcing the dotfile and
+// symlink policies of options.
+func resolveFile(path, root string, options *config.ServeOptions) (string, os.FileInfo, error) {
+	directory, err := filepath.Abs(root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	clean := pathpkg.Clean("/" + path)
+	if !options.Dotfiles && hasDotSegment(clean) {
+		return "", nil, ErrNotFound
+	}
+
+	// Cleaning the rooted path removes every "..", so file is always located
+	// under directory before symlinks are taken into account.
+	file := filepath.Join(directory, filepath.FromSlash(clean))
+
+	switch options.Symlinks {
+	case config.SymlinksDeny:
+		if err := denySymlinks(directory, file); err != nil {
+			return "", nil, err
+		}
+	case config.SymlinksWithinRoot:
+		realRoot, err := filepath.EvalSymlinks(directory)
+		if err != nil {
+			return "", nil, notFound(err)
+		}
+		realFile, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return "", nil, notFound(err)
+		}
+		if !within(realFile, realRoot) {
+			return "", nil, ErrNotFound
+		}
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", nil, notFound(err)
+	}
+
+	// Devices, sockets and pipes are never served.
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return "", nil, ErrNotFound
+	}
+
+	return file, info, nil
+}
+
+// denySymlinks fails if any component of file below directory is a symlink.
+func denySymlinks(directory, file string) error {
+	relative, err := filepath.Rel(directory, file)
+	if err != nil || relative == "." {
+		return err
+	}
+
+	current := directory
+	for _, component := range strings.Split(relative, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return notFound(err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrNotFound
+		}
+	}
+
 	return nil
 }
 
-func fileExists(filePath string) bool {
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return false
+// sendFile writes file with its content type, validators and cache policy.
+// A precompressed sibling is sent instead when the client accepts it.
+func sendFile(file string, info os.FileInfo, options *config.ServeOptions, w http.ResponseWriter, r *http.Request) error {
+	header := w.Header()
+
+	// Without a known extension ServeContent sniffs the content instead.
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+
+	cacheControl := cacheControlFor(options, file)
+
+	// Variants share the validators of the original file.
+	etag := fileETag(info)
+	modTime := info.ModTime()
+	if len(options.Precompressed) > 0 {
+		header.Add("Vary", "Accept-Encoding")
+		if encoding, variant := precompressedVariant(file, options, r); variant != "" {
+			header.Set("Content-Encoding", encoding)
+			if contentType == "" {
+				// Sniffing would see the compressed bytes.
+				contentType = "application/octet-stream"
+			}
+			file = variant
+			etag = strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		header.Del("Content-Encoding")
+		return notFound(err)
+	}
+	defer f.Close()
+
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	header.Set("ETag", etag)
+
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+
+	// Handles Last-Modified, If-None-Match, If-Modified-Since, If-Range and
+	// byte ranges.
+	http.ServeContent(w, r, info.Name(), modTime, f)
+	return nil
+}
+
+// precompressedVariant returns the best precompressed sibling of file
+// accepted by the client, if any. Siblings must be regular files and, unless
+// symlinks are followed, not symlinks.
+func precompressedVariant(file string, options *config.ServeOptions, r *http.Request) (string, string) {
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	offered := options.Precompressed
+
+	for len(offered) > 0 {
+		encoding := NegotiateEncoding(acceptEncoding, offered)
+		if encoding == "" {
+			break
+		}
+
+		variant := file + precompressedExtensions[encoding]
+		stat := os.Lstat
+		if options.Symlinks == config.SymlinksFollow {
+			stat = os.Stat
+		}
+		if info, err := stat(variant); err == nil && info.Mode().IsRegular() {
+			return encoding, variant
+		}
+
+		// Try the next best encoding.
+		remaining := make([]string, 0, len(offered)-1)
+		for _, candidate := range offered {
+			if candidate != encoding {
+				remaining = append(remaining, candidate)
+			}
+		}
+		offered = remaining
+	}
+
+	return "", ""
+}
+
+// fileETag computes a strong validator from the size and modification time.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+func cacheControlFor(options *config.ServeOptions, file string) string {
+	if value, ok := options.CacheControl[strings.ToLower(filepath.Ext(file))]; ok {
+		return value
+	}
+	return options.CacheControl["*"]
+}
+
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func within(path, root string) bool {
+	if path == root {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// notFound turns missing files and permission errors into ErrNotFound, so
+// that clients can't probe which files exist.
+func notFound(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission), errors.Is(err, ErrNotFound):
+		return ErrNotFound
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.ENAMETOOLONG):
+		return ErrNotFound
 	}
-	return !info.IsDir()
+	return err
 }
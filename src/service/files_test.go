@@ -0,0 +1,321 @@
+package service
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"roxy/src/filecache"
+	"roxy/src/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupRoot creates a serve root with a few files and a symlink escaping it.
+func setupRoot(t *testing.T) string {
+	t.Helper()
+
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	files := map[string]string{
+		"root/index.html":      "<h1>home</h1>",
+		"root/app.css":         "body{}",
+		"root/docs/index.html": "<h1>docs</h1>",
+		"root/.env":            "SECRET=1",
+		"secret.txt":           "secret",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "app.css"), filepath.Join(root, "inner.css")); err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func transfer(root, target string, options *config.ServeOptions, header http.Header) (*httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest("GET", target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	return w, Transfer(r.URL.Path, root, options, nil, w, r)
+}
+
+func TestTransfer(t *testing.T) {
+	root := setupRoot(t)
+	options := &config.ServeOptions{
+		Index:        []string{"index.html"},
+		Symlinks:     config.SymlinksWithinRoot,
+		CacheControl: map[string]string{".css": "max-age=31536000", "*": "no-cache"},
+	}
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/", 200, "<h1>home</h1>"},
+		{"/docs/", 200, "<h1>docs</h1>"},
+		{"/docs", 301, ""},
+		{"/app.css", 200, "body{}"},
+		{"/inner.css", 200, "body{}"},
+		{"/escape.txt", 404, ""},
+		{"/../secret.txt", 404, ""},
+		{"/.env", 404, ""},
+		{"/missing", 404, ""},
+		{"/app.css/x", 404, ""},
+	}
+
+	for _, test := range tests {
+		w, err := transfer(root, test.target, options, nil)
+		status := w.Code
+		if err == ErrNotFound {
+			status = 404
+		} else if err != nil {
+			t.Errorf("Transfer(%s) error = %v", test.target, err)
+			continue
+		}
+		if status != test.status {
+			t.Errorf("Transfer(%s) status = %d, want %d", test.target, status, test.status)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Transfer(%s) body = %q, want %q", test.target, w.Body.String(), test.body)
+		}
+	}
+
+	w, _ := transfer(root, "/app.css", options, nil)
+	if got := w.Header().Get("Content-Type"); got != "text/css; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "max-age=31536000" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	etag := w.Header().Get("ETag")
+	w, _ = transfer(root, "/app.css", options, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional request status = %d, want 304", w.Code)
+	}
+
+	w, _ = transfer(root, "/app.css", options, http.Header{"Range": {"bytes=0-3"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "body" {
+		t.Errorf("range request = %d %q, want 206 \"body\"", w.Code, w.Body.String())
+	}
+
+	options.Symlinks = config.SymlinksDeny
+	if _, err := transfer(root, "/inner.css", options, nil); err != ErrNotFound {
+		t.Errorf("Transfer(/inner.css) with symlinks denied error = %v, want ErrNotFound", err)
+	}
+
+	options.Symlinks = config.SymlinksFollow
+	if w, err := transfer(root, "/escape.txt", options, nil); err != nil || w.Body.String() != "secret" {
+		t.Errorf("Transfer(/escape.txt) following symlinks = %v %q", err, w.Body.String())
+	}
+}
+
+func TestTransferBrowse(t *testing.T) {
+	root := setupRoot(t)
+	docs := filepath.Join(root, "docs")
+	if err := os.Remove(filepath.Join(docs, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(docs, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for name, file := range map[string]struct {
+		size int
+		age  time.Duration
+	}{"a.txt": {300, 3 * time.Hour}, "b.txt": {100, time.Hour}, "c.txt": {200, 2 * time.Hour}} {
+		path := filepath.Join(docs, name)
+		if err := os.WriteFile(path, make([]byte, file.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-file.age), now.Add(-file.age))
+	}
+
+	options := &config.ServeOptions{Symlinks: config.SymlinksWithinRoot, Browse: true, BrowseSort: "name"}
+
+	// Directories come first whatever the order.
+	for query, want := range map[string]string{
+		"":                       "sub a.txt b.txt c.txt",
+		"?order=desc":            "sub c.txt b.txt a.txt",
+		"?sort=size":             "sub b.txt c.txt a.txt",
+		"?sort=size&order=desc":  "sub a.txt c.txt b.txt",
+		"?sort=mtime":            "sub a.txt c.txt b.txt",
+		"?sort=mtime&order=desc": "sub b.txt c.txt a.txt",
+		"?sort=unknown":          "sub a.txt b.txt c.txt",
+	} {
+		w, err := transfer(root, "/docs/"+query, options, http.Header{"Accept": {"application/json"}})
+		if err != nil {
+			t.Fatalf("Transfer(/docs/%s) error = %v", query, err)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		var listing Listing
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range listing.Entries {
+			names = append(names, entry.Name)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("/docs/%s: entries %s, want %s", query, got, want)
+		}
+	}
+
+	templateFile := filepath.Join(t.TempDir(), "listing.html")
+	os.WriteFile(templateFile, []byte("{{.Path}}:{{range .Entries}} {{.Name}}{{end}}"), 0644)
+	custom := *options
+	custom.CompiledBrowseTemplate = template.Must(template.ParseFiles(templateFile))
+	w, err := transfer(root, "/docs/?sort=size", &custom, http.Header{"Accept": {"text/html"}})
+	if err != nil {
+		t.Fatalf("Transfer(/docs/) error = %v", err)
+	}
+	if got := w.Body.String(); got != "/docs/: sub b.txt c.txt a.txt" {
+		t.Errorf("custom template listing = %q", got)
+	}
+
+	w, err = transfer(root, "/", &config.ServeOptions{Symlinks: config.SymlinksWithinRoot, Browse: true, BrowseSort: "name", Index: []string{"missing.html"}}, http.Header{"Accept": {"text/html"}})
+	if err != nil {
+		t.Fatalf("Transfer(/) error = %v", err)
+	}
+	body := w.Body.String()
+	for _, hidden := range []string{".env", "escape.txt"} {
+		if strings.Contains(body, hidden) {
+			t.Errorf("listing shows %s", hidden)
+		}
+	}
+	if !strings.Contains(body, `href="docs/"`) || !strings.Contains(body, `href="app.css"`) {
+		t.Errorf("listing = %s, want docs/ and app.css", body)
+	}
+}
+
+func TestPrefersJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"*/*":                               false,
+		"application/json":                  true,
+		"text/html, application/json":       false,
+		"text/html, application/json;q=0.9": false,
+		"text/html;q=0.5, application/json": true,
+		"application/json;q=0":              false,
+		"TEXT/HTML;q=0.1, Application/JSON": true,
+		"application/json;q=0.8, text/html;q=0.8": false,
+	} {
+		if got := prefersJSON(accept); got != want {
+			t.Errorf("prefersJSON(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestTransferTryFiles(t *testing.T) {
+	root := setupRoot(t)
+	if err := os.WriteFile(filepath.Join(root, "about.html"), []byte("about"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &config.ServeOptions{
+		Index:    []string{"index.html"},
+		Symlinks: config.SymlinksWithinRoot,
+		TryFiles: []string{"$uri", "$uri.html", "$uri/", "/index.html"},
+	}
+
+	tests := map[string]string{
+		"/app.css":        "body{}",
+		"/about":          "about",
+		"/docs/":          "<h1>docs</h1>",
+		"/users/42":       "<h1>home</h1>",
+		"/.env":           "<h1>home</h1>",
+		"/../secret.txt":  "<h1>home</h1>",
+		"/app.css/nested": "<h1>home</h1>",
+	}
+
+	for target, want := range tests {
+		w, err := transfer(root, target, options, nil)
+		if err != nil || w.Body.String() != want {
+			t.Errorf("Transfer(%s) = %v %q, want %q", target, err, w.Body.String(), want)
+		}
+	}
+
+	options.TryFiles = []string{"$uri", "=410"}
+	if _, err := transfer(root, "/gone", options, nil); err != StatusError(410) {
+		t.Errorf("Transfer(/gone) error = %v, want status 410", err)
+	}
+}
+
+func TestErrorDocument(t *testing.T) {
+	root := setupRoot(t)
+	if err := os.WriteFile(filepath.Join(root, "404.html"), []byte("<h1>missing</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &config.ServeOptions{
+		Symlinks:   config.SymlinksWithinRoot,
+		ErrorPages: map[string]string{"404": "/404.html", "500": "/500.html"},
+	}
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	w := httptest.NewRecorder()
+	if !ErrorDocument(http.StatusNotFound, root, options, w, r) {
+		t.Fatalf("ErrorDocument(404) = false, want true")
+	}
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>missing</h1>" {
+		t.Errorf("ErrorDocument(404) = %d %q", w.Code, w.Body.String())
+	}
+
+	if ErrorDocument(http.StatusInternalServerError, root, options, httptest.NewRecorder(), r) {
+		t.Errorf("ErrorDocument(500) = true for a missing page")
+	}
+}
+
+func TestTransferCached(t *testing.T) {
+	root := setupRoot(t)
+	cache, err := filecache.New(root, 1<<20, 1<<16, metrics.Labels{"test": t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	options := &config.ServeOptions{Symlinks: config.SymlinksFollow}
+
+	get := func(path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		if err := Transfer(path, root, options, cache, w, r); err != nil {
+			t.Fatalf("Transfer(%s) error = %v", path, err)
+		}
+		return w.Body.String()
+	}
+
+	if get("/inner.css") != "body{}" || cache.Get("/inner.css") == nil {
+		t.Errorf("symlink within the root not cached")
+	}
+
+	// The watcher can't see the target of escape.txt change.
+	if get("/escape.txt") != "secret" || cache.Get("/escape.txt") != nil {
+		t.Errorf("symlink out of the root cached")
+	}
+	os.WriteFile(filepath.Join(filepath.Dir(root), "secret.txt"), []byte("changed"), 0644)
+	if body := get("/escape.txt"); body != "changed" {
+		t.Errorf("symlink out of the root = %q after a change", body)
+	}
+}
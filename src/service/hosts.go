@@ -0,0 +1,154 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"roxy/src/config"
+	"roxy/src/httpcache"
+	"roxy/src/router"
+	"roxy/src/shedding"
+	"sort"
+)
+
+// VirtualHosts dispatches requests to the [`Roxy`] handler of the host they
+// are addressed to. A single listener can serve any number of hosts.
+type VirtualHosts struct {
+	hosts []*Roxy
+
+	// Host used when no names match, always present.
+	fallback *Roxy
+
+	// Certificates indexed like hosts, nil for hosts without TLS.
+	certificates []*tls.Certificate
+}
+
+// NewVirtualHosts builds the handler of every configured host and loads
+// their certificates.
+func NewVirtualHosts(config *config.Config) (*VirtualHosts, error) {
+	vhosts := &VirtualHosts{}
+
+	var shedder *shedding.Shedder
+	if config.Server.Shedding != nil {
+		shedder = shedding.New(config.Server.Shedding)
+	}
+
+	for i := range config.Hosts {
+		host := &config.Hosts[i]
+
+		roxy, err := NewRoxy(config, host)
+		if err != nil {
+			return nil, err
+		}
+		roxy.shedder = shedder
+
+		var certificate *tls.Certificate
+		if host.TLS != nil {
+			loaded, err := tls.LoadX509KeyPair(host.TLS.Cert, host.TLS.Key)
+			if err != nil {
+				return nil, fmt.Errorf("host %v: failed to load certificate: %w", host.Names, err)
+			}
+			certificate = &loaded
+		}
+
+		vhosts.hosts = append(vhosts.hosts, roxy)
+		vhosts.certificates = append(vhosts.certificates, certificate)
+		if host.Default {
+			vhosts.fallback = roxy
+		}
+	}
+
+	return vhosts, nil
+}
+
+// Lookup returns the index of the host that serves name. Exact names take
+// precedence over wildcards and the default host is used when nothing else
+// matches.
+func (vhosts *VirtualHosts) Lookup(name string) int {
+	wildcard := -1
+	for i, roxy := range vhosts.hosts {
+		for _, candidate := range roxy.Host.Names {
+			if !router.MatchHost([]string{candidate}, name) {
+				continue
+			}
+			if candidate[0] != '*' {
+				return i
+			}
+			if wildcard < 0 {
+				wildcard = i
+			}
+		}
+	}
+
+	if wildcard >= 0 {
+		return wildcard
+	}
+
+	for i, roxy := range vhosts.hosts {
+		if roxy == vhosts.fallback {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (vhosts *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vhosts.hosts[vhosts.Lookup(r.Host)].ServeHTTP(w, r)
+}
+
+// CachedRoute is a forward pattern with a response cache.
+type CachedRoute struct {
+	Host  string
+	Route string
+	Cache *httpcache.Cache
+}
+
+// ResponseCaches returns the response caches of every host, in the order of
+// the configuration.
+func (vhosts *VirtualHosts) ResponseCaches() []CachedRoute {
+	var routes []CachedRoute
+	for _, roxy := range vhosts.hosts {
+		indexes := make([]int, 0, len(roxy.responseCaches))
+		for index := range roxy.responseCaches {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+
+		for _, index := range indexes {
+			routes = append(routes, CachedRoute{
+				Host:  roxy.logName(),
+				Route: RouteName(&roxy.Host.Pattern[index]),
+				Cache: roxy.responseCaches[index],
+			})
+		}
+	}
+	return routes
+}
+
+// TLSConfig returns the configuration used by TLS listeners, which selects
+// the certificate of the host named by the client. It returns nil when no
+// host has a certificate.
+func (vhosts *VirtualHosts) TLSConfig() *tls.Config {
+	var fallback *tls.Certificate
+	for _, certificate := range vhosts.certificates {
+		if certificate != nil {
+			fallback = certificate
+			break
+		}
+	}
+
+	if fallback == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if certificate := vhosts.certificates[vhosts.Lookup(hello.ServerName)]; certificate != nil {
+				return certificate, nil
+			}
+			return fallback, nil
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"strconv"
+	"strings"
+)
+
+// RedirectToHTTPS answers requests received on a plaintext listener with a
+// redirect to the HTTPS equivalent URL. Requests for exempt paths, such as
+// ACME challenges or health checks, are passed to next.
+func RedirectToHTTPS(listen config.Listen, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range listen.Exempt {
+			if startsWith(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		host := r.Host
+		if name, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = name
+		}
+		host = strings.Trim(host, "[]")
+
+		if listen.HTTPSPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(listen.HTTPSPort))
+		} else if strings.Contains(host, ":") {
+			// IPv6 literal.
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of non idempotent requests.
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+
+		location := "https://" + host + r.URL.RequestURI()
+		copyResponse(w, new(local_http.LocalResponse).Redirect(status, location))
+	})
+}
+
+// StrictTransportSecurity adds the Strict-Transport-Security header described
+// by hsts to every response.
+func StrictTransportSecurity(hsts *config.HSTS, next http.Handler) http.Handler {
+	value := fmt.Sprintf("max-age=%d", hsts.MaxAge)
+	if hsts.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if hsts.Preload {
+		value += "; preload"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"roxy/src/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListingEntry describes a file of a directory listing.
+type ListingEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// Listing is the data rendered by directory listing templates.
+type Listing struct {
+	Path    string         `json:"path"`
+	Sort    string         `json:"sort"`
+	Order   string         `json:"order"`
+	Entries []ListingEntry `json:"entries"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>
+<th><a href="?sort=name&amp;order={{if and (eq .Sort "name") (eq .Order "asc")}}desc{{else}}asc{{end}}">Name</a></th>
+<th><a href="?sort=size&amp;order={{if and (eq .Sort "size") (eq .Order "asc")}}desc{{else}}asc{{end}}">Size</a></th>
+<th><a href="?sort=mtime&amp;order={{if and (eq .Sort "mtime") (eq .Order "asc")}}desc{{else}}asc{{end}}">Modified</a></th>
+</tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr>
+<td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td>
+<td class="size">{{if not .IsDir}}{{.Size}}{{end}}</td>
+<td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// listDirectory writes the listing of directory, which path maps to, as HTML
+// or JSON.
+func listDirectory(directory, path, root string, options *config.ServeOptions, w http.ResponseWriter, r *http.Request) error {
+	dirEntries, err := os.ReadDir(directory)
+	if err != nil {
+		return notFound(err)
+	}
+
+	listing := Listing{
+		Path:  r.URL.Path,
+		Sort:  options.BrowseSort,
+		Order: "asc",
+	}
+
+	query := r.URL.Query()
+	switch sortBy := query.Get("sort"); sortBy {
+	case "name", "size", "mtime":
+		listing.Sort = sortBy
+	}
+	if query.Get("order") == "desc" {
+		listing.Order = "desc"
+	}
+
+	for _, dirEntry := range dirEntries {
+		// Apply the dotfile and symlink policies to every entry, so that the
+		// listing only shows what can actually be downloaded.
+		_, info, err := resolveFile(pathpkg.Join(path, dirEntry.Name()), root, options)
+		if err != nil {
+			continue
+		}
+
+		link := (&url.URL{Path: dirEntry.Name()}).EscapedPath()
+		if info.IsDir() {
+			link += "/"
+		}
+
+		listing.Entries = append(listing.Entries, ListingEntry{
+			Name:    dirEntry.Name(),
+			URL:     link,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		})
+	}
+
+	sortListing(&listing)
+
+	// Render first so that nothing is written if the template fails.
+	var body bytes.Buffer
+	contentType := "text/html; charset=utf-8"
+
+	if prefersJSON(r.Header.Get("Accept")) {
+		contentType = "application/json"
+		err = json.NewEncoder(&body).Encode(listing)
+	} else {
+		tmpl := listingTemplate
+		if options.CompiledBrowseTemplate != nil {
+			tmpl = options.CompiledBrowseTemplate
+		}
+		err = tmpl.Execute(&body, listing)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body.Bytes())
+	}
+
+	return nil
+}
+
+// sortListing orders the entries of listing, directories always come first.
+func sortListing(listing *Listing) {
+	entries := listing.Entries
+	less := func(a, b ListingEntry) bool {
+		switch listing.Sort {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		if listing.Order == "desc" {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+// prefersJSON reports whether the Accept header ranks application/json above
+// text/html.
+func prefersJSON(accept string) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+
+	return jsonQ > 0 && jsonQ > htmlQ
+}
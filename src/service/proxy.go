@@ -13,17 +13,27 @@ import (
 )
 
 // Forward forwards the request to the target server and returns the response sent by the target server.
+// An error is returned when the target can't be reached, callers should answer with a Bad Gateway.
 func Forward(ctx context.Context, req *http.Request, targetAddr string) (*http.Response, error) {
 	conn, err := net.Dial("tcp", targetAddr)
 	if err != nil {
-		return new(local_http.LocalResponse).BadGateway(), nil
+		return nil, err
 	}
 	defer conn.Close()
 
-	client := &http.Client{}
+	req.URL.Scheme = "http"
+	req.URL.Host = targetAddr
+	req.RequestURI = ""
+
+	// Redirects are the client's business, they must reach it untouched.
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return new(local_http.LocalResponse).BadGateway(), nil
+		return nil, err
 	}
 
 	if resp.StatusCode == http.StatusSwitchingProtocols {
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"roxy/src/config"
+	local_http "roxy/src/server/http"
+	"strings"
+)
+
+// Redirect answers r with the redirection described by redirect.
+func Redirect(w http.ResponseWriter, r *http.Request, redirect *config.Redirect) {
+	copyResponse(w, new(local_http.LocalResponse).Redirect(redirect.Status, RedirectTarget(r, redirect)))
+}
+
+// Respond answers r with the fixed response described by respond.
+func Respond(w http.ResponseWriter, r *http.Request, respond *config.Respond) {
+	resp := new(local_http.LocalResponse).Static(respond.Status, respond.Headers, respond.Body)
+	if r.Method == http.MethodHead {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	}
+	copyResponse(w, resp)
+}
+
+// RedirectTarget expands the placeholders of the redirect target for r and
+// appends the request path and query if the redirect preserves them.
+func RedirectTarget(r *http.Request, redirect *config.Redirect) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	hostname := r.Host
+	if name, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = name
+	}
+
+	target := strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", r.Host,
+		"{hostname}", hostname,
+		"{path}", r.URL.EscapedPath(),
+		"{query}", r.URL.RawQuery,
+		"{uri}", r.URL.RequestURI(),
+	).Replace(redirect.To)
+
+	if redirect.PreservePath {
+		target = strings.TrimSuffix(target, "/") + r.URL.EscapedPath()
+	}
+
+	if redirect.PreserveQuery && r.URL.RawQuery != "" {
+		separator := "?"
+		if strings.Contains(target, "?") {
+			separator = "&"
+		}
+		target += separator + r.URL.RawQuery
+	}
+
+	return target
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"net/http"
+	"net/url"
+	"roxy/src/config"
+	"strings"
+)
+
+// RewritePath computes the path sent to the backend for a request matched
+// by pattern. The prefix is stripped first, then the regex rewrite runs and
+// finally the new prefix is added.
+func RewritePath(pattern *config.Pattern, path string) string {
+	if pattern.StripPrefix != "" && hasPathPrefix(path, pattern.StripPrefix) {
+		path = ensureLeadingSlash(path[len(pattern.StripPrefix):])
+	}
+
+	if pattern.Rewrite != nil && pattern.Rewrite.Compiled != nil {
+		path = pattern.Rewrite.Compiled.ReplaceAllString(path, pattern.Rewrite.Replacement)
+	}
+
+	if pattern.AddPrefix != "" {
+		path = strings.TrimSuffix(pattern.AddPrefix, "/") + ensureLeadingSlash(path)
+	}
+
+	return ensureLeadingSlash(path)
+}
+
+// unrewritePath maps a path produced by the backend back to the path the
+// client would use. Only the prefix operations can be reversed, regex
+// rewrites are left untouched.
+func unrewritePath(pattern *config.Pattern, path string) string {
+	if pattern.AddPrefix != "" {
+		prefix := strings.TrimSuffix(pattern.AddPrefix, "/")
+		if !hasPathPrefix(path, prefix) {
+			return path
+		}
+		path = ensureLeadingSlash(path[len(prefix):])
+	}
+
+	if pattern.StripPrefix != "" {
+		path = strings.TrimSuffix(pattern.StripPrefix, "/") + path
+	}
+
+	return path
+}
+
+// RewriteResponse rewrites the Location header and the Path attribute of
+// Set-Cookie headers sent by backend so that they keep working through the
+// proxy.
+func RewriteResponse(pattern *config.Pattern, req *http.Request, backend string, resp *http.Response) {
+	if pattern.RewriteLocation {
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", rewriteLocation(pattern, req, backend, location))
+		}
+	}
+
+	if pattern.RewriteCookiePath {
+		cookies := resp.Header.Values("Set-Cookie")
+		resp.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			resp.Header.Add("Set-Cookie", rewriteCookiePath(pattern, cookie))
+		}
+	}
+}
+
+func rewriteLocation(pattern *config.Pattern, req *http.Request, backend, location string) string {
+	target, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if target.IsAbs() {
+		// Only redirects pointing to the backend itself, by its address or
+		// by the Host of the forwarded request, are ours to rewrite.
+		if target.Host != backend && target.Host != req.Host {
+			return location
+		}
+		target.Host = req.Host
+		if req.TLS == nil {
+			target.Scheme = "http"
+		} else {
+			target.Scheme = "https"
+		}
+	} else if target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		return location
+	}
+
+	target.Path = unrewritePath(pattern, target.Path)
+	target.RawPath = ""
+
+	return target.String()
+}
+
+func rewriteCookiePath(pattern *config.Pattern, cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	for i, attribute := range attributes {
+		name, value, found := strings.Cut(strings.TrimSpace(attribute), "=")
+		if !found || !strings.EqualFold(name, "path") {
+			continue
+		}
+		attributes[i] = " Path=" + unrewritePath(pattern, value)
+	}
+
+	return strings.Join(attributes, ";")
+}
+
+// hasPathPrefix tells whether path starts with prefix at a segment
+// boundary, so that "/api" is a prefix of "/api/users" but not of "/apiary".
+func hasPathPrefix(path, prefix string) bool {
+	if !startsWith(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func ensureLeadingSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
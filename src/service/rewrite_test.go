@@ -0,0 +1,72 @@
+package service
+
+import (
+	"net/http"
+	"regexp"
+	"roxy/src/config"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	pattern := &config.Pattern{
+		URI:         "/api",
+		StripPrefix: "/api",
+		AddPrefix:   "/v2/",
+		Rewrite: &config.Rewrite{
+			Replacement: "/people/$1",
+			Compiled:    regexp.MustCompile(`^/users/(\d+)$`),
+		},
+	}
+
+	tests := map[string]string{
+		"/api":          "/v2/",
+		"/api/users/42": "/v2/people/42",
+		"/api/orders":   "/v2/orders",
+		"/apiary":       "/v2/apiary",
+	}
+
+	for path, want := range tests {
+		if got := RewritePath(pattern, path); got != want {
+			t.Errorf("RewritePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	pattern := &config.Pattern{
+		URI:               "/api",
+		StripPrefix:       "/api",
+		AddPrefix:         "/v2",
+		RewriteLocation:   true,
+		RewriteCookiePath: true,
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/api/login", nil)
+	resp := &http.Response{Header: http.Header{}}
+	// Backends build absolute redirects from the Host they receive, which
+	// is the one of the client.
+	resp.Header.Set("Location", "http://example.com/v2/home?x=1")
+	resp.Header.Add("Set-Cookie", "session=abc; Path=/v2/account; HttpOnly")
+
+	RewriteResponse(pattern, req, "127.0.0.1:8080", resp)
+
+	if got, want := resp.Header.Get("Location"), "http://example.com/api/home?x=1"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+
+	for location, want := range map[string]string{
+		"http://127.0.0.1:8080/v2/home": "http://example.com/api/home",
+		"https://other.com/v2/home":     "https://other.com/v2/home",
+		"/v2x/home":                     "/v2x/home",
+	} {
+		resp.Header.Set("Location", location)
+		RewriteResponse(pattern, req, "127.0.0.1:8080", resp)
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("Location %q rewritten to %q, want %q", location, got, want)
+		}
+	}
+
+	if got, want := resp.Header.Get("Set-Cookie"), "session=abc; Path=/api/account; HttpOnly"; got != want {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+}
@@ -1,58 +1,580 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"io/fs"
+	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
+	"roxy/src/access"
+	"roxy/src/concurrency"
 	"roxy/src/config"
+	"roxy/src/filecache"
+	"roxy/src/forwardauth"
+	"roxy/src/httpcache"
+	"roxy/src/jwt"
+	"roxy/src/metrics"
+	"roxy/src/oidc"
+	"roxy/src/ratelimit"
+	"roxy/src/router"
+	scheduler "roxy/src/sched"
+	local_http "roxy/src/server/http"
+	"roxy/src/shedding"
+	"roxy/src/waf"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Roxy handles the requests of a single virtual host.
 type Roxy struct {
-	Config     *config.Config
-	ClientAddr net.Addr
-	ServerAddr net.Addr
+	Config *config.Config
+	Host   *config.HostConfig
+
+	// Compiled [[match]] patterns of the host.
+	router *router.Router
+
+	// Load balancer of every forward pattern, indexed like Host.Pattern.
+	schedulers map[int]scheduler.Scheduler
+
+	// In-memory caches of the serve patterns that enable one, indexed like
+	// Host.Pattern.
+	fileCaches map[int]*filecache.Cache
+
+	// Response caches of the forward patterns that enable one, indexed like
+	// Host.Pattern.
+	responseCaches map[int]*httpcache.Cache
+
+	// Rate limiters of the patterns that enable one, indexed like
+	// Host.Pattern.
+	rateLimiters map[int]*ratelimit.Limiter
+
+	// Firewalls of the patterns that enable one, indexed like Host.Pattern.
+	firewalls map[int]*waf.Firewall
+
+	// Access control of the patterns that enable it, indexed like
+	// Host.Pattern.
+	access map[int]*access.Controller
+
+	// JWT validators of the patterns that enable one, indexed like
+	// Host.Pattern.
+	jwt map[int]*jwt.Validator
+
+	// OpenID Connect logins of the patterns that enable them, indexed like
+	// Host.Pattern.
+	oidc map[int]*oidc.Authenticator
+
+	// Forward authentication of the patterns that enable it, indexed like
+	// Host.Pattern.
+	forwardAuth map[int]*forwardauth.Authorizer
+
+	// Concurrency limiters of the forward patterns that enable one, indexed
+	// like Host.Pattern.
+	concurrency map[int]*concurrency.Limiter
+
+	// Load shedding shared by every host, nil if disabled.
+	shedder *shedding.Shedder
+
+	// Error page files indexed by status code.
+	errorPages map[int]string
+
+	// Access log of the host.
+	logger *config.CustomLogger
 }
 
-func NewRoxy(config *config.Config, clientAddr net.Addr, serverAddr net.Addr) *Roxy {
-	return &Roxy{
-		Config:     config,
-		ClientAddr: clientAddr,
-		ServerAddr: serverAddr,
+func NewRoxy(config *config.Config, host *config.HostConfig) (*Roxy, error) {
+	schedulers := make(map[int]scheduler.Scheduler)
+	for index, pattern := range host.Pattern {
+		if pattern.Action.Forward != nil {
+			schedulers[index] = scheduler.NewWeightedRoundRobin(pattern.Action.Forward.Backends)
+		}
+	}
+
+	fileCaches := make(map[int]*filecache.Cache)
+	for index, pattern := range host.Pattern {
+		if pattern.Action.Serve != nil && pattern.MemoryCache != nil {
+			labels := metrics.Labels{"host": host.LOGNAME, "route": RouteName(&pattern)}
+			cache, err := filecache.New(*pattern.Action.Serve, pattern.MemoryCache.MaxBytes, pattern.MemoryCache.MaxFileSize, labels)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: memory cache: %w", RouteName(&pattern), err)
+			}
+			fileCaches[index] = cache
+		}
+	}
+
+	responseCaches := make(map[int]*httpcache.Cache)
+	for index, pattern := range host.Pattern {
+		if pattern.Action.Forward != nil && pattern.Cache != nil {
+			labels := metrics.Labels{"host": host.LOGNAME, "route": RouteName(&pattern)}
+			cache, err := httpcache.New(pattern.Cache, labels)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: cache: %w", RouteName(&pattern), err)
+			}
+			responseCaches[index] = cache
+		}
+	}
+
+	rateLimiters := make(map[int]*ratelimit.Limiter)
+	for index, pattern := range host.Pattern {
+		if pattern.RateLimit != nil {
+			labels := metrics.Labels{"host": host.LOGNAME, "route": RouteName(&pattern)}
+			limiter, err := ratelimit.New(pattern.RateLimit, labels)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: %w", RouteName(&pattern), err)
+			}
+			rateLimiters[index] = limiter
+		}
+	}
+
+	firewalls := make(map[int]*waf.Firewall)
+	for index, pattern := range host.Pattern {
+		if pattern.WAF != nil {
+			firewall, err := waf.New(pattern.WAF)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: waf: %w", RouteName(&pattern), err)
+			}
+			firewalls[index] = firewall
+		}
+	}
+
+	accessControllers := make(map[int]*access.Controller)
+	for index, pattern := range host.Pattern {
+		if pattern.Access != nil {
+			controller, err := access.New(pattern.Access)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: access: %w", RouteName(&pattern), err)
+			}
+			accessControllers[index] = controller
+		}
+	}
+
+	validators := make(map[int]*jwt.Validator)
+	for index, pattern := range host.Pattern {
+		if pattern.JWT != nil {
+			validator, err := jwt.New(pattern.JWT)
+			if err != nil {
+				return nil, fmt.Errorf("match %q: jwt: %w", RouteName(&pattern), err)
+			}
+			validators[index] = validator
+		}
+	}
+
+	authenticators := make(map[int]*oidc.Authenticator)
+	for index, pattern := range host.Pattern {
+		if pattern.OIDC != nil {
+			authenticators[index] = oidc.New(pattern.OIDC)
+		}
+	}
+
+	authorizers := make(map[int]*forwardauth.Authorizer)
+	for index, pattern := range host.Pattern {
+		if pattern.ForwardAuth != nil {
+			authorizers[index] = forwardauth.New(pattern.ForwardAuth)
+		}
+	}
+
+	concurrencyLimiters := make(map[int]*concurrency.Limiter)
+	for index, pattern := range host.Pattern {
+		if pattern.Action.Forward != nil && pattern.Concurrency != nil {
+			labels := metrics.Labels{"host": host.LOGNAME, "route": RouteName(&pattern)}
+			concurrencyLimiters[index] = concurrency.New(pattern.Concurrency, labels)
+		}
+	}
+
+	errorPages := make(map[int]string)
+	for status, file := range host.ErrorPages {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page status %q: %w", status, err)
+		}
+		errorPages[code] = file
+	}
+
+	logger, err := openAccessLog(host.LOGFILE)
+	if err != nil {
+		return nil, err
+	}
+
+	roxy := &Roxy{
+		Config:         config,
+		Host:           host,
+		router:         router.New(host.Pattern),
+		schedulers:     schedulers,
+		fileCaches:     fileCaches,
+		responseCaches: responseCaches,
+		rateLimiters:   rateLimiters,
+		firewalls:      firewalls,
+		access:         accessControllers,
+		jwt:            validators,
+		oidc:           authenticators,
+		forwardAuth:    authorizers,
+		concurrency:    concurrencyLimiters,
+		errorPages:     errorPages,
+		logger:         logger,
+	}
+	for _, cache := range responseCaches {
+		cache.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> Response cache: %v", roxy.logName(), err))
+		}
+	}
+	for _, limiter := range rateLimiters {
+		limiter.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> Rate limit: %v", roxy.logName(), err))
+		}
+	}
+	for _, firewall := range firewalls {
+		firewall.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> WAF: %v", roxy.logName(), err))
+		}
+	}
+	for _, controller := range accessControllers {
+		controller.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> Access: %v", roxy.logName(), err))
+		}
+	}
+	for _, validator := range validators {
+		validator.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> JWT: %v", roxy.logName(), err))
+		}
 	}
+	for _, authenticator := range authenticators {
+		authenticator.ErrorLog = func(err error) {
+			roxy.logger.Error(fmt.Sprintf("%s -> OIDC: %v", roxy.logName(), err))
+		}
+	}
+
+	return roxy, nil
 }
 
-func (roxy *Roxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (roxy *Roxy) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	uri := r.RequestURI
 	method := r.Method
+	w := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+
+	route := roxy.router.Match(r)
+	if route == nil {
+		roxy.sendLocal(w, new(local_http.LocalResponse).NotFound())
+		roxy.logRequest(method, uri, w.status, start)
+		return
+	}
 
-	var matchedPattern *config.Pattern
-	for _, pattern := range roxy.Config.Pattern {
-		if startsWith(uri, pattern.URI) {
-			matchedPattern = &pattern
-			break
+	matchedPattern := route.Pattern
+
+	clientIP := ClientIP(r, roxy.Config.Server.TrustedNetworks)
+
+	// Before the authentication checks, which preflight requests carry no
+	// credentials for and whose refusals scripts must be able to read.
+	if policy := matchedPattern.CORS; policy != nil {
+		if IsPreflight(r) {
+			if !Preflight(w, r, policy) {
+				roxy.sendLocal(w, new(local_http.LocalResponse).Forbidden())
+			}
+			roxy.logRequest(method, uri, w.status, start)
+			return
 		}
+		w.ResponseWriter = NewCORSWriter(w.ResponseWriter, r.Header.Get("Origin"), policy)
 	}
 
-	switch matchedPattern.Action.Type {
-	case "forward":
-		targetAddr := matchedPattern.URI
-		req := r.Clone(context.Background())
-		resp, err := Forward(req.Context(), req, targetAddr)
+	// Limits keyed by a claim wait for the JWT check to verify the token.
+	limiter := roxy.rateLimiters[route.Index]
+	if limiter != nil && !limiter.ByClaim() && !roxy.allowRate(w, r, limiter, clientIP) {
+		roxy.logRequest(method, uri, w.status, start)
+		return
+	}
+
+	// The original writer closes the connection once the limit is reached.
+	if matchedPattern.MaxBodySize > 0 && !LimitBody(writer, r, matchedPattern.MaxBodySize) {
+		roxy.sendLocal(w, new(local_http.LocalResponse).Error(http.StatusRequestEntityTooLarge))
+		roxy.logRequest(method, uri, w.status, start)
+		return
+	}
+
+	// Rules matched by the request, logged with it.
+	var wafMatches []string
+	if firewall := roxy.firewalls[route.Index]; firewall != nil {
+		verdict, err := firewall.Inspect(r)
+		wafMatches = verdict.Matches
+		if err != nil || verdict.Status != 0 {
+			status := verdict.Status
+			switch {
+			case BodyTooLarge(err):
+				status = http.StatusRequestEntityTooLarge
+			case err != nil:
+				status = http.StatusBadRequest
+			}
+			roxy.sendLocal(w, new(local_http.LocalResponse).Error(status))
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+	}
+
+	if controller := roxy.access[route.Index]; controller != nil {
+		if refusal := controller.Check(r, clientIP); refusal != nil {
+			roxy.sendLocal(w, refusal)
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+	}
+
+	if validator := roxy.jwt[route.Index]; validator != nil {
+		claims, refusal := validator.Check(r)
+		if refusal != nil {
+			roxy.sendLocal(w, refusal)
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+		r = r.WithContext(jwt.NewContext(r.Context(), claims))
+	}
+
+	if limiter != nil && limiter.ByClaim() && !roxy.allowRate(w, r, limiter, clientIP) {
+		roxy.logRequest(method, uri, w.status, start, wafMatches...)
+		return
+	}
+
+	if authenticator := roxy.oidc[route.Index]; authenticator != nil {
+		resp, err := authenticator.Check(w, r)
+		if err != nil {
+			roxy.logger.Error(fmt.Sprintf("%s -> OIDC: %v", roxy.logName(), err))
+			roxy.sendLocal(w, new(local_http.LocalResponse).BadGateway())
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+		if resp != nil {
+			roxy.sendLocal(w, resp)
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+	}
+
+	if authorizer := roxy.forwardAuth[route.Index]; authorizer != nil {
+		denial, err := authorizer.Check(r, clientIP)
+		if err != nil {
+			roxy.logger.Error(fmt.Sprintf("%s -> Forward auth: %v", roxy.logName(), err))
+			roxy.sendLocal(w, new(local_http.LocalResponse).BadGateway())
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+		if denial != nil {
+			copyResponse(w, denial)
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+	}
+
+	// Before taking a load shedding slot, held for as long as slow uploads
+	// would otherwise last.
+	if buffering := matchedPattern.RequestBuffering; buffering != nil {
+		release, err := BufferBody(r, buffering)
+		if err != nil {
+			var fileErr *fs.PathError
+			status := http.StatusBadRequest
+			switch {
+			case BodyTooLarge(err):
+				status = http.StatusRequestEntityTooLarge
+			case errors.As(err, &fileErr):
+				roxy.logger.Error(fmt.Sprintf("%s -> Request buffering: %v", roxy.logName(), err))
+				status = http.StatusInternalServerError
+			}
+			roxy.sendLocal(w, new(local_http.LocalResponse).Error(status))
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
+			return
+		}
+		defer release()
+	}
+
+	if roxy.shedder != nil {
+		tier, key := roxy.shedder.Classify(r, matchedPattern.Tier, clientIP)
+		release, err := roxy.shedder.Acquire(r.Context(), tier, key)
 		if err != nil {
-			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			roxy.sendLocal(w, new(local_http.LocalResponse).Error(http.StatusServiceUnavailable))
+			roxy.logRequest(method, uri, w.status, start, wafMatches...)
 			return
 		}
-		copyResponse(w, resp)
-	case "serve":
-		// Implement file serving logic here if necessary
-		http.ServeFile(w, r, *matchedPattern.Action.Serve)
+		defer release()
+	}
+
+	if matchedPattern.Compress != nil && method != http.MethodHead {
+		encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"), matchedPattern.Compress.Algorithms)
+		compressor := NewCompressWriter(w.ResponseWriter, encoding, matchedPattern.Compress)
+		defer compressor.Close()
+		w.ResponseWriter = compressor
+	}
+
+	switch matchedPattern.Action.Type {
+	case config.ForwardAction:
+		var err error
+		if cache := roxy.responseCaches[route.Index]; cache != nil {
+			err = cache.Serve(w, r, func(req *http.Request) (*http.Response, error) {
+				return roxy.forward(route, req)
+			})
+		} else {
+			var resp *http.Response
+			if resp, err = roxy.forward(route, r); err == nil {
+				copyResponse(w, resp)
+			}
+		}
+		switch {
+		case BodyTooLarge(err):
+			roxy.sendLocal(w, new(local_http.LocalResponse).Error(http.StatusRequestEntityTooLarge))
+		case errors.Is(err, concurrency.ErrLimited):
+			roxy.sendLocal(w, new(local_http.LocalResponse).Error(http.StatusServiceUnavailable))
+		case err != nil:
+			roxy.sendLocal(w, new(local_http.LocalResponse).BadGateway())
+		}
+	case config.ServeAction:
+		roxy.serve(w, r, route)
+	case config.RedirectAction:
+		Redirect(w, r, matchedPattern.Action.Redirect)
+	case config.RespondAction:
+		Respond(w, r, matchedPattern.Action.Respond)
+	}
+
+	roxy.logRequest(method, uri, w.status, start, wafMatches...)
+}
+
+// forward sends r to the next backend of the pattern of route and returns
+// the response to send back to the client.
+func (roxy *Roxy) forward(route *router.Route, r *http.Request) (*http.Response, error) {
+	pattern := route.Pattern
+	targetAddr := roxy.schedulers[route.Index].NextServer().String()
+
+	// Tunnels would hold a slot for as long as they are open.
+	var slot *concurrency.Slot
+	if limiter := roxy.concurrency[route.Index]; limiter != nil && r.Header.Get("Upgrade") == "" {
+		var err error
+		if slot, err = limiter.Acquire(r.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	req := r.Clone(r.Context())
+	req.URL.Path = RewritePath(pattern, r.URL.Path)
+	req.URL.RawPath = ""
+	resp, err := Forward(req.Context(), req, targetAddr)
+	if err != nil {
+		if slot != nil {
+			// A client going away tells nothing about the backend.
+			if !errors.Is(err, context.Canceled) {
+				slot.Done(true)
+			}
+			slot.Release()
+		}
+		return nil, err
+	}
+
+	if slot != nil {
+		slot.Done(resp.StatusCode == http.StatusServiceUnavailable)
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: slot.Release}
+	}
+
+	RewriteResponse(pattern, r, targetAddr, resp)
+	return resp, nil
+}
+
+// releaseBody calls release once the body of a response is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// serve answers r with the files of a serve pattern, falling back to the
+// error documents of the pattern and then to those of the host.
+func (roxy *Roxy) serve(w http.ResponseWriter, r *http.Request, route *router.Route) {
+	pattern := route.Pattern
+	root := *pattern.Action.Serve
+	path := RewritePath(pattern, r.URL.Path)
+
+	err := Transfer(path, root, &pattern.ServeOptions, roxy.fileCaches[route.Index], w, r)
+	if err == nil {
+		return
+	}
+
+	status := http.StatusNotFound
+	var statusErr StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		status = int(statusErr)
+	case !errors.Is(err, ErrNotFound):
+		roxy.logger.Error(fmt.Sprintf("%s -> Serving %s: %v", roxy.logName(), path, err))
+		status = http.StatusInternalServerError
+	}
+
+	if ErrorDocument(status, root, &pattern.ServeOptions, w, r) {
+		return
+	}
+
+	if status == http.StatusNotFound {
+		roxy.sendLocal(w, new(local_http.LocalResponse).NotFound())
+	} else {
+		roxy.sendLocal(w, new(local_http.LocalResponse).Error(status))
+	}
+}
+
+// allowRate counts r against limiter and answers it with 429 Too Many
+// Requests when its client is over the limit. It tells whether r may go on.
+func (roxy *Roxy) allowRate(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, clientIP string) bool {
+	decision := limiter.Allow(r, clientIP)
+	decision.SetHeaders(w.Header())
+	if !decision.Allowed {
+		roxy.sendLocal(w, new(local_http.LocalResponse).Error(http.StatusTooManyRequests))
+	}
+	return decision.Allowed
+}
+
+// sendLocal writes a response generated by roxy, replacing its body with the
+// error page configured for its status code if there is one.
+func (roxy *Roxy) sendLocal(w http.ResponseWriter, resp *http.Response) {
+	if file, ok := roxy.errorPages[resp.StatusCode]; ok {
+		if page, err := os.ReadFile(file); err == nil {
+			contentType := mime.TypeByExtension(filepath.Ext(file))
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+			resp.Body.Close()
+			resp.Header.Set("Content-Type", contentType)
+			resp.Body = io.NopCloser(bytes.NewReader(page))
+		} else {
+			roxy.logger.Warn(fmt.Sprintf("%s -> Error page %s: %v", roxy.logName(), file, err))
+		}
 	}
 
-	logRequest(roxy.Config.Server.LOGNAME, method, uri, w, start)
+	copyResponse(w, resp)
+}
+
+// statusRecorder remembers the status code written to the client so that it
+// can be logged.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// RouteName identifies pattern in logs and metrics.
+func RouteName(pattern *config.Pattern) string {
+	switch {
+	case pattern.PathRegex != "":
+		return pattern.PathRegex
+	case pattern.Path != "":
+		return pattern.Path
+	}
+	return pattern.URI
 }
 
 func startsWith(str, prefix string) bool {
@@ -70,8 +592,30 @@ func copyResponse(w http.ResponseWriter, resp *http.Response) {
 	resp.Body.Close()
 }
 
-func logRequest(logName, method, uri string, w http.ResponseWriter, start time.Time) {
-	status := w.Header().Get("Status")
+// openAccessLog returns a logger writing to logFile, or only to stdout when
+// logFile is empty.
+func openAccessLog(logFile string) (*config.CustomLogger, error) {
+	if logFile == "" {
+		return config.NewLogger(os.Stdout, "", log.LstdFlags), nil
+	}
+	return config.SetupLogger(logFile)
+}
+
+func (roxy *Roxy) logName() string {
+	if roxy.Host.LOGNAME != "" {
+		return roxy.Host.LOGNAME
+	}
+	return "roxy"
+}
+
+// logRequest logs a handled request. Requests that matched WAF rules are
+// logged as warnings, followed by the rules.
+func (roxy *Roxy) logRequest(method, uri string, status int, start time.Time, wafMatches ...string) {
 	elapsed := time.Since(start)
-	fmt.Printf("%s -> %s %s %s HTTP %s %v\n", logName, method, uri, status, elapsed)
+	line := fmt.Sprintf("%s -> %s %s HTTP %d %v", roxy.logName(), method, uri, status, elapsed)
+	if len(wafMatches) > 0 {
+		roxy.logger.Warn(line + " WAF " + strings.Join(wafMatches, ", "))
+		return
+	}
+	roxy.logger.Info(line)
 }
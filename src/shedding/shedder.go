@@ -0,0 +1,287 @@
+// Package shedding bounds the requests handled at once, queuing the excess
+// by priority tier and fairly between clients, and shedding low priority
+// requests first when the queue is full.
+package shedding
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	"roxy/src/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrShed is returned by [`Shedder.Acquire`] for requests dropped from a
+// full queue or that waited too long.
+var ErrShed = errors.New("request shed")
+
+// Tier ranks requests, higher tiers are admitted first and shed last.
+type Tier int
+
+// ParseTier returns the tier named name, one of [`config.Tiers`].
+func ParseTier(name string) Tier {
+	return Tier(max(0, slices.Index(config.Tiers, name)))
+}
+
+func (t Tier) String() string {
+	return config.Tiers[t]
+}
+
+// Shedder is the request granularity counterpart of the connection
+// semaphore of the servers: at most max requests are handled at once and
+// the others wait in per tier queues. A tier queue holds a FIFO per client
+// and serves clients in turns.
+type Shedder struct {
+	options     *config.LoadShedding
+	defaultTier Tier
+	keyKind     string
+	keyName     string
+
+	max          int
+	queueSize    int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	inflight int
+	queued   int
+	tiers    []*tierQueue
+
+	// Requests shed, by tier.
+	Shed []*metrics.Counter
+}
+
+// tierQueue holds the waiting requests of a tier.
+type tierQueue struct {
+	clients map[string]*clientQueue
+	// Keys of the clients with waiting requests, the next one to be served
+	// at the front.
+	turns *list.List
+}
+
+type clientQueue struct {
+	requests *list.List
+	turn     *list.Element
+}
+
+// waiter is a queued request.
+type waiter struct {
+	tier    Tier
+	key     string
+	element *list.Element
+
+	// Closed once the request is admitted or shed.
+	ready    chan struct{}
+	admitted bool
+}
+
+func New(options *config.LoadShedding) *Shedder {
+	shedder := &Shedder{
+		options:      options,
+		defaultTier:  ParseTier(options.DefaultTier),
+		max:          options.MaxRequests,
+		queueSize:    options.QueueSize,
+		queueTimeout: time.Duration(options.QueueTimeout) * time.Millisecond,
+	}
+	shedder.keyKind, shedder.keyName, _ = strings.Cut(options.Key, ":")
+
+	for _, name := range config.Tiers {
+		shedder.tiers = append(shedder.tiers, &tierQueue{clients: make(map[string]*clientQueue), turns: list.New()})
+		shedder.Shed = append(shedder.Shed, metrics.Default.Counter("roxy_shed_total", "Requests shed by load shedding.", metrics.Labels{"tier": name}))
+	}
+
+	metrics.Default.GaugeFunc("roxy_shedding_in_flight", "Requests handled under load shedding.", nil, func() float64 {
+		shedder.mu.Lock()
+		defer shedder.mu.Unlock()
+		return float64(shedder.inflight)
+	})
+	metrics.Default.GaugeFunc("roxy_shedding_queued", "Requests waiting under load shedding.", nil, func() float64 {
+		shedder.mu.Lock()
+		defer shedder.mu.Unlock()
+		return float64(shedder.queued)
+	})
+
+	return shedder
+}
+
+// Classify returns the tier of r, sent by clientIP to a route of tier
+// routeTier (empty if the route has none), and the key of its client.
+func (s *Shedder) Classify(r *http.Request, routeTier string, clientIP string) (Tier, string) {
+	tier := s.defaultTier
+	if routeTier != "" {
+		tier = ParseTier(routeTier)
+	}
+	for _, rule := range s.options.Rules {
+		if matches(&rule, r, clientIP) {
+			tier = ParseTier(rule.Tier)
+			break
+		}
+	}
+
+	key := clientIP
+	switch s.keyKind {
+	case "header":
+		if value := r.Header.Get(s.keyName); value != "" {
+			key = "header:" + value
+		}
+	case "jwt":
+		// Routes without a JWT check have no verified claims, their
+		// clients are told apart by address.
+		if value, ok := jwt.Claim(r.Context(), s.keyName); ok {
+			key = "jwt:" + value
+		}
+	}
+
+	return tier, key
+}
+
+func matches(rule *config.TierRule, r *http.Request, clientIP string) bool {
+	if rule.Header != "" {
+		values := r.Header.Values(rule.Header)
+		if len(values) == 0 || (rule.Value != "" && !slices.Contains(values, rule.Value)) {
+			return false
+		}
+	}
+	if len(rule.ClientNetworks) > 0 {
+		ip := net.ParseIP(clientIP)
+		if ip == nil || !slices.ContainsFunc(rule.ClientNetworks, func(network *net.IPNet) bool {
+			return network.Contains(ip)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Acquire admits a request of tier sent by the client key, waiting in the
+// queue if max requests are already handled. The returned function must be
+// called once the request is over. It fails with ErrShed if the request is
+// dropped or waits too long, and with the error of ctx if it is done first.
+func (s *Shedder) Acquire(ctx context.Context, tier Tier, key string) (func(), error) {
+	s.mu.Lock()
+	if s.queued == 0 && s.inflight < s.max {
+		s.inflight++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+
+	if s.queued >= s.queueSize {
+		victim := s.victim(tier)
+		if victim == nil {
+			s.mu.Unlock()
+			s.Shed[tier].Inc()
+			return nil, ErrShed
+		}
+		s.remove(victim)
+		close(victim.ready)
+	}
+
+	w := &waiter{tier: tier, key: key, ready: make(chan struct{})}
+	s.push(w)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.admitted {
+		return s.release, nil
+	}
+	select {
+	case <-w.ready:
+		// Dropped for a request of a higher tier.
+	default:
+		s.remove(w)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	s.Shed[tier].Inc()
+	return nil, ErrShed
+}
+
+func (s *Shedder) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight--
+	for s.inflight < s.max && s.queued > 0 {
+		w := s.next()
+		s.remove(w)
+		w.admitted = true
+		s.inflight++
+		close(w.ready)
+	}
+}
+
+// push queues w behind the other requests of its client, s.mu must be
+// held.
+func (s *Shedder) push(w *waiter) {
+	queue := s.tiers[w.tier]
+	client, ok := queue.clients[w.key]
+	if !ok {
+		client = &clientQueue{requests: list.New(), turn: queue.turns.PushBack(w.key)}
+		queue.clients[w.key] = client
+	}
+	w.element = client.requests.PushBack(w)
+	s.queued++
+}
+
+// remove takes w out of the queue, s.mu must be held.
+func (s *Shedder) remove(w *waiter) {
+	queue := s.tiers[w.tier]
+	client := queue.clients[w.key]
+	client.requests.Remove(w.element)
+	if client.requests.Len() == 0 {
+		queue.turns.Remove(client.turn)
+		delete(queue.clients, w.key)
+	}
+	s.queued--
+}
+
+// next returns the request to admit: the oldest one of the client whose
+// turn it is in the highest tier with waiting requests. s.mu must be held
+// and the queue not empty.
+func (s *Shedder) next() *waiter {
+	for tier := len(s.tiers) - 1; ; tier-- {
+		queue := s.tiers[tier]
+		if queue.turns.Len() == 0 {
+			continue
+		}
+		turn := queue.turns.Front()
+		queue.turns.MoveToBack(turn)
+		return queue.clients[turn.Value.(string)].requests.Front().Value.(*waiter)
+	}
+}
+
+// victim returns the request to drop in favor of a request of tier: the
+// newest one of the client with the most waiting requests in the lowest
+// tier below tier, nil if there is none. s.mu must be held.
+func (s *Shedder) victim(tier Tier) *waiter {
+	for lower := Tier(0); lower < tier; lower++ {
+		var longest *clientQueue
+		for _, client := range s.tiers[lower].clients {
+			if longest == nil || client.requests.Len() > longest.requests.Len() {
+				longest = client
+			}
+		}
+		if longest != nil {
+			return longest.requests.Back().Value.(*waiter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package shedding
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"roxy/src/config"
+	"roxy/src/jwt"
+	"testing"
+	"time"
+)
+
+// queued waits until n requests are queued.
+func queued(t *testing.T, s *Shedder, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		current := s.queued
+		s.mu.Unlock()
+		if current == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", current, n)
+		}
+	}
+}
+
+type outcome struct {
+	name string
+	err  error
+}
+
+// enqueue starts a request and reports its outcome on done, releasing it
+// once reported when admitted.
+func enqueue(s *Shedder, tier Tier, key, name string, done chan<- outcome) {
+	go func() {
+		release, err := s.Acquire(context.Background(), tier, key)
+		done <- outcome{name, err}
+		if err == nil {
+			release()
+		}
+	}()
+}
+
+func TestShedderOrder(t *testing.T) {
+	s := New(&config.LoadShedding{MaxRequests: 1, QueueSize: 10, QueueTimeout: 5000})
+
+	release, err := s.Acquire(context.Background(), ParseTier("normal"), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client a floods the normal tier before b and a high tier request.
+	done := make(chan outcome)
+	for i, name := range []string{"a1", "a2", "a3"} {
+		enqueue(s, ParseTier("normal"), "a", name, done)
+		queued(t, s, i+1)
+	}
+	enqueue(s, ParseTier("normal"), "b", "b1", done)
+	queued(t, s, 4)
+	enqueue(s, ParseTier("high"), "c", "c1", done)
+	queued(t, s, 5)
+
+	release()
+
+	var order []string
+	for range 5 {
+		order = append(order, (<-done).name)
+	}
+	want := []string{"c1", "a1", "b1", "a2", "a3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("admission order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestShedderDropsLowerTiers(t *testing.T) {
+	s := New(&config.LoadShedding{MaxRequests: 1, QueueSize: 2, QueueTimeout: 5000})
+
+	release, _ := s.Acquire(context.Background(), ParseTier("normal"), "x")
+
+	done := make(chan outcome)
+	enqueue(s, ParseTier("low"), "a", "a1", done)
+	queued(t, s, 1)
+	enqueue(s, ParseTier("low"), "a", "a2", done)
+	queued(t, s, 2)
+
+	// The newest request of the lowest tier makes room.
+	enqueue(s, ParseTier("high"), "b", "b1", done)
+	if result := <-done; result.name != "a2" || !errors.Is(result.err, ErrShed) {
+		t.Fatalf("dropped %s (%v), want a2", result.name, result.err)
+	}
+
+	// Nothing is lower than a new low tier request, it is the one shed.
+	if _, err := s.Acquire(context.Background(), ParseTier("low"), "c"); !errors.Is(err, ErrShed) {
+		t.Fatalf("request over a full queue: %v", err)
+	}
+
+	release()
+	for range 2 {
+		if result := <-done; result.err != nil {
+			t.Errorf("%s: %v", result.name, result.err)
+		}
+	}
+}
+
+func TestShedderClassify(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	s := New(&config.LoadShedding{
+		MaxRequests: 1,
+		Key:         "header:X-Tenant",
+		DefaultTier: "normal",
+		Rules: []config.TierRule{
+			{Header: "X-Priority", Value: "batch", Tier: "low"},
+			{ClientNetworks: []*net.IPNet{internal}, Tier: "critical"},
+		},
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if tier, key := s.Classify(r, "", "192.0.2.1"); tier.String() != "normal" || key != "192.0.2.1" {
+		t.Errorf("default: %v %q", tier, key)
+	}
+	if tier, _ := s.Classify(r, "high", "192.0.2.1"); tier.String() != "high" {
+		t.Errorf("route tier: %v", tier)
+	}
+	if tier, _ := s.Classify(r, "high", "10.1.2.3"); tier.String() != "critical" {
+		t.Errorf("client rule: %v", tier)
+	}
+
+	r.Header.Set("X-Priority", "batch")
+	r.Header.Set("X-Tenant", "acme")
+	if tier, key := s.Classify(r, "high", "10.1.2.3"); tier.String() != "low" || key != "header:acme" {
+		t.Errorf("header rule: %v %q", tier, key)
+	}
+
+	// Claims only identify clients once the JWT check verified them.
+	s.keyKind, s.keyName = "jwt", "sub"
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer e30."+base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"forged"}`))+".c2ln")
+	if _, key := s.Classify(r, "", "192.0.2.1"); key != "192.0.2.1" {
+		t.Errorf("unverified token: %q", key)
+	}
+	r = r.WithContext(jwt.NewContext(r.Context(), map[string]any{"sub": "alice"}))
+	if _, key := s.Classify(r, "", "192.0.2.1"); key != "jwt:alice" {
+		t.Errorf("verified token: %q", key)
+	}
+}
@@ -42,7 +42,7 @@ func (n *Notifier) Subscribe() *Subscription {
 
 	id := uuid.New().String()
 	notificationChannel := make(chan Notification, 1)
-	acknowledgeChannel := make(chan struct{})
+	acknowledgeChannel := make(chan struct{}, 1)
 
 	n.subscribers[id] = notificationChannel
 	n.acknowledgements[id] = acknowledgeChannel
@@ -69,17 +69,42 @@ func (n *Notifier) Send(notification Notification) int {
 }
 
 // CollectAcknowledgements waits for all subscribers to acknowledge the last notification.
+// The lock is not held while waiting so that subscribers can still unsubscribe.
 func (n *Notifier) CollectAcknowledgements() {
 	n.mu.Lock()
-	defer n.mu.Unlock()
+	pending := n.acknowledgements
+	n.subscribers = make(map[string]chan Notification)
+	n.acknowledgements = make(map[string]chan struct{})
+	n.mu.Unlock()
 
-	for id, ackCh := range n.acknowledgements {
+	for _, ackCh := range pending {
 		<-ackCh
-		delete(n.acknowledgements, id)
-		delete(n.subscribers, id)
 	}
 }
 
+// Unsubscribe removes the Subscription from its Notifier. If a notification
+// was already sent but not received, it is acknowledged instead so that
+// CollectAcknowledgements doesn't wait forever.
+func (s *Subscription) Unsubscribe() {
+	n := s.notifier
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(s.notificationChannel) > 0 {
+		s.AcknowledgeNotification()
+		return
+	}
+
+	delete(n.subscribers, s.id)
+	delete(n.acknowledgements, s.id)
+}
+
+// Notifications returns the channel where notifications are delivered, to be
+// used in select statements.
+func (s *Subscription) Notifications() <-chan Notification {
+	return s.notificationChannel
+}
+
 // ReceiveNotification reads the notifications channel for a Subscription
 func (s *Subscription) ReceiveNotification() (Notification, bool) {
 	notification, ok := <-s.notificationChannel
@@ -0,0 +1,84 @@
+package waf
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// request holds the inspected parts of a request.
+type request struct {
+	r *http.Request
+	// Start of the body, up to the body limit.
+	body []byte
+
+	path  []string
+	query []string
+}
+
+func newRequest(r *http.Request, body []byte) *request {
+	return &request{
+		r:     r,
+		body:  body,
+		path:  decoded(r.URL.EscapedPath(), url.PathUnescape),
+		query: decoded(r.URL.RawQuery, url.QueryUnescape),
+	}
+}
+
+// values returns the values of a target.
+func (req *request) values(target string) []string {
+	switch target {
+	case "method":
+		return []string{req.r.Method}
+	case "path":
+		return req.path
+	case "query":
+		return req.query
+	case "headers":
+		var values []string
+		for name, fields := range req.r.Header {
+			for _, field := range fields {
+				values = append(values, name+": "+field)
+			}
+		}
+		return values
+	case "body":
+		if len(req.body) == 0 {
+			return nil
+		}
+		values := []string{string(req.body)}
+		if strings.HasPrefix(req.r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			values = decoded(string(req.body), url.QueryUnescape)
+		}
+		return values
+	}
+	return req.r.Header.Values(strings.TrimPrefix(target, "header:"))
+}
+
+// size returns the length in bytes of a target, the longest value when it
+// has several.
+func (req *request) size(target string) int {
+	if target == "body" && req.r.ContentLength > int64(len(req.body)) {
+		return int(req.r.ContentLength)
+	}
+	longest := 0
+	for _, value := range req.values(target) {
+		longest = max(longest, len(value))
+	}
+	return longest
+}
+
+// decoded returns value and its URL decoded forms, decoded once and twice
+// to see through double encoding.
+func decoded(value string, unescape func(string) (string, error)) []string {
+	values := []string{value}
+	for range 2 {
+		next, err := unescape(values[len(values)-1])
+		if err != nil || slices.Contains(values, next) {
+			break
+		}
+		values = append(values, next)
+	}
+	return values
+}
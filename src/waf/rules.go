@@ -0,0 +1,150 @@
+package waf
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rule is a firewall rule, as written in the [[rule]] tables of rule files.
+type Rule struct {
+	ID string `toml:"id"`
+
+	// Parts of the request inspected: method, path, query, headers,
+	// header:<name> or body. Path and query are also inspected URL decoded,
+	// once and twice.
+	Targets []string `toml:"targets"`
+
+	// Predicates, all of which must hold for one of the inspected values: a
+	// regular expression, a case insensitive substring and a length in
+	// bytes to exceed.
+	Regex      string `toml:"regex"`
+	Contains   string `toml:"contains"`
+	LongerThan int    `toml:"longer_than"`
+
+	// What a match does: block (the default), log or tag.
+	Action string `toml:"action"`
+
+	// Status of the blocked requests, 403 by default.
+	Status int `toml:"status"`
+
+	// Tag of tag rules, the ID by default.
+	Tag string `toml:"tag"`
+
+	regex *regexp.Regexp
+}
+
+// compile checks the rule, fills its defaults and compiles its regular
+// expression.
+func (rule *Rule) compile() error {
+	if rule.ID == "" {
+		return fmt.Errorf("rule without id")
+	}
+	if len(rule.Targets) == 0 {
+		return fmt.Errorf("rule %s: no targets", rule.ID)
+	}
+	for _, target := range rule.Targets {
+		if !slices.Contains([]string{"method", "path", "query", "headers", "body"}, target) &&
+			(!strings.HasPrefix(target, "header:") || target == "header:") {
+			return fmt.Errorf("rule %s: invalid target %q", rule.ID, target)
+		}
+	}
+
+	if rule.Regex == "" && rule.Contains == "" && rule.LongerThan == 0 {
+		return fmt.Errorf("rule %s: no regex, contains or longer_than", rule.ID)
+	}
+	if rule.Regex != "" {
+		compiled, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+		rule.regex = compiled
+	}
+	rule.Contains = strings.ToLower(rule.Contains)
+	if rule.LongerThan < 0 {
+		return fmt.Errorf("rule %s: invalid longer_than", rule.ID)
+	}
+
+	switch rule.Action {
+	case "":
+		rule.Action = "block"
+	case "block", "log", "tag":
+	default:
+		return fmt.Errorf("rule %s: invalid action %q", rule.ID, rule.Action)
+	}
+	if rule.Status == 0 {
+		rule.Status = http.StatusForbidden
+	}
+	if rule.Status < 400 || rule.Status > 599 {
+		return fmt.Errorf("rule %s: invalid status %d", rule.ID, rule.Status)
+	}
+	if rule.Tag == "" {
+		rule.Tag = rule.ID
+	}
+
+	return nil
+}
+
+// matches tells whether a value of a target of req satisfies every
+// predicate of the rule.
+func (rule *Rule) matches(req *request) bool {
+	for _, target := range rule.Targets {
+		if rule.LongerThan > 0 && req.size(target) <= rule.LongerThan {
+			continue
+		}
+		if rule.regex == nil && rule.Contains == "" {
+			return true
+		}
+		for _, value := range req.values(target) {
+			if (rule.regex == nil || rule.regex.MatchString(value)) &&
+				(rule.Contains == "" || strings.Contains(strings.ToLower(value), rule.Contains)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Built-in rules, signatures of common attacks.
+var builtinRules = mustCompile([]Rule{
+	{
+		ID:      "builtin-path-traversal",
+		Targets: []string{"path", "query"},
+		Regex:   `(?:^|[/\\=])\.\.(?:[/\\]|$)`,
+	},
+	{
+		ID:      "builtin-sensitive-files",
+		Targets: []string{"path", "query"},
+		Regex:   `(?i)(?:/etc/(?:passwd|shadow|hosts)\b|\bwin\.ini\b|\bboot\.ini\b|/proc/self/)`,
+	},
+	{
+		ID:      "builtin-sql-injection",
+		Targets: []string{"query", "body"},
+		Regex: `(?i)(?:\bunion\b[\s(/*]+(?:all[\s(/*]+)?select\b` +
+			`|['"]\s*(?:or|and)\s+['"]?\w+['"]?\s*(?:=|like)\s*['"]?\w+` +
+			`|;\s*(?:drop|truncate|alter)\s+table\b` +
+			`|\b(?:sleep|benchmark|pg_sleep)\s*\(\s*\d` +
+			`|\bwaitfor\s+delay\s+'` +
+			`|\binformation_schema\b)`,
+	},
+	{
+		ID:      "builtin-xss",
+		Targets: []string{"query", "body"},
+		Regex: `(?i)(?:<\s*script\b|<\s*/\s*script\s*>|\bjavascript\s*:` +
+			`|<[^>]*\bon(?:error|load|mouseover|focus|blur|click|toggle|animationstart)\s*=` +
+			`|<\s*(?:iframe|object|embed)\b|\bdocument\.(?:cookie|domain)\b)`,
+	},
+})
+
+func mustCompile(rules []Rule) []*Rule {
+	compiled := make([]*Rule, len(rules))
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			panic(err)
+		}
+		compiled[i] = &rules[i]
+	}
+	return compiled
+}
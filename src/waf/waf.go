@@ -0,0 +1,129 @@
+// Package waf is a lightweight web application firewall: rules inspect the
+// parts of requests and block them, log them or tag them for the backends.
+package waf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"roxy/src/config"
+	"roxy/src/watch"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Firewall applies the [`config.WAF`] options of a pattern.
+type Firewall struct {
+	options *config.WAF
+	builtin []*Rule
+	files   []*watch.File[[]*Rule]
+
+	// Called with the errors of the rule files, the previous rules stay in
+	// force until they are fixed.
+	ErrorLog func(error)
+}
+
+// Verdict is the outcome of the inspection of a request.
+type Verdict struct {
+	// Status refusing the request, 0 if it may go on.
+	Status int
+
+	// Rules the request matched, as id(action).
+	Matches []string
+
+	// Tags of the matching tag rules.
+	Tags []string
+}
+
+// New creates the firewall described by options and loads its rule files.
+func New(options *config.WAF) (*Firewall, error) {
+	firewall := &Firewall{options: options}
+	if !options.DisableBuiltinRules {
+		firewall.builtin = builtinRules
+	}
+
+	for _, path := range options.RuleFiles {
+		file, err := watch.NewFile(path, parseRules)
+		if err != nil {
+			return nil, err
+		}
+		firewall.files = append(firewall.files, file)
+	}
+
+	return firewall, nil
+}
+
+// Inspect evaluates the rules against r, until one blocks it, and sets the
+// tag header of r. The start of the body is read, and put back in front of
+// the rest. The error is returned when the body can't be read.
+func (f *Firewall) Inspect(r *http.Request) (Verdict, error) {
+	r.Header.Del(f.options.TagHeader)
+
+	var body []byte
+	if f.options.BodyLimit > 0 && r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, int64(f.options.BodyLimit)))
+		if err != nil {
+			return Verdict{}, err
+		}
+		r.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+	}
+	req := newRequest(r, body)
+
+	rules := f.builtin
+	now := time.Now()
+	for _, file := range f.files {
+		fileRules, err := file.Get(now)
+		if err != nil && f.ErrorLog != nil {
+			f.ErrorLog(err)
+		}
+		rules = append(rules[:len(rules):len(rules)], fileRules...)
+	}
+
+	var verdict Verdict
+	for _, rule := range rules {
+		if !rule.matches(req) {
+			continue
+		}
+		verdict.Matches = append(verdict.Matches, fmt.Sprintf("%s(%s)", rule.ID, rule.Action))
+		switch rule.Action {
+		case "tag":
+			verdict.Tags = append(verdict.Tags, rule.Tag)
+		case "block":
+			verdict.Status = rule.Status
+			return verdict, nil
+		}
+	}
+
+	if len(verdict.Tags) > 0 {
+		r.Header.Set(f.options.TagHeader, strings.Join(verdict.Tags, ","))
+	}
+	return verdict, nil
+}
+
+// prefixedBody is a request body whose start was read for inspection.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// parseRules reads a file of [[rule]] tables.
+func parseRules(data []byte) ([]*Rule, error) {
+	var file struct {
+		Rule []Rule `toml:"rule"`
+	}
+	if _, err := toml.Decode(string(data), &file); err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, len(file.Rule))
+	for i := range file.Rule {
+		if err := file.Rule[i].compile(); err != nil {
+			return nil, err
+		}
+		rules[i] = &file.Rule[i]
+	}
+	return rules, nil
+}
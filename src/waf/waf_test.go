@@ -0,0 +1,116 @@
+package waf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"roxy/src/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuiltinRules(t *testing.T) {
+	firewall, err := New(&config.WAF{BodyLimit: 1024, TagHeader: "X-WAF-Tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]string{
+		"/static/app.js?v=2":                           "",
+		"/search?q=union+station&sort=asc":             "",
+		"/static/../../etc/passwd":                     "builtin-path-traversal(block)",
+		"/download?file=%252e%252e%252fsecret":         "builtin-path-traversal(block)",
+		"/items?id=1%27%20OR%20%271%27%3D%271":         "builtin-sql-injection(block)",
+		"/items?id=1+UNION+ALL+SELECT+password":        "builtin-sql-injection(block)",
+		"/comment?text=%3Cscript%3Ealert(1)%3C/script": "builtin-xss(block)",
+		"/comment?text=<img+src=x+onerror=alert(1)>":   "builtin-xss(block)",
+	} {
+		verdict, err := firewall.Inspect(httptest.NewRequest("GET", target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(verdict.Matches, ", ")
+		if got != want || (want != "" && verdict.Status != http.StatusForbidden) {
+			t.Errorf("%s: matches %q, status %d, want %q", target, got, verdict.Status, want)
+		}
+	}
+
+	// The inspected start of the body still reaches the backend.
+	body := "name=x&bio=" + strings.Repeat("a", 2000)
+	r := httptest.NewRequest("POST", "/profile", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if verdict, _ := firewall.Inspect(r); verdict.Status != 0 {
+		t.Errorf("harmless body: %v", verdict)
+	}
+	if read, _ := io.ReadAll(r.Body); string(read) != body {
+		t.Errorf("body altered, %d bytes", len(read))
+	}
+
+	r = httptest.NewRequest("POST", "/profile", strings.NewReader("bio=%3Csvg%20onload%3Dalert(1)%3E"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if verdict, _ := firewall.Inspect(r); verdict.Status != http.StatusForbidden {
+		t.Errorf("XSS in the body: %v", verdict)
+	}
+}
+
+func TestRuleFiles(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.toml")
+	os.WriteFile(rules, []byte(`
+		[[rule]]
+		id = "scanner"
+		targets = ["header:User-Agent"]
+		contains = "sqlmap"
+		action = "log"
+
+		[[rule]]
+		id = "internal"
+		targets = ["path"]
+		regex = "^/internal/"
+		action = "tag"
+		tag = "internal-path"
+
+		[[rule]]
+		id = "long-query"
+		targets = ["query"]
+		longer_than = 64
+		status = 414
+	`), 0644)
+
+	firewall, err := New(&config.WAF{RuleFiles: []string{rules}, DisableBuiltinRules: true, TagHeader: "X-WAF-Tags"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/internal/metrics", nil)
+	r.Header.Set("User-Agent", "sqlmap/1.7")
+	r.Header.Set("X-WAF-Tags", "forged")
+	verdict, _ := firewall.Inspect(r)
+	if verdict.Status != 0 || strings.Join(verdict.Matches, ", ") != "scanner(log), internal(tag)" || r.Header.Get("X-WAF-Tags") != "internal-path" {
+		t.Errorf("log and tag rules: %+v, tags %q", verdict, r.Header.Get("X-WAF-Tags"))
+	}
+
+	if verdict, _ := firewall.Inspect(httptest.NewRequest("GET", "/?q="+strings.Repeat("a", 100), nil)); verdict.Status != 414 {
+		t.Errorf("long query: %+v", verdict)
+	}
+
+	// The file is read again once it changes, and kept when broken.
+	os.WriteFile(rules, []byte("[[rule]]\nid = \"all\"\ntargets = [\"method\"]\ncontains = \"get\"\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(rules, later, later)
+	firewall.files[0].Expire()
+	if verdict, _ := firewall.Inspect(httptest.NewRequest("GET", "/", nil)); verdict.Status != http.StatusForbidden {
+		t.Errorf("reloaded rules: %+v", verdict)
+	}
+
+	os.WriteFile(rules, []byte("[[rule]]\nid = \"broken\"\ntargets = [\"cookies\"]\nregex = \"x\"\n"), 0644)
+	os.Chtimes(rules, later.Add(time.Minute), later.Add(time.Minute))
+	firewall.files[0].Expire()
+	var logged error
+	firewall.ErrorLog = func(err error) { logged = err }
+	if verdict, _ := firewall.Inspect(httptest.NewRequest("GET", "/", nil)); verdict.Status != http.StatusForbidden || logged == nil {
+		t.Errorf("broken rules: %+v, error %v", verdict, logged)
+	}
+}
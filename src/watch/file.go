@@ -0,0 +1,82 @@
+// Package watch keeps the parsed content of configuration files, such as
+// password lists or rule files, that can be edited while roxy runs.
+package watch
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the files are checked for changes.
+const CheckInterval = time.Second
+
+// File is the parsed content of a file, parsed again when its modification
+// time changes. A file that can't be read or parsed keeps the previous
+// content in force.
+type File[T any] struct {
+	path  string
+	parse func([]byte) (T, error)
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	value   T
+}
+
+// NewFile reads and parses the file at path, failing if it can't.
+func NewFile[T any](path string, parse func([]byte) (T, error)) (*File[T], error) {
+	file := &File[T]{path: path, parse: parse}
+	if err := file.reload(); err != nil {
+		return nil, err
+	}
+	file.checked = time.Now()
+	return file, nil
+}
+
+// Get returns the content of the file, and the error of the file when it was
+// read again and couldn't be loaded.
+func (f *File[T]) Get(now time.Time) (T, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	if now.Sub(f.checked) >= CheckInterval {
+		f.checked = now
+		err = f.reload()
+	}
+	return f.value, err
+}
+
+// Expire makes the next call to Get check the file without waiting for the
+// check interval.
+func (f *File[T]) Expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checked = time.Time{}
+}
+
+// reload parses the file if it changed since it was last parsed.
+func (f *File[T]) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.value = value
+	f.modTime = info.ModTime()
+	return nil
+}